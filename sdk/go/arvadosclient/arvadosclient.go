@@ -4,30 +4,39 @@ package arvadosclient
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"regexp"
 	"strings"
+	"time"
 )
 
 // Errors
-var MissingArvadosApiHost = errors.New("Missing required environment variable ARVADOS_API_HOST")
-var MissingArvadosApiToken = errors.New("Missing required environment variable ARVADOS_API_TOKEN")
+var MissingArvadosApiHost = errors.New("Missing required setting ARVADOS_API_HOST")
+var MissingArvadosApiToken = errors.New("Missing required setting ARVADOS_API_TOKEN")
 
+// An error response from the API server.  ErrorDetails holds the reasons
+// the server gave in the "errors" list of the response, if any; the error
+// message is made from them, or from HttpStatus if there are none.
 type ArvadosApiError struct {
 	error
 	HttpStatusCode int
 	HttpStatus string
+	ErrorDetails []string
 }
 
 func (e ArvadosApiError) Error() string { return e.error.Error() }
 
+// Report whether err is an ArvadosApiError with the given HTTP status code.
+func IsApiError(err error, statusCode int) bool {
+	var apiErr ArvadosApiError
+	return errors.As(err, &apiErr) && apiErr.HttpStatusCode == statusCode
+}
+
 // Helper type so we don't have to write out 'map[string]interface{}' every time.
 type Dict map[string]interface{}
 
@@ -48,32 +57,32 @@ type ArvadosClient struct {
 	// If true, sets the X-External-Client header to indicate
 	// the client is outside the cluster.
 	External bool
-}
 
-// Create a new KeepClient, initialized with standard Arvados environment
-// variables ARVADOS_API_HOST, ARVADOS_API_TOKEN, and (optionally)
-// ARVADOS_API_HOST_INSECURE.
-func MakeArvadosClient() (kc ArvadosClient, err error) {
-	var matchTrue = regexp.MustCompile("^(?i:1|yes|true)$")
-	insecure := matchTrue.MatchString(os.Getenv("ARVADOS_API_HOST_INSECURE"))
-	external := matchTrue.MatchString(os.Getenv("ARVADOS_EXTERNAL_CLIENT"))
+	// How requests that fail with a transient error are retried.
+	Retry RetryPolicy
 
-	kc = ArvadosClient{
-		ApiServer:   os.Getenv("ARVADOS_API_HOST"),
-		ApiToken:    os.Getenv("ARVADOS_API_TOKEN"),
-		ApiInsecure: insecure,
-		Client: &http.Client{Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}}},
-		External: external}
+	// Time limit for each attempt at a request, including reading the
+	// response.  Zero means no limit.
+	Timeout time.Duration
 
-	if kc.ApiServer == "" {
-		return kc, MissingArvadosApiHost
-	}
-	if kc.ApiToken == "" {
-		return kc, MissingArvadosApiToken
-	}
+	// If true, each request is sent with a new request ID in the
+	// X-Request-Id header, unless its context has one (see
+	// WithRequestId).  Retries of a request use the same ID.
+	SendRequestIds bool
+
+	// Where failed attempts are reported.  If nil, the standard logger
+	// is used.
+	Logger Logger
+}
 
-	return kc, err
+// Create a new ArvadosClient, initialized with standard Arvados
+// environment variables ARVADOS_API_HOST, ARVADOS_API_TOKEN, and
+// (optionally) ARVADOS_API_HOST_INSECURE.  Settings missing from the
+// environment are read from the settings file of the profile named by
+// ARVADOS_PROFILE, or from ~/.config/arvados/settings.conf (see
+// LoadSettings).
+func MakeArvadosClient() (kc ArvadosClient, err error) {
+	return MakeArvadosClientProfile("")
 }
 
 // Low-level access to a resource.
@@ -88,23 +97,29 @@ func MakeArvadosClient() (kc ArvadosClient, err error) {
 //   reader - the body reader, or nil if there was an error
 //   err - error accessing the resource, or nil if no error
 func (this ArvadosClient) CallRaw(method string, resource string, uuid string, action string, parameters Dict) (reader io.ReadCloser, err error) {
-	var req *http.Request
+	return this.CallRawContext(context.Background(), method, resource, uuid, action, parameters)
+}
+
+// Like CallRaw, but the request is abandoned if ctx is cancelled or its
+// deadline passes.  The context also governs reads from the returned reader.
+func (this ArvadosClient) CallRawContext(ctx context.Context, method string, resource string, uuid string, action string, parameters Dict) (reader io.ReadCloser, err error) {
+	path := "/arvados/v1"
+	for _, part := range []string{resource, uuid, action} {
+		if part != "" {
+			path = path + "/" + part
+		}
+	}
+	return this.callPath(ctx, method, path, parameters)
+}
 
+// Make a request to the API server for 'path', such as
+// "/arvados/v1/collections", sending 'parameters' in the query string or
+// request body.  Failed attempts are logged, and retried as Retry allows.
+func (this ArvadosClient) callPath(ctx context.Context, method string, path string, parameters Dict) (reader io.ReadCloser, err error) {
 	u := url.URL{
 		Scheme: "https",
-		Host:   this.ApiServer}
-
-	u.Path = "/arvados/v1"
-
-	if resource != "" {
-		u.Path = u.Path + "/" + resource
-	}
-	if uuid != "" {
-		u.Path = u.Path + "/" + uuid
-	}
-	if action != "" {
-		u.Path = u.Path + "/" + action
-	}
+		Host:   this.ApiServer,
+		Path:   path}
 
 	if parameters == nil {
 		parameters = make(Dict)
@@ -120,13 +135,56 @@ func (this ArvadosClient) CallRaw(method string, resource string, uuid string, a
 		}
 	}
 
+	var body string
 	if method == "GET" || method == "HEAD" {
 		u.RawQuery = vals.Encode()
-		if req, err = http.NewRequest(method, u.String(), nil); err != nil {
+	} else {
+		body = vals.Encode()
+	}
+
+	requestId := this.requestId(ctx)
+	label := method + " " + path
+	if requestId != "" {
+		label = requestId + " " + label
+	}
+	for attempt := 1; ; attempt++ {
+		reader, err = this.attempt(ctx, method, u.String(), body, requestId)
+		if err == nil {
+			return reader, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		status := statusCode(err)
+		if !idempotent(method) || !this.Retry.ShouldRetry(status, err) || attempt >= this.Retry.MaxAttempts() {
+			if attempt > 1 {
+				this.logf("API request %s failed after %d attempts: %v", label, attempt, err)
+			}
+			return nil, err
+		}
+		this.logf("API request %s attempt %d failed, retrying: %v", label, attempt, err)
+		if err := this.Retry.Wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Make a single attempt at a request, which gives up after Timeout.
+func (this ArvadosClient) attempt(ctx context.Context, method string, url string, body string, requestId string) (reader io.ReadCloser, err error) {
+	cancel := context.CancelFunc(func() {})
+	if this.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, this.Timeout)
+	}
+
+	var req *http.Request
+	if method == "GET" || method == "HEAD" {
+		if req, err = http.NewRequestWithContext(ctx, method, url, nil); err != nil {
+			cancel()
 			return nil, err
 		}
 	} else {
-		if req, err = http.NewRequest(method, u.String(), bytes.NewBufferString(vals.Encode())); err != nil {
+		if req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBufferString(body)); err != nil {
+			cancel()
 			return nil, err
 		}
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -137,26 +195,32 @@ func (this ArvadosClient) CallRaw(method string, resource string, uuid string, a
 	if this.External {
 		req.Header.Add("X-External-Client", "1")
 	}
+	if requestId != "" {
+		req.Header.Add(X_Request_Id, requestId)
+	}
 
 	// Make the request
 	var resp *http.Response
 	if resp, err = this.Client.Do(req); err != nil {
+		cancel()
 		return nil, err
 	}
 
 	if resp.StatusCode == http.StatusOK {
-		return resp.Body, nil
+		return cancelOnClose{resp.Body, cancel}, nil
 	}
 
+	defer cancel()
+
 	defer resp.Body.Close()
 	errorText := fmt.Sprintf("API response: %s", resp.Status)
 
 	// If the response body has {"errors":["reason1","reason2"]}
 	// then return those reasons.
+	var errorStrings []string
 	var errInfo = Dict{}
 	if err := json.NewDecoder(resp.Body).Decode(&errInfo); err == nil {
 		if errorList, ok := errInfo["errors"]; ok {
-			var errorStrings []string
 			if errArray, ok := errorList.([]interface{}); ok {
 				for _, errItem := range errArray {
 					// We expect an array of strings here.
@@ -168,11 +232,13 @@ func (this ArvadosClient) CallRaw(method string, resource string, uuid string, a
 						errorStrings = append(errorStrings, string(j))
 					}
 				}
-				errorText = strings.Join(errorStrings, "; ")
 			}
 		}
 	}
-	return nil, ArvadosApiError{errors.New(errorText), resp.StatusCode, resp.Status}
+	if len(errorStrings) > 0 {
+		errorText = strings.Join(errorStrings, "; ")
+	}
+	return nil, ArvadosApiError{errors.New(errorText), resp.StatusCode, resp.Status, errorStrings}
 }
 
 // Access to a resource.
@@ -186,8 +252,14 @@ func (this ArvadosClient) CallRaw(method string, resource string, uuid string, a
 // return
 //   err - error accessing the resource, or nil if no error
 func (this ArvadosClient) Call(method string, resource string, uuid string, action string, parameters Dict, output interface{}) (err error) {
+	return this.CallContext(context.Background(), method, resource, uuid, action, parameters, output)
+}
+
+// Like Call, but the request is abandoned if ctx is cancelled or its deadline
+// passes.
+func (this ArvadosClient) CallContext(ctx context.Context, method string, resource string, uuid string, action string, parameters Dict, output interface{}) (err error) {
 	var reader io.ReadCloser
-	reader, err = this.CallRaw(method, resource, uuid, action, parameters)
+	reader, err = this.CallRawContext(ctx, method, resource, uuid, action, parameters)
 	if reader != nil {
 		defer reader.Close()
 	}
@@ -212,7 +284,13 @@ func (this ArvadosClient) Call(method string, resource string, uuid string, acti
 // return
 //   err - error accessing the resource, or nil if no error
 func (this ArvadosClient) Create(resource string, parameters Dict, output interface{}) (err error) {
-	return this.Call("POST", resource, "", "", parameters, output)
+	return this.CreateContext(context.Background(), resource, parameters, output)
+}
+
+// Like Create, but the request is abandoned if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) CreateContext(ctx context.Context, resource string, parameters Dict, output interface{}) (err error) {
+	return this.CallContext(ctx, "POST", resource, "", "", parameters, output)
 }
 
 // Delete an instance of a resource.
@@ -224,7 +302,31 @@ func (this ArvadosClient) Create(resource string, parameters Dict, output interf
 // return
 //   err - error accessing the resource, or nil if no error
 func (this ArvadosClient) Delete(resource string, uuid string, parameters Dict, output interface{}) (err error) {
-	return this.Call("DELETE", resource, uuid, "", parameters, output)
+	return this.DeleteContext(context.Background(), resource, uuid, parameters, output)
+}
+
+// Like Delete, but the request is abandoned if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) DeleteContext(ctx context.Context, resource string, uuid string, parameters Dict, output interface{}) (err error) {
+	return this.CallContext(ctx, "DELETE", resource, uuid, "", parameters, output)
+}
+
+// Get a single instance of a resource.
+//
+//   resource - the arvados resource to get the item from
+//   uuid - the item to get
+//   parameters - method parameters
+//   output - a map or annotated struct which is a legal target for encoding/json/Decoder
+// return
+//   err - error accessing the resource, or nil if no error
+func (this ArvadosClient) Get(resource string, uuid string, parameters Dict, output interface{}) (err error) {
+	return this.GetContext(context.Background(), resource, uuid, parameters, output)
+}
+
+// Like Get, but the request is abandoned if ctx is cancelled or its deadline
+// passes.
+func (this ArvadosClient) GetContext(ctx context.Context, resource string, uuid string, parameters Dict, output interface{}) (err error) {
+	return this.CallContext(ctx, "GET", resource, uuid, "", parameters, output)
 }
 
 // Update fields of an instance of a resource.
@@ -236,7 +338,13 @@ func (this ArvadosClient) Delete(resource string, uuid string, parameters Dict,
 // return
 //   err - error accessing the resource, or nil if no error
 func (this ArvadosClient) Update(resource string, uuid string, parameters Dict, output interface{}) (err error) {
-	return this.Call("PUT", resource, uuid, "", parameters, output)
+	return this.UpdateContext(context.Background(), resource, uuid, parameters, output)
+}
+
+// Like Update, but the request is abandoned if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) UpdateContext(ctx context.Context, resource string, uuid string, parameters Dict, output interface{}) (err error) {
+	return this.CallContext(ctx, "PUT", resource, uuid, "", parameters, output)
 }
 
 // List the instances of a resource
@@ -247,5 +355,11 @@ func (this ArvadosClient) Update(resource string, uuid string, parameters Dict,
 // return
 //   err - error accessing the resource, or nil if no error
 func (this ArvadosClient) List(resource string, parameters Dict, output interface{}) (err error) {
-	return this.Call("GET", resource, "", "", parameters, output)
+	return this.ListContext(context.Background(), resource, parameters, output)
+}
+
+// Like List, but the request is abandoned if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) ListContext(ctx context.Context, resource string, parameters Dict, output interface{}) (err error) {
+	return this.CallContext(ctx, "GET", resource, "", "", parameters, output)
 }
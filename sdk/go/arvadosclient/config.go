@@ -0,0 +1,170 @@
+/* Reads client settings from the environment and from settings files. */
+
+package arvadosclient
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var UnknownProfile = errors.New("No settings file for profile")
+
+// The profile used if none is named, read from settings.conf.
+const DEFAULT_PROFILE = "settings"
+
+// The settings needed to connect to an API server.  Each has the name it
+// has in the environment and in settings files, given below.
+type Settings struct {
+	// ARVADOS_API_HOST, in the form "host:port"
+	ApiHost string
+
+	// ARVADOS_API_TOKEN
+	ApiToken string
+
+	// ARVADOS_API_HOST_INSECURE: whether to skip checking the API
+	// server's SSL certificate
+	ApiInsecure bool
+
+	// ARVADOS_EXTERNAL_CLIENT: whether the client is outside the
+	// cluster
+	External bool
+}
+
+var matchTrue = regexp.MustCompile("^(?i:1|yes|true)$")
+
+// Set the setting with the given name, such as "ARVADOS_API_HOST".
+// Returns false if there is no setting with that name.
+func (this *Settings) set(name string, value string) bool {
+	switch name {
+	case "ARVADOS_API_HOST":
+		this.ApiHost = value
+	case "ARVADOS_API_TOKEN":
+		this.ApiToken = value
+	case "ARVADOS_API_HOST_INSECURE":
+		this.ApiInsecure = matchTrue.MatchString(value)
+	case "ARVADOS_EXTERNAL_CLIENT":
+		this.External = matchTrue.MatchString(value)
+	default:
+		return false
+	}
+	return true
+}
+
+// The directory that holds settings files: $XDG_CONFIG_HOME/arvados, or
+// ~/.config/arvados if XDG_CONFIG_HOME is not set.
+func ConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "arvados")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "arvados")
+}
+
+// The settings file for a profile, such as ~/.config/arvados/settings.conf
+// for DEFAULT_PROFILE, or ~/.config/arvados/cluster2.conf for "cluster2".
+func ProfilePath(profile string) string {
+	return filepath.Join(ConfigDir(), profile+".conf")
+}
+
+// Read a settings file.  Each line is either blank, a comment starting
+// with "#", or a setting in the form NAME=VALUE:
+//
+//   ARVADOS_API_HOST=zzzzz.arvadosapi.com
+//   ARVADOS_API_TOKEN=...
+//
+// Settings this client does not use are ignored.
+func ReadSettingsFile(path string) (settings Settings, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return settings, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return settings, fmt.Errorf("%s:%d: expected NAME=VALUE", path, lineno)
+		}
+		settings.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return settings, scanner.Err()
+}
+
+// Get the settings for a profile.  Each setting is taken from the first of
+// these that has it:
+//
+//   1. the environment
+//   2. the profile's settings file (see ProfilePath)
+//
+// If 'profile' is empty, the ARVADOS_PROFILE environment variable names
+// the profile, or DEFAULT_PROFILE is used if it is not set either.  The
+// default profile's file need not exist, but a named profile's must.
+func LoadSettings(profile string) (settings Settings, err error) {
+	if profile == "" {
+		profile = os.Getenv("ARVADOS_PROFILE")
+	}
+	if profile == "" {
+		profile = DEFAULT_PROFILE
+	}
+
+	settings, err = ReadSettingsFile(ProfilePath(profile))
+	if os.IsNotExist(err) {
+		if profile != DEFAULT_PROFILE {
+			return settings, fmt.Errorf("%w %q (%s)", UnknownProfile, profile, ProfilePath(profile))
+		}
+		err = nil
+	}
+	if err != nil {
+		return settings, err
+	}
+
+	for _, name := range []string{"ARVADOS_API_HOST", "ARVADOS_API_TOKEN", "ARVADOS_API_HOST_INSECURE", "ARVADOS_EXTERNAL_CLIENT"} {
+		if value, ok := os.LookupEnv(name); ok {
+			settings.set(name, value)
+		}
+	}
+	return settings, nil
+}
+
+// Create a new ArvadosClient with the settings of the given profile, as
+// returned by LoadSettings.
+func MakeArvadosClientProfile(profile string) (ArvadosClient, error) {
+	settings, err := LoadSettings(profile)
+	if err != nil {
+		return ArvadosClient{}, err
+	}
+	return MakeArvadosClientWithSettings(settings)
+}
+
+// Create a new ArvadosClient with the given settings.  Neither the
+// environment nor any settings file is read.
+func MakeArvadosClientWithSettings(settings Settings) (kc ArvadosClient, err error) {
+	kc = ArvadosClient{
+		ApiServer:   settings.ApiHost,
+		ApiToken:    settings.ApiToken,
+		ApiInsecure: settings.ApiInsecure,
+		Client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: settings.ApiInsecure}}},
+		External: settings.External,
+		Retry:    DefaultRetryPolicy,
+		Timeout:  DEFAULT_TIMEOUT}
+
+	if kc.ApiServer == "" {
+		return kc, MissingArvadosApiHost
+	}
+	if kc.ApiToken == "" {
+		return kc, MissingArvadosApiToken
+	}
+	return kc, nil
+}
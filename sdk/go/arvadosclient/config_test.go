@@ -0,0 +1,132 @@
+package arvadosclient
+
+import (
+	"errors"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Point the settings files at an empty directory, and clear the client
+// settings from the environment.  Returns a function that undoes this.
+func setupSettingsEnv(c *C) (restore func()) {
+	dir := c.MkDir()
+	names := []string{"XDG_CONFIG_HOME", "ARVADOS_PROFILE", "ARVADOS_API_HOST",
+		"ARVADOS_API_TOKEN", "ARVADOS_API_HOST_INSECURE", "ARVADOS_EXTERNAL_CLIENT"}
+	saved := make(map[string]*string)
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			saved[name] = &value
+		} else {
+			saved[name] = nil
+		}
+		os.Unsetenv(name)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	os.MkdirAll(filepath.Join(dir, "arvados"), 0700)
+	return func() {
+		for name, value := range saved {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+func writeProfile(c *C, profile string, text string) {
+	c.Assert(ioutil.WriteFile(ProfilePath(profile), []byte(text), 0600), IsNil)
+}
+
+func (s *StandaloneSuite) TestReadSettingsFile(c *C) {
+	restore := setupSettingsEnv(c)
+	defer restore()
+
+	writeProfile(c, DEFAULT_PROFILE, `
+# a comment
+ARVADOS_API_HOST=zzzzz.example.com
+ARVADOS_API_TOKEN = abc=def
+ARVADOS_API_HOST_INSECURE=yes
+ARVADOS_UNUSED=1
+`)
+	settings, err := ReadSettingsFile(ProfilePath(DEFAULT_PROFILE))
+	c.Assert(err, IsNil)
+	c.Check(settings, DeepEquals, Settings{
+		ApiHost:     "zzzzz.example.com",
+		ApiToken:    "abc=def",
+		ApiInsecure: true})
+
+	writeProfile(c, "bad", "ARVADOS_API_HOST=x\nnonsense\n")
+	_, err = ReadSettingsFile(ProfilePath("bad"))
+	c.Check(err, ErrorMatches, `.*bad.conf:2: expected NAME=VALUE`)
+}
+
+func (s *StandaloneSuite) TestMakeClientFromSettingsFile(c *C) {
+	restore := setupSettingsEnv(c)
+	defer restore()
+
+	_, err := MakeArvadosClient()
+	c.Check(err, Equals, MissingArvadosApiHost)
+
+	writeProfile(c, DEFAULT_PROFILE, "ARVADOS_API_HOST=zzzzz.example.com\nARVADOS_API_TOKEN=abc\n")
+	arv, err := MakeArvadosClient()
+	c.Assert(err, IsNil)
+	c.Check(arv.ApiServer, Equals, "zzzzz.example.com")
+	c.Check(arv.ApiToken, Equals, "abc")
+	c.Check(arv.Retry, DeepEquals, DefaultRetryPolicy)
+}
+
+func (s *StandaloneSuite) TestEnvironmentOverridesSettingsFile(c *C) {
+	restore := setupSettingsEnv(c)
+	defer restore()
+
+	writeProfile(c, DEFAULT_PROFILE, "ARVADOS_API_HOST=zzzzz.example.com\nARVADOS_API_TOKEN=abc\n")
+	os.Setenv("ARVADOS_API_TOKEN", "fromenv")
+	os.Setenv("ARVADOS_API_HOST_INSECURE", "true")
+
+	arv, err := MakeArvadosClient()
+	c.Assert(err, IsNil)
+	c.Check(arv.ApiServer, Equals, "zzzzz.example.com")
+	c.Check(arv.ApiToken, Equals, "fromenv")
+	c.Check(arv.ApiInsecure, Equals, true)
+}
+
+func (s *StandaloneSuite) TestNamedProfiles(c *C) {
+	restore := setupSettingsEnv(c)
+	defer restore()
+
+	writeProfile(c, DEFAULT_PROFILE, "ARVADOS_API_HOST=zzzzz.example.com\nARVADOS_API_TOKEN=abc\n")
+	writeProfile(c, "yyyyy", "ARVADOS_API_HOST=yyyyy.example.com\nARVADOS_API_TOKEN=def\n")
+
+	arv, err := MakeArvadosClientProfile("yyyyy")
+	c.Assert(err, IsNil)
+	c.Check(arv.ApiServer, Equals, "yyyyy.example.com")
+	c.Check(arv.ApiToken, Equals, "def")
+
+	os.Setenv("ARVADOS_PROFILE", "yyyyy")
+	arv, err = MakeArvadosClient()
+	c.Assert(err, IsNil)
+	c.Check(arv.ApiServer, Equals, "yyyyy.example.com")
+
+	_, err = MakeArvadosClientProfile("xxxxx")
+	c.Check(errors.Is(err, UnknownProfile), Equals, true)
+}
+
+func (s *StandaloneSuite) TestMakeClientWithSettingsIgnoresEnvironment(c *C) {
+	restore := setupSettingsEnv(c)
+	defer restore()
+
+	writeProfile(c, DEFAULT_PROFILE, "ARVADOS_API_HOST=zzzzz.example.com\nARVADOS_API_TOKEN=abc\n")
+	os.Setenv("ARVADOS_API_HOST", "fromenv.example.com")
+
+	arv, err := MakeArvadosClientWithSettings(Settings{ApiHost: "explicit.example.com", ApiToken: "ghi"})
+	c.Assert(err, IsNil)
+	c.Check(arv.ApiServer, Equals, "explicit.example.com")
+	c.Check(arv.ApiToken, Equals, "ghi")
+	c.Check(arv.ApiInsecure, Equals, false)
+
+	_, err = MakeArvadosClientWithSettings(Settings{ApiHost: "explicit.example.com"})
+	c.Check(err, Equals, MissingArvadosApiToken)
+}
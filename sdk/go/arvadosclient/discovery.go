@@ -0,0 +1,235 @@
+/* Reads the API server's discovery document, and makes calls described by it. */
+
+package arvadosclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var InvalidApiCall = errors.New("Invalid API call")
+
+// Where the API server publishes its discovery document.
+const DISCOVERY_PATH = "/discovery/v1/apis/arvados/v1/rest"
+
+// The API server's description of itself: its resources, their methods
+// and parameters, and the values it advertises to clients.
+type DiscoveryDocument struct {
+	// How long, in seconds, the permission signatures on block
+	// locators are valid
+	BlobSignatureTtl int64 `json:"blobSignatureTtl"`
+
+	// The number of replicas of a collection's blocks to store, if the
+	// collection does not say
+	DefaultCollectionReplication int `json:"defaultCollectionReplication"`
+
+	Revision string `json:"revision"`
+
+	// Parameters accepted by every method
+	Parameters map[string]DiscoveryParameter `json:"parameters"`
+
+	Resources map[string]DiscoveryResource `json:"resources"`
+
+	// Every top-level value in the document, keyed by name
+	Values map[string]interface{} `json:"-"`
+}
+
+type DiscoveryResource struct {
+	Methods map[string]DiscoveryMethod `json:"methods"`
+}
+
+type DiscoveryMethod struct {
+	// Relative to /arvados/v1/, with path parameters in braces, such
+	// as "collections/{uuid}"
+	Path       string                        `json:"path"`
+	HttpMethod string                        `json:"httpMethod"`
+	Parameters map[string]DiscoveryParameter `json:"parameters"`
+
+	// The resource attributes the method accepts, if any, such as
+	// "collection" for collections.create
+	Request *struct {
+		Required   bool                   `json:"required"`
+		Properties map[string]interface{} `json:"properties"`
+	} `json:"request"`
+}
+
+type DiscoveryParameter struct {
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+
+	// "path" or "query"
+	Location string `json:"location"`
+}
+
+// Discovery documents fetched so far, keyed by API server.  The document
+// changes only when the API server is upgraded, so it is fetched once per
+// process.
+var discoveryCache = struct {
+	lock sync.Mutex
+	docs map[string]*DiscoveryDocument
+}{docs: make(map[string]*DiscoveryDocument)}
+
+// Get the API server's discovery document, fetching it if it has not been
+// fetched already.
+func (this ArvadosClient) Discovery() (*DiscoveryDocument, error) {
+	return this.DiscoveryContext(context.Background())
+}
+
+// Like Discovery, but the request is abandoned if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) DiscoveryContext(ctx context.Context) (*DiscoveryDocument, error) {
+	discoveryCache.lock.Lock()
+	doc, ok := discoveryCache.docs[this.ApiServer]
+	discoveryCache.lock.Unlock()
+	if ok {
+		return doc, nil
+	}
+
+	reader, err := this.callPath(ctx, "GET", DISCOVERY_PATH, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var raw json.RawMessage
+	if err := json.NewDecoder(reader).Decode(&raw); err != nil {
+		return nil, err
+	}
+	doc = &DiscoveryDocument{}
+	if err := json.Unmarshal(raw, doc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &doc.Values); err != nil {
+		return nil, err
+	}
+
+	discoveryCache.lock.Lock()
+	discoveryCache.docs[this.ApiServer] = doc
+	discoveryCache.lock.Unlock()
+	return doc, nil
+}
+
+// Check that 'resource' has a method named 'method', that every one of
+// 'parameters' is accepted by it, and that none it requires is missing.
+// Returns the method, or an error wrapping InvalidApiCall.
+func (this *DiscoveryDocument) Validate(resource string, method string, parameters Dict) (*DiscoveryMethod, error) {
+	r, ok := this.Resources[resource]
+	if !ok {
+		return nil, fmt.Errorf("%w: no resource %q", InvalidApiCall, resource)
+	}
+	m, ok := r.Methods[method]
+	if !ok {
+		return nil, fmt.Errorf("%w: no method %q for %s", InvalidApiCall, method, resource)
+	}
+
+	for name, value := range parameters {
+		if p, ok := m.Parameters[name]; ok {
+			if !p.accepts(value) {
+				return nil, fmt.Errorf("%w: parameter %q of %s.%s must be of type %s",
+					InvalidApiCall, name, resource, method, p.Type)
+			}
+			continue
+		}
+		_, global := this.Parameters[name]
+		body := m.Request != nil && m.Request.Properties[name] != nil
+		if !global && !body {
+			return nil, fmt.Errorf("%w: %s.%s has no parameter %q", InvalidApiCall, resource, method, name)
+		}
+	}
+
+	for name, p := range m.Parameters {
+		if _, ok := parameters[name]; p.Required && !ok {
+			return nil, fmt.Errorf("%w: %s.%s requires parameter %q", InvalidApiCall, resource, method, name)
+		}
+	}
+	if m.Request != nil && m.Request.Required {
+		found := false
+		for name := range m.Request.Properties {
+			if _, ok := parameters[name]; ok {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s.%s requires a request body", InvalidApiCall, resource, method)
+		}
+	}
+	return &m, nil
+}
+
+// Report whether 'value' can be sent as a parameter of this type.  Only
+// the scalar types are checked.
+func (this DiscoveryParameter) accepts(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	switch this.Type {
+	case "string":
+		return v.Kind() == reflect.String
+	case "boolean":
+		return v.Kind() == reflect.Bool
+	case "integer":
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return true
+		case reflect.Float32, reflect.Float64:
+			return v.Float() == float64(int64(v.Float()))
+		}
+		return false
+	}
+	return true
+}
+
+// Call a method described in the discovery document, such as
+// CallMethod("collections", "get", Dict{"uuid": uuid}, &c).  The
+// parameters are checked with Validate before anything is sent, and path
+// parameters such as "uuid" are put in the URL.
+//
+//   resource - the arvados resource, such as "collections"
+//   method - the name of the method, such as "list" or "get"
+//   parameters - method parameters
+//   output - a map or annotated struct which is a legal target for encoding/json/Decoder
+// return
+//   err - error accessing the resource, or nil if no error
+func (this ArvadosClient) CallMethod(resource string, method string, parameters Dict, output interface{}) error {
+	return this.CallMethodContext(context.Background(), resource, method, parameters, output)
+}
+
+// Like CallMethod, but the requests are abandoned if ctx is cancelled or
+// its deadline passes.
+func (this ArvadosClient) CallMethodContext(ctx context.Context, resource string, method string, parameters Dict, output interface{}) error {
+	doc, err := this.DiscoveryContext(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := doc.Validate(resource, method, parameters)
+	if err != nil {
+		return err
+	}
+
+	path := m.Path
+	query := make(Dict)
+	for name, value := range parameters {
+		if p, ok := m.Parameters[name]; ok && p.Location == "path" {
+			path = strings.Replace(path, "{"+name+"}", fmt.Sprint(value), -1)
+		} else {
+			query[name] = value
+		}
+	}
+
+	var reader io.ReadCloser
+	reader, err = this.callPath(ctx, m.HttpMethod, "/arvados/v1/"+path, query)
+	if reader != nil {
+		defer reader.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if output != nil {
+		return json.NewDecoder(reader).Decode(output)
+	}
+	return nil
+}
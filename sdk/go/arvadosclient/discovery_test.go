@@ -0,0 +1,141 @@
+package arvadosclient
+
+import (
+	"errors"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"sync"
+)
+
+const stubDiscoveryDocument = `{
+  "revision": "20150709",
+  "blobSignatureTtl": 1209600,
+  "defaultCollectionReplication": 3,
+  "uuidPrefix": "zzzzz",
+  "parameters": {
+    "alt": {"type": "string", "location": "query"}
+  },
+  "resources": {
+    "collections": {
+      "methods": {
+        "get": {
+          "path": "collections/{uuid}",
+          "httpMethod": "GET",
+          "parameters": {
+            "uuid": {"type": "string", "required": true, "location": "path"}
+          }
+        },
+        "list": {
+          "path": "collections",
+          "httpMethod": "GET",
+          "parameters": {
+            "limit": {"type": "integer", "location": "query"},
+            "filters": {"type": "array", "location": "query"}
+          }
+        },
+        "create": {
+          "path": "collections",
+          "httpMethod": "POST",
+          "parameters": {},
+          "request": {
+            "required": true,
+            "properties": {"collection": {"$ref": "Collection"}}
+          }
+        }
+      }
+    }
+  }
+}`
+
+// Serves a discovery document, and answers other requests with their
+// method and path.  Counts the requests for the discovery document.
+type StubDiscoveryHandler struct {
+	lock      sync.Mutex
+	discovery int
+}
+
+func (this *StubDiscoveryHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == DISCOVERY_PATH {
+		this.lock.Lock()
+		this.discovery += 1
+		this.lock.Unlock()
+		resp.Write([]byte(stubDiscoveryDocument))
+		return
+	}
+	req.ParseForm()
+	fmt.Fprintf(resp, `{"method":%q,"path":%q,"limit":%q}`, req.Method, req.URL.Path, req.Form.Get("limit"))
+}
+
+func (s *StandaloneSuite) TestDiscovery(c *C) {
+	api := &StubDiscoveryHandler{}
+	arv, stop := makeStubClient(api)
+	defer stop()
+
+	doc, err := arv.Discovery()
+	c.Assert(err, IsNil)
+	c.Check(doc.BlobSignatureTtl, Equals, int64(1209600))
+	c.Check(doc.DefaultCollectionReplication, Equals, 3)
+	c.Check(doc.Revision, Equals, "20150709")
+	c.Check(doc.Values["uuidPrefix"], Equals, "zzzzz")
+
+	// The document is fetched only once.
+	_, err = arv.Discovery()
+	c.Check(err, IsNil)
+	c.Check(api.discovery, Equals, 1)
+}
+
+func (s *StandaloneSuite) TestDiscoveryValidate(c *C) {
+	api := &StubDiscoveryHandler{}
+	arv, stop := makeStubClient(api)
+	defer stop()
+	doc, err := arv.Discovery()
+	c.Assert(err, IsNil)
+
+	for _, trial := range []struct {
+		resource string
+		method   string
+		params   Dict
+		err      string
+	}{
+		{"collections", "get", Dict{"uuid": "zzzzz-4zz18-000000000000000"}, ""},
+		{"collections", "list", Dict{"limit": 10, "filters": Where("a", "=", "b"), "alt": "json"}, ""},
+		{"collections", "list", Dict{"limit": 10.0}, ""},
+		{"collections", "create", Dict{"collection": Dict{"name": "foo"}}, ""},
+		{"bogus", "get", nil, `Invalid API call: no resource "bogus"`},
+		{"collections", "bogus", nil, `Invalid API call: no method "bogus" for collections`},
+		{"collections", "get", nil, `Invalid API call: collections.get requires parameter "uuid"`},
+		{"collections", "list", Dict{"bogus": 1}, `Invalid API call: collections.list has no parameter "bogus"`},
+		{"collections", "list", Dict{"limit": "ten"}, `Invalid API call: parameter "limit" of collections.list must be of type integer`},
+		{"collections", "list", Dict{"limit": 1.5}, `Invalid API call: parameter "limit" of collections.list must be of type integer`},
+		{"collections", "create", nil, `Invalid API call: collections.create requires a request body`},
+	} {
+		_, err := doc.Validate(trial.resource, trial.method, trial.params)
+		if trial.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, trial.err)
+			c.Check(errors.Is(err, InvalidApiCall), Equals, true)
+		}
+	}
+}
+
+func (s *StandaloneSuite) TestCallMethod(c *C) {
+	api := &StubDiscoveryHandler{}
+	arv, stop := makeStubClient(api)
+	defer stop()
+
+	var output map[string]string
+	err := arv.CallMethod("collections", "get", Dict{"uuid": "zzzzz-4zz18-000000000000000"}, &output)
+	c.Check(err, IsNil)
+	c.Check(output, DeepEquals, map[string]string{
+		"method": "GET", "path": "/arvados/v1/collections/zzzzz-4zz18-000000000000000", "limit": ""})
+
+	err = arv.CallMethod("collections", "list", Dict{"limit": 5}, &output)
+	c.Check(err, IsNil)
+	c.Check(output, DeepEquals, map[string]string{
+		"method": "GET", "path": "/arvados/v1/collections", "limit": "5"})
+
+	err = arv.CallMethod("collections", "create", Dict{}, &output)
+	c.Check(errors.Is(err, InvalidApiCall), Equals, true)
+}
@@ -0,0 +1,371 @@
+/* Receives log events from the API server's websocket as they happen. */
+
+package arvadosclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+)
+
+var EventStreamClosed = errors.New("EventStream is closed")
+
+// Where the API server accepts websocket connections, if its discovery
+// document does not give a websocketUrl.
+const WEBSOCKET_PATH = "/websocket"
+
+// A stream of the log events matching a set of subscriptions, delivered
+// on a channel as the API server records them.
+//
+// If the connection drops, the stream reconnects, waiting between attempts
+// as the client's Retry policy says, and resubscribes asking for the
+// events after the last one received, so none are missed.  It gives up
+// once Retry.Attempts attempts in a row have failed; the Events channel is
+// then closed and Err says why.
+//
+// Usage:
+//
+//   stream, err := arv.ListenEvents(0, Where("object_uuid", "=", uuid))
+//   ...
+//   defer stream.Close()
+//   for event := range stream.Events() {
+//           ...
+//   }
+//   if err := stream.Err(); err != nil {
+//           ...
+//   }
+type EventStream struct {
+	client ArvadosClient
+	ctx    context.Context
+	cancel context.CancelFunc
+	events chan Log
+
+	lock sync.Mutex
+	conn *websocket.Conn
+
+	// The filters of each subscription
+	filters []Filters
+
+	// The ID of the last event received
+	lastId int64
+
+	closed bool
+	err    error
+}
+
+// A request to the API server to start or stop sending events.
+type subscription struct {
+	Method    string  `json:"method"`
+	Filters   Filters `json:"filters"`
+	LastLogId int64   `json:"last_log_id,omitempty"`
+}
+
+// A message from the API server: either an event, or, if Id is zero, the
+// response to a subscription request.
+type eventMessage struct {
+	Log
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// Connect to the API server's websocket and subscribe to the events
+// matching each of 'filters'.  With no filters, every event the token can
+// see is received.  If lastId is not zero, events after the one with that ID
+// that happened before the connection are sent first.
+func (this ArvadosClient) ListenEvents(lastId int64, filters ...Filters) (*EventStream, error) {
+	return this.ListenEventsContext(context.Background(), lastId, filters...)
+}
+
+// Like ListenEvents, but the stream is closed if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) ListenEventsContext(ctx context.Context, lastId int64, filters ...Filters) (*EventStream, error) {
+	if len(filters) == 0 {
+		filters = []Filters{nil}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &EventStream{
+		client:  this,
+		ctx:     ctx,
+		cancel:  cancel,
+		events:  make(chan Log),
+		filters: filters,
+		lastId:  lastId,
+	}
+	conn, err := stream.connect()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go stream.run(conn)
+	return stream, nil
+}
+
+// The channel on which events are delivered.  It is closed when the
+// stream ends.
+func (this *EventStream) Events() <-chan Log {
+	return this.events
+}
+
+// Start receiving the events matching 'filters' as well.  Only events
+// that happen from now on are sent.
+func (this *EventStream) Subscribe(filters Filters) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return EventStreamClosed
+	}
+	this.filters = append(this.filters, filters)
+	if this.conn == nil {
+		// Sent when the stream reconnects.
+		return nil
+	}
+	return websocket.JSON.Send(this.conn, subscription{Method: "subscribe", Filters: filters})
+}
+
+// Stop receiving the events matching 'filters', which must be the filters
+// of an earlier subscription.
+func (this *EventStream) Unsubscribe(filters Filters) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return EventStreamClosed
+	}
+	for i, f := range this.filters {
+		if reflect.DeepEqual(f, filters) {
+			this.filters = append(this.filters[:i], this.filters[i+1:]...)
+			break
+		}
+	}
+	if this.conn == nil {
+		return nil
+	}
+	return websocket.JSON.Send(this.conn, subscription{Method: "unsubscribe", Filters: filters})
+}
+
+// The ID of the last event received, which can be given to ListenEvents
+// to pick up where this stream left off.
+func (this *EventStream) LastId() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.lastId
+}
+
+// The error that ended the stream, if any.  Nil until the Events channel
+// is closed, and if the stream was ended by Close.
+func (this *EventStream) Err() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.err
+}
+
+// Disconnect and end the stream.
+func (this *EventStream) Close() error {
+	this.lock.Lock()
+	this.closed = true
+	conn := this.conn
+	this.lock.Unlock()
+	this.cancel()
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// Receive events until the stream is closed, reconnecting each time the
+// connection drops.
+func (this *EventStream) run(conn *websocket.Conn) {
+	defer close(this.events)
+	var err error
+	failures := 0
+	for {
+		if conn != nil {
+			var received bool
+			received, err = this.receive(conn)
+			if received {
+				failures = 0
+			}
+			conn.Close()
+			this.lock.Lock()
+			this.conn = nil
+			this.lock.Unlock()
+		}
+		if this.ctx.Err() != nil {
+			this.finish(this.ctx.Err())
+			return
+		}
+		var subErr subscriptionError
+		if errors.As(err, &subErr) {
+			this.finish(err)
+			return
+		}
+		failures += 1
+		if failures >= this.client.Retry.MaxAttempts() {
+			this.client.logf("Event stream failed after %d attempts: %v", failures, err)
+			this.finish(err)
+			return
+		}
+		this.client.logf("Event stream attempt %d failed, reconnecting: %v", failures, err)
+		if this.client.Retry.Wait(this.ctx, failures) != nil {
+			this.finish(this.ctx.Err())
+			return
+		}
+		conn, err = this.connect()
+	}
+}
+
+// Record why the stream ended, unless it was ended by Close.
+func (this *EventStream) finish(err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if !this.closed {
+		this.err = err
+	}
+}
+
+// The API server refused a subscription.
+type subscriptionError struct {
+	status  int
+	message string
+}
+
+func (e subscriptionError) Error() string {
+	return fmt.Sprintf("Event subscription failed: %d %s", e.status, e.message)
+}
+
+// Deliver the events received on conn, skipping any already delivered,
+// until there is an error.  Reports whether any message was received, so
+// that a server which drops every connection at once is not retried
+// forever.
+func (this *EventStream) receive(conn *websocket.Conn) (received bool, err error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-this.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		var msg eventMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return received, err
+		}
+		received = true
+		if msg.Id == 0 {
+			if msg.Status >= 400 {
+				return received, subscriptionError{msg.Status, msg.Message}
+			}
+			continue
+		}
+
+		this.lock.Lock()
+		seen := msg.Id <= this.lastId
+		if !seen {
+			this.lastId = msg.Id
+		}
+		this.lock.Unlock()
+		if seen {
+			continue
+		}
+
+		select {
+		case this.events <- msg.Log:
+		case <-this.ctx.Done():
+			return received, this.ctx.Err()
+		}
+	}
+}
+
+// Open a websocket connection and send the subscriptions.
+func (this *EventStream) connect() (*websocket.Conn, error) {
+	location, err := this.client.websocketUrl(this.ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := websocket.NewConfig(location, "https://"+this.client.ApiServer)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = &tls.Config{InsecureSkipVerify: this.client.ApiInsecure}
+	if this.client.Client != nil {
+		if t, ok := this.client.Client.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			config.TlsConfig = t.TLSClientConfig.Clone()
+		}
+	}
+	if this.client.External {
+		config.Header.Add("X-External-Client", "1")
+	}
+
+	// DialConfig does not take a context, so wait for it here and close
+	// the connection if the context is done first.
+	type dialResult struct {
+		conn *websocket.Conn
+		err  error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := websocket.DialConfig(config)
+		dialed <- dialResult{conn, err}
+	}()
+	var conn *websocket.Conn
+	select {
+	case result := <-dialed:
+		if result.err != nil {
+			return nil, result.err
+		}
+		conn = result.conn
+	case <-this.ctx.Done():
+		go func() {
+			if result := <-dialed; result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, this.ctx.Err()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		conn.Close()
+		return nil, EventStreamClosed
+	}
+	for _, filters := range this.filters {
+		sub := subscription{Method: "subscribe", Filters: filters, LastLogId: this.lastId}
+		if err := websocket.JSON.Send(conn, sub); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	this.conn = conn
+	return conn, nil
+}
+
+// The URL of the API server's websocket, with the token.  The discovery
+// document says where it is; if it cannot be fetched, the usual place on
+// the API server is assumed.
+func (this ArvadosClient) websocketUrl(ctx context.Context) (string, error) {
+	location := "wss://" + this.ApiServer + WEBSOCKET_PATH
+	if doc, err := this.DiscoveryContext(ctx); err == nil {
+		if s, ok := doc.Values["websocketUrl"].(string); ok && s != "" {
+			location = s
+		}
+	} else if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("api_token", this.ApiToken)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,280 @@
+package arvadosclient
+
+import (
+	"fmt"
+	"golang.org/x/net/websocket"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A stand-in for the API server's websocket.  Events published are sent
+// to every connection, and subscriptions that give a last_log_id are sent
+// the events from that one on.  (The event with that ID is sent again, so
+// the client must drop events it has already seen.)  A subscription whose
+// filters have the attribute "bad" is refused.
+type StubEventServer struct {
+	lock          sync.Mutex
+	events        []Log
+	conns         []*websocket.Conn
+	tokens        []string
+	subscriptions []stubSubscription
+}
+
+// A subscription request as the stub server reads it.
+type stubSubscription struct {
+	Method    string          `json:"method"`
+	Filters   [][]interface{} `json:"filters"`
+	LastLogId int64           `json:"last_log_id"`
+}
+
+func (this *StubEventServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case DISCOVERY_PATH:
+		fmt.Fprintf(resp, `{"websocketUrl":"wss://%s/websocket"}`, req.Host)
+	case WEBSOCKET_PATH:
+		websocket.Handler(this.serveWebsocket).ServeHTTP(resp, req)
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+func (this *StubEventServer) serveWebsocket(conn *websocket.Conn) {
+	this.lock.Lock()
+	this.conns = append(this.conns, conn)
+	this.tokens = append(this.tokens, conn.Request().FormValue("api_token"))
+	this.lock.Unlock()
+
+	for {
+		var sub stubSubscription
+		if err := websocket.JSON.Receive(conn, &sub); err != nil {
+			return
+		}
+		this.lock.Lock()
+		this.subscriptions = append(this.subscriptions, sub)
+		if len(sub.Filters) > 0 && sub.Filters[0][0] == "bad" {
+			websocket.JSON.Send(conn, Dict{"status": 400, "message": "Invalid filter"})
+		} else {
+			websocket.JSON.Send(conn, Dict{"status": 200})
+			for _, event := range this.events {
+				if sub.LastLogId > 0 && event.Id >= sub.LastLogId {
+					websocket.JSON.Send(conn, event)
+				}
+			}
+		}
+		this.lock.Unlock()
+	}
+}
+
+// Record an event, and send it to every connection.
+func (this *StubEventServer) Publish(objectUuid string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	event := Log{
+		Id:         int64(len(this.events) + 1),
+		Uuid:       fmt.Sprintf("zzzzz-57u5n-%015d", len(this.events)+1),
+		ObjectUuid: objectUuid,
+		EventType:  "update"}
+	this.events = append(this.events, event)
+	for _, conn := range this.conns {
+		websocket.JSON.Send(conn, event)
+	}
+}
+
+// Close every connection.
+func (this *StubEventServer) Disconnect() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, conn := range this.conns {
+		conn.Close()
+	}
+	this.conns = nil
+}
+
+func (this *StubEventServer) Subscriptions() []stubSubscription {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]stubSubscription(nil), this.subscriptions...)
+}
+
+// Wait for the server to have received n subscription requests.
+func (this *StubEventServer) waitForSubscriptions(c *C, n int) []stubSubscription {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if subs := this.Subscriptions(); len(subs) >= n {
+			return subs
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatalf("Timed out waiting for %d subscriptions, got %v", n, this.Subscriptions())
+	return nil
+}
+
+func makeEventTestClient(server *StubEventServer, attempts int) (arv ArvadosClient, logger *StubLogger, stop func()) {
+	arv, stop = makeStubClient(server)
+	arv.Retry = RetryPolicy{Attempts: attempts, InitialDelay: 10 * time.Millisecond}
+	logger = &StubLogger{}
+	arv.Logger = logger
+	return arv, logger, stop
+}
+
+func nextEvent(c *C, stream *EventStream) Log {
+	select {
+	case event, ok := <-stream.Events():
+		c.Assert(ok, Equals, true, Commentf("stream ended: %v", stream.Err()))
+		return event
+	case <-time.After(5 * time.Second):
+		c.Fatal("Timed out waiting for an event")
+	}
+	return Log{}
+}
+
+func waitForEnd(c *C, stream *EventStream) {
+	for {
+		select {
+		case _, ok := <-stream.Events():
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			c.Fatal("Timed out waiting for the stream to end")
+		}
+	}
+}
+
+func (s *StandaloneSuite) TestEvents(c *C) {
+	server := &StubEventServer{}
+	arv, _, stop := makeEventTestClient(server, 1)
+	defer stop()
+
+	filters := Where("object_uuid", "=", "zzzzz-4zz18-000000000000000")
+	stream, err := arv.ListenEvents(0, filters)
+	c.Assert(err, IsNil)
+	subs := server.waitForSubscriptions(c, 1)
+	c.Check(subs[0].Method, Equals, "subscribe")
+	c.Check(subs[0].LastLogId, Equals, int64(0))
+	c.Check(subs[0].Filters, DeepEquals, [][]interface{}{{"object_uuid", "=", "zzzzz-4zz18-000000000000000"}})
+	server.lock.Lock()
+	c.Check(server.tokens, DeepEquals, []string{"abc123"})
+	server.lock.Unlock()
+
+	server.Publish("zzzzz-4zz18-000000000000000")
+	server.Publish("zzzzz-4zz18-000000000000000")
+	event := nextEvent(c, stream)
+	c.Check(event.Id, Equals, int64(1))
+	c.Check(event.ObjectUuid, Equals, "zzzzz-4zz18-000000000000000")
+	c.Check(event.EventType, Equals, "update")
+	c.Check(nextEvent(c, stream).Id, Equals, int64(2))
+	c.Check(stream.LastId(), Equals, int64(2))
+
+	c.Check(stream.Close(), IsNil)
+	waitForEnd(c, stream)
+	c.Check(stream.Err(), IsNil)
+	c.Check(stream.Subscribe(filters), Equals, EventStreamClosed)
+}
+
+func (s *StandaloneSuite) TestEventsSubscribeUnsubscribe(c *C) {
+	server := &StubEventServer{}
+	arv, _, stop := makeEventTestClient(server, 1)
+	defer stop()
+
+	stream, err := arv.ListenEvents(0)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	subs := server.waitForSubscriptions(c, 1)
+	c.Check(subs[0].Filters, DeepEquals, [][]interface{}{})
+
+	filters := Where("event_type", "=", "create")
+	c.Check(stream.Subscribe(filters), IsNil)
+	c.Check(stream.Unsubscribe(filters), IsNil)
+	subs = server.waitForSubscriptions(c, 3)
+	c.Check(subs[1].Method, Equals, "subscribe")
+	c.Check(subs[1].Filters, DeepEquals, [][]interface{}{{"event_type", "=", "create"}})
+	c.Check(subs[2].Method, Equals, "unsubscribe")
+	c.Check(subs[2].Filters, DeepEquals, [][]interface{}{{"event_type", "=", "create"}})
+}
+
+func (s *StandaloneSuite) TestEventsReconnect(c *C) {
+	server := &StubEventServer{}
+	arv, logger, stop := makeEventTestClient(server, 3)
+	defer stop()
+
+	stream, err := arv.ListenEvents(0, nil)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	server.waitForSubscriptions(c, 1)
+
+	server.Publish("zzzzz-4zz18-000000000000000")
+	server.Publish("zzzzz-4zz18-000000000000001")
+	c.Check(nextEvent(c, stream).Id, Equals, int64(1))
+	c.Check(nextEvent(c, stream).Id, Equals, int64(2))
+
+	// The event published while disconnected is sent on reconnecting,
+	// and the one before it, sent again, is dropped.
+	server.Disconnect()
+	server.Publish("zzzzz-4zz18-000000000000002")
+	event := nextEvent(c, stream)
+	c.Check(event.Id, Equals, int64(3))
+	c.Check(event.ObjectUuid, Equals, "zzzzz-4zz18-000000000000002")
+
+	subs := server.waitForSubscriptions(c, 2)
+	c.Check(subs[1].LastLogId, Equals, int64(2))
+
+	server.Publish("zzzzz-4zz18-000000000000003")
+	c.Check(nextEvent(c, stream).Id, Equals, int64(4))
+	logger.lock.Lock()
+	c.Check(logger.messages, Not(HasLen), 0)
+	logger.lock.Unlock()
+}
+
+func (s *StandaloneSuite) TestEventsResumeFromLastId(c *C) {
+	server := &StubEventServer{}
+	arv, _, stop := makeEventTestClient(server, 1)
+	defer stop()
+	for i := 0; i < 3; i++ {
+		server.Publish("zzzzz-4zz18-000000000000000")
+	}
+
+	stream, err := arv.ListenEvents(2, nil)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	c.Check(nextEvent(c, stream).Id, Equals, int64(3))
+}
+
+func (s *StandaloneSuite) TestEventsGiveUp(c *C) {
+	server := &StubEventServer{}
+	arv, logger, stop := makeEventTestClient(server, 2)
+
+	stream, err := arv.ListenEvents(0, nil)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	server.waitForSubscriptions(c, 1)
+
+	server.Disconnect()
+	stop()
+	waitForEnd(c, stream)
+	c.Check(stream.Err(), NotNil)
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	c.Check(logger.messages[len(logger.messages)-1], Matches, "Event stream failed after 2 attempts: .*")
+}
+
+func (s *StandaloneSuite) TestEventsSubscriptionRefused(c *C) {
+	server := &StubEventServer{}
+	arv, _, stop := makeEventTestClient(server, 3)
+	defer stop()
+
+	stream, err := arv.ListenEvents(0, Where("bad", "=", "filter"))
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	waitForEnd(c, stream)
+	c.Check(stream.Err(), ErrorMatches, "Event subscription failed: 400 Invalid filter")
+}
+
+func (s *StandaloneSuite) TestEventsUnreachable(c *C) {
+	arv, _, stop := makeEventTestClient(&StubEventServer{}, 1)
+	stop()
+
+	_, err := arv.ListenEvents(0, nil)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,71 @@
+/* Builds the filters used to select the items in a list request. */
+
+package arvadosclient
+
+import (
+	"encoding/json"
+)
+
+// A condition on one attribute of the items listed, such as
+// Filter{"modified_at", ">=", t}.  The operand may be any value that
+// encodes to JSON, such as a string, number, time.Time or []string.
+type Filter struct {
+	Attr     string
+	Operator string
+	Operand  interface{}
+}
+
+// Encode the filter in the form the API server expects: an array of the
+// attribute, operator and operand.
+func (f Filter) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{f.Attr, f.Operator, f.Operand})
+}
+
+// A list of filters, all of which must match.  Can be used as the
+// "filters" parameter of a list request:
+//
+//   filters := arvadosclient.Where("owner_uuid", "=", uuid).
+//           And("modified_at", ">=", since)
+//   err := arv.List("collections", Dict{"filters": filters}, &list)
+type Filters []Filter
+
+// Start a list of filters with a single condition.
+func Where(attr string, operator string, operand interface{}) Filters {
+	return Filters{{attr, operator, operand}}
+}
+
+// Return a copy of the list with another condition added.
+func (f Filters) And(attr string, operator string, operand interface{}) Filters {
+	result := make(Filters, len(f), len(f)+1)
+	copy(result, f)
+	return append(result, Filter{attr, operator, operand})
+}
+
+// Add a condition that the attribute equals 'value'.
+func (f Filters) Eq(attr string, value interface{}) Filters {
+	return f.And(attr, "=", value)
+}
+
+// Add a condition that the attribute is one of 'values'.
+func (f Filters) In(attr string, values ...interface{}) Filters {
+	return f.And(attr, "in", values)
+}
+
+// Add a condition that the attribute is none of 'values'.
+func (f Filters) NotIn(attr string, values ...interface{}) Filters {
+	return f.And(attr, "not in", values)
+}
+
+// Add a condition that the attribute matches the SQL LIKE pattern
+// 'pattern'.
+func (f Filters) Like(attr string, pattern string) Filters {
+	return f.And(attr, "like", pattern)
+}
+
+// Encode as an empty list rather than null if there are no filters.
+func (f Filters) MarshalJSON() ([]byte, error) {
+	if f == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]Filter(f))
+}
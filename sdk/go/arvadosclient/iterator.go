@@ -0,0 +1,224 @@
+/* Pages through all the items matching a list request. */
+
+package arvadosclient
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Pages through the results of a list request, fetching one page at a time.
+//
+// By default pages are fetched by offset, which can skip or repeat items
+// if they are added or removed while paging.  ByKeyset instead orders the
+// items by an attribute that does not change once set, such as created_at
+// or modified_at, and asks for each page to start where the last one
+// ended, which is also faster for large lists.
+//
+// Usage:
+//
+//   pages := arv.Iterate("collections", Dict{"filters": filters})
+//   var page CollectionList
+//   for pages.Next(&page) {
+//           for _, c := range page.Items {
+//                   ...
+//           }
+//   }
+//   if err := pages.Err(); err != nil {
+//           ...
+//   }
+type ListIterator struct {
+	client     ArvadosClient
+	ctx        context.Context
+	resource   string
+	parameters Dict
+
+	// The attribute to order by, if paging by keyset
+	keyset string
+
+	// The number of items seen so far
+	offset int
+
+	// The keyset value of the last item seen, and the UUIDs of the
+	// items seen with that value
+	lastValue interface{}
+	lastUuids []interface{}
+
+	itemsAvailable int
+	done           bool
+	err            error
+}
+
+// The parts of a page of results used to request the next one.
+type listPage struct {
+	ItemsAvailable *int                         `json:"items_available"`
+	Items          []map[string]json.RawMessage `json:"items"`
+}
+
+// Page through the items of 'resource' matching the list 'parameters'.
+// The "limit" parameter, if given, sets the size of each page.
+func (this ArvadosClient) Iterate(resource string, parameters Dict) *ListIterator {
+	return this.IterateContext(context.Background(), resource, parameters)
+}
+
+// Like Iterate, but each request is abandoned if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) IterateContext(ctx context.Context, resource string, parameters Dict) *ListIterator {
+	params := make(Dict)
+	for k, v := range parameters {
+		params[k] = v
+	}
+	return &ListIterator{
+		client:         this,
+		ctx:            ctx,
+		resource:       resource,
+		parameters:     params,
+		itemsAvailable: -1,
+	}
+}
+
+// Page by keyset, ordering the items by 'attr' and then by UUID.  Any
+// "order" parameter is replaced.  Must be called before the first Next.
+func (this *ListIterator) ByKeyset(attr string) *ListIterator {
+	this.keyset = attr
+	return this
+}
+
+// Fetch the next page of items into 'output', which is decoded from the
+// API server's response like the output of List.  Returns false, leaving
+// output unchanged, once there are no more items or if there is an error.
+func (this *ListIterator) Next(output interface{}) bool {
+	if this.done || this.err != nil {
+		return false
+	}
+	params := make(Dict)
+	for k, v := range this.parameters {
+		params[k] = v
+	}
+	if this.keyset == "" {
+		params["offset"] = this.offset
+	} else {
+		params["order"] = []string{this.keyset + " asc", "uuid asc"}
+		if this.lastUuids != nil {
+			filters, err := this.keysetFilters()
+			if err != nil {
+				this.err = err
+				return false
+			}
+			params["filters"] = filters
+		}
+	}
+
+	var raw json.RawMessage
+	if err := this.client.ListContext(this.ctx, this.resource, params, &raw); err != nil {
+		this.err = err
+		return false
+	}
+	var page listPage
+	if err := json.Unmarshal(raw, &page); err != nil {
+		this.err = err
+		return false
+	}
+	if page.ItemsAvailable != nil && this.itemsAvailable < 0 {
+		this.itemsAvailable = *page.ItemsAvailable
+	}
+	if len(page.Items) == 0 {
+		this.done = true
+		return false
+	}
+
+	this.offset += len(page.Items)
+	if this.keyset != "" {
+		if err := this.updateKeyset(page.Items); err != nil {
+			this.err = err
+			return false
+		}
+	} else if this.itemsAvailable >= 0 && this.offset >= this.itemsAvailable {
+		this.done = true
+	}
+
+	if err := json.Unmarshal(raw, output); err != nil {
+		this.err = err
+		return false
+	}
+	return true
+}
+
+// The caller's filters, followed by ones selecting the items after the
+// last one seen.
+func (this *ListIterator) keysetFilters() ([]interface{}, error) {
+	var filters []interface{}
+	if f, ok := this.parameters["filters"]; ok {
+		// The filters may be of any type that encodes to a
+		// JSON array, so convert them to a generic one.
+		j, err := json.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(j, &filters); err != nil {
+			return nil, err
+		}
+	}
+	filters = append(filters,
+		Filter{this.keyset, ">=", this.lastValue},
+		Filter{"uuid", "not in", this.lastUuids})
+	return filters, nil
+}
+
+// Record the keyset value of the last item in 'items', and the UUIDs of
+// all the items seen with that value.
+func (this *ListIterator) updateKeyset(items []map[string]json.RawMessage) error {
+	for _, item := range items {
+		var value, uuid interface{}
+		if err := json.Unmarshal(item[this.keyset], &value); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(item["uuid"], &uuid); err != nil {
+			return err
+		}
+		if this.lastUuids == nil || value != this.lastValue {
+			this.lastValue = value
+			this.lastUuids = []interface{}{}
+		}
+		this.lastUuids = append(this.lastUuids, uuid)
+	}
+	return nil
+}
+
+// The error that stopped Next, if any.
+func (this *ListIterator) Err() error {
+	return this.err
+}
+
+// The number of items the API server reported as matching, or -1 if no
+// page has been fetched yet.
+func (this *ListIterator) ItemsAvailable() int {
+	return this.itemsAvailable
+}
+
+// Fetch every item of 'resource' matching the list 'parameters', paging by
+// offset, and decode them into 'output', which must point to a slice.
+func (this ArvadosClient) ListAll(resource string, parameters Dict, output interface{}) error {
+	return this.ListAllContext(context.Background(), resource, parameters, output)
+}
+
+// Like ListAll, but each request is abandoned if ctx is cancelled or its
+// deadline passes.
+func (this ArvadosClient) ListAllContext(ctx context.Context, resource string, parameters Dict, output interface{}) error {
+	pages := this.IterateContext(ctx, resource, parameters)
+	items := []json.RawMessage{}
+	var page struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	for pages.Next(&page) {
+		items = append(items, page.Items...)
+	}
+	if err := pages.Err(); err != nil {
+		return err
+	}
+	j, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, output)
+}
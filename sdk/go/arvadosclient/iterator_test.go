@@ -0,0 +1,206 @@
+package arvadosclient
+
+import (
+	"encoding/json"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = Suite(&StandaloneSuite{})
+
+// Tests that use a stub in place of the API server
+type StandaloneSuite struct{}
+
+// Stands in for the API server's collections list, applying the "offset",
+// "limit" and "filters" parameters to a list of items sorted by
+// modified_at, and records the filters of each request.
+type StubListHandler struct {
+	items []Dict
+
+	lock    sync.Mutex
+	filters []string
+}
+
+func (this *StubListHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var offset, limit int
+	var filters [][]interface{}
+	json.Unmarshal([]byte(req.FormValue("offset")), &offset)
+	json.Unmarshal([]byte(req.FormValue("filters")), &filters)
+	limit = 2
+	json.Unmarshal([]byte(req.FormValue("limit")), &limit)
+
+	this.lock.Lock()
+	// The encoder escapes ">" as "\u003e".
+	this.filters = append(this.filters, strings.Replace(req.FormValue("filters"), `\u003e`, ">", -1))
+	this.lock.Unlock()
+
+	var matching []Dict
+	for _, item := range this.items {
+		ok := true
+		for _, f := range filters {
+			switch f[1] {
+			case ">=":
+				ok = ok && item[f[0].(string)].(string) >= f[2].(string)
+			case "not in":
+				for _, v := range f[2].([]interface{}) {
+					ok = ok && item[f[0].(string)] != v
+				}
+			}
+		}
+		if ok {
+			matching = append(matching, item)
+		}
+	}
+	page := []Dict{}
+	for i := offset; i < len(matching) && i < offset+limit; i++ {
+		page = append(page, matching[i])
+	}
+	json.NewEncoder(resp).Encode(Dict{
+		"items_available": len(matching),
+		"offset":          offset,
+		"limit":           limit,
+		"items":           page})
+}
+
+func makeStubClient(api http.Handler) (arv ArvadosClient, stop func()) {
+	ts := httptest.NewTLSServer(api)
+	arv = ArvadosClient{
+		ApiServer: strings.TrimPrefix(ts.URL, "https://"),
+		ApiToken:  "abc123",
+		Client:    ts.Client()}
+	return arv, ts.Close
+}
+
+// Five collections, with the last three modified at the same time.
+func makeStubItems() []Dict {
+	var items []Dict
+	for i, t := range []string{"01", "02", "03", "03", "03"} {
+		items = append(items, Dict{
+			"uuid":        fmt.Sprintf("zzzzz-4zz18-%015d", i),
+			"modified_at": "2015-01-" + t + "T00:00:00Z",
+		})
+	}
+	return items
+}
+
+func (s *StandaloneSuite) TestFilters(c *C) {
+	t := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := Where("owner_uuid", "=", "zzzzz-tpzed-000000000000000").
+		And("modified_at", ">=", t).
+		In("uuid", "a", "b").
+		NotIn("name", "c").
+		Like("name", "foo%")
+	j, err := json.Marshal(Dict{"filters": f})
+	c.Check(err, IsNil)
+	c.Check(strings.Replace(string(j), `\u003e`, ">", -1), Equals, `{"filters":[`+
+		`["owner_uuid","=","zzzzz-tpzed-000000000000000"],`+
+		`["modified_at",">=","2015-01-02T03:04:05Z"],`+
+		`["uuid","in",["a","b"]],`+
+		`["name","not in",["c"]],`+
+		`["name","like","foo%"]]}`)
+
+	// And does not change the list it is called on.
+	base := Where("a", "=", 1)
+	base.And("b", "=", 2)
+	c.Check(base, HasLen, 1)
+
+	j, err = json.Marshal(Filters(nil))
+	c.Check(err, IsNil)
+	c.Check(string(j), Equals, "[]")
+}
+
+func (s *StandaloneSuite) TestIterateByOffset(c *C) {
+	api := &StubListHandler{items: makeStubItems()}
+	arv, stop := makeStubClient(api)
+	defer stop()
+
+	pages := arv.Iterate("collections", nil)
+	var uuids []string
+	var page CollectionList
+	for pages.Next(&page) {
+		for _, coll := range page.Items {
+			uuids = append(uuids, coll.Uuid)
+		}
+	}
+	c.Check(pages.Err(), IsNil)
+	c.Check(pages.ItemsAvailable(), Equals, 5)
+	c.Check(uuids, DeepEquals, []string{
+		"zzzzz-4zz18-000000000000000",
+		"zzzzz-4zz18-000000000000001",
+		"zzzzz-4zz18-000000000000002",
+		"zzzzz-4zz18-000000000000003",
+		"zzzzz-4zz18-000000000000004"})
+	c.Check(page.Items[0].ModifiedAt, Equals, time.Date(2015, 1, 3, 0, 0, 0, 0, time.UTC))
+	// No request is made for an empty page after the last item.
+	c.Check(api.filters, HasLen, 3)
+
+	var all []Collection
+	c.Check(arv.ListAll("collections", Dict{"limit": 3}, &all), IsNil)
+	c.Check(all, HasLen, 5)
+}
+
+func (s *StandaloneSuite) TestIterateByKeyset(c *C) {
+	api := &StubListHandler{items: makeStubItems()}
+	arv, stop := makeStubClient(api)
+	defer stop()
+
+	filters := Where("modified_at", ">=", "2015-01-02T00:00:00Z")
+	pages := arv.Iterate("collections", Dict{"filters": filters}).ByKeyset("modified_at")
+	var uuids []string
+	var page CollectionList
+	for pages.Next(&page) {
+		for _, coll := range page.Items {
+			uuids = append(uuids, coll.Uuid)
+		}
+	}
+	c.Check(pages.Err(), IsNil)
+	c.Check(uuids, DeepEquals, []string{
+		"zzzzz-4zz18-000000000000001",
+		"zzzzz-4zz18-000000000000002",
+		"zzzzz-4zz18-000000000000003",
+		"zzzzz-4zz18-000000000000004"})
+
+	// Each page starts after the last item of the one before,
+	// keeping the caller's filters.
+	c.Check(api.filters, DeepEquals, []string{
+		`[["modified_at",">=","2015-01-02T00:00:00Z"]]`,
+		`[["modified_at",">=","2015-01-02T00:00:00Z"],["modified_at",">=","2015-01-03T00:00:00Z"],["uuid","not in",["zzzzz-4zz18-000000000000002"]]]`,
+		`[["modified_at",">=","2015-01-02T00:00:00Z"],["modified_at",">=","2015-01-03T00:00:00Z"],["uuid","not in",["zzzzz-4zz18-000000000000002","zzzzz-4zz18-000000000000003","zzzzz-4zz18-000000000000004"]]]`,
+	})
+}
+
+func (s *StandaloneSuite) TestApiErrorDetails(c *C) {
+	api := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/logs") {
+			resp.WriteHeader(422)
+			resp.Write([]byte(`{"errors":["unknown attribute: bogus_attr",{"code":1}]}`))
+			return
+		}
+		http.Error(resp, "Not here", http.StatusNotFound)
+	})
+	arv, stop := makeStubClient(api)
+	defer stop()
+
+	err := arv.Create("logs", Dict{"log": Dict{"bogus_attr": "foo"}}, nil)
+	c.Assert(err, FitsTypeOf, ArvadosApiError{})
+	c.Check(err, ErrorMatches, `unknown attribute: bogus_attr; \{"code":1\}`)
+	c.Check(err.(ArvadosApiError).HttpStatusCode, Equals, 422)
+	c.Check(err.(ArvadosApiError).ErrorDetails, DeepEquals, []string{"unknown attribute: bogus_attr", `{"code":1}`})
+	c.Check(IsApiError(err, 422), Equals, true)
+
+	// A response that is not JSON gives the HTTP status.
+	err = arv.Get("bogus", "x", nil, nil)
+	c.Check(err, ErrorMatches, "API response: 404 Not Found")
+	c.Check(err.(ArvadosApiError).ErrorDetails, IsNil)
+	c.Check(IsApiError(fmt.Errorf("wrapped: %w", err), 404), Equals, true)
+	c.Check(IsApiError(err, 422), Equals, false)
+
+	var pages = arv.Iterate("bogus", nil)
+	c.Check(pages.Next(&CollectionList{}), Equals, false)
+	c.Check(IsApiError(pages.Err(), 404), Equals, true)
+}
@@ -0,0 +1,112 @@
+/* Types for the common resources returned by the API server. */
+
+package arvadosclient
+
+import (
+	"time"
+)
+
+// A collection of files stored in Keep.
+type Collection struct {
+	Uuid                 string                 `json:"uuid"`
+	OwnerUuid            string                 `json:"owner_uuid"`
+	CreatedAt            time.Time              `json:"created_at"`
+	ModifiedAt           time.Time              `json:"modified_at"`
+	ModifiedByUserUuid   string                 `json:"modified_by_user_uuid"`
+	Name                 string                 `json:"name"`
+	Description          string                 `json:"description"`
+	PortableDataHash     string                 `json:"portable_data_hash"`
+	ManifestText         string                 `json:"manifest_text"`
+	ReplicationDesired   int                    `json:"replication_desired"`
+	ReplicationConfirmed int                    `json:"replication_confirmed"`
+	Properties           map[string]interface{} `json:"properties"`
+}
+
+type CollectionList struct {
+	ItemsAvailable int          `json:"items_available"`
+	Offset         int          `json:"offset"`
+	Limit          int          `json:"limit"`
+	Items          []Collection `json:"items"`
+}
+
+// A Keep server or proxy.
+type KeepService struct {
+	Uuid           string    `json:"uuid"`
+	OwnerUuid      string    `json:"owner_uuid"`
+	ModifiedAt     time.Time `json:"modified_at"`
+	ServiceHost    string    `json:"service_host"`
+	ServicePort    int       `json:"service_port"`
+	ServiceSSLFlag bool      `json:"service_ssl_flag"`
+	ServiceType    string    `json:"service_type"`
+	ReadOnly       bool      `json:"read_only"`
+}
+
+type KeepServiceList struct {
+	ItemsAvailable int           `json:"items_available"`
+	Offset         int           `json:"offset"`
+	Limit          int           `json:"limit"`
+	Items          []KeepService `json:"items"`
+}
+
+type User struct {
+	Uuid       string    `json:"uuid"`
+	OwnerUuid  string    `json:"owner_uuid"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Email      string    `json:"email"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	Username   string    `json:"username"`
+	IsActive   bool      `json:"is_active"`
+	IsAdmin    bool      `json:"is_admin"`
+}
+
+type UserList struct {
+	ItemsAvailable int    `json:"items_available"`
+	Offset         int    `json:"offset"`
+	Limit          int    `json:"limit"`
+	Items          []User `json:"items"`
+}
+
+// An entry in the API server's event log.
+type Log struct {
+	Id              int64                  `json:"id"`
+	Uuid            string                 `json:"uuid"`
+	OwnerUuid       string                 `json:"owner_uuid"`
+	CreatedAt       time.Time              `json:"created_at"`
+	ObjectUuid      string                 `json:"object_uuid"`
+	ObjectOwnerUuid string                 `json:"object_owner_uuid"`
+	EventType       string                 `json:"event_type"`
+	EventAt         time.Time              `json:"event_at"`
+	Summary         string                 `json:"summary"`
+	Properties      map[string]interface{} `json:"properties"`
+}
+
+type LogList struct {
+	ItemsAvailable int   `json:"items_available"`
+	Offset         int   `json:"offset"`
+	Limit          int   `json:"limit"`
+	Items          []Log `json:"items"`
+}
+
+// A Crunch job.  The times are nil until the job reaches that point.
+type Job struct {
+	Uuid             string                 `json:"uuid"`
+	OwnerUuid        string                 `json:"owner_uuid"`
+	ModifiedAt       time.Time              `json:"modified_at"`
+	Script           string                 `json:"script"`
+	ScriptVersion    string                 `json:"script_version"`
+	ScriptParameters map[string]interface{} `json:"script_parameters"`
+	Repository       string                 `json:"repository"`
+	State            string                 `json:"state"`
+	StartedAt        *time.Time             `json:"started_at"`
+	FinishedAt       *time.Time             `json:"finished_at"`
+	Log              string                 `json:"log"`
+	Output           string                 `json:"output"`
+}
+
+type JobList struct {
+	ItemsAvailable int   `json:"items_available"`
+	Offset         int   `json:"offset"`
+	Limit          int   `json:"limit"`
+	Items          []Job `json:"items"`
+}
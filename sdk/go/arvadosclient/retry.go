@@ -0,0 +1,201 @@
+/* Retry policy, timeouts, request IDs and logging for API requests. */
+
+package arvadosclient
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// How a client retries requests that fail with a transient error, such as
+// a 503 from a busy server or a refused connection.  ArvadosClient retries
+// only requests with idempotent methods (GET, HEAD, PUT and DELETE), since
+// a POST that failed may still have taken effect.  KeepClient uses the
+// same policy for Keep requests.
+//
+// The zero value makes a single attempt.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first.  Zero or one
+	// means no retries.
+	Attempts int
+
+	// Delay before the first retry.  The delay doubles after each
+	// attempt, up to MaxDelay.
+	InitialDelay time.Duration
+
+	// Upper bound on the delay between attempts.  Zero means no bound.
+	MaxDelay time.Duration
+
+	// Fraction of each delay, between 0 and 1, that is chosen at
+	// random, so that clients which failed together do not all retry
+	// at the same moment.
+	Jitter float64
+
+	// Reports whether a request that failed with the given status code
+	// (zero if no response was received) or error is worth retrying.
+	// If nil, DefaultRetryable is used.
+	Retryable func(statusCode int, err error) bool
+}
+
+// The policy set by MakeArvadosClient: up to five attempts, waiting half a
+// second, then one, two and four seconds between them.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:     5,
+	InitialDelay: 500 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Jitter:       0.5,
+}
+
+// The time limit set by MakeArvadosClient for each attempt at a request.
+const DEFAULT_TIMEOUT = 5 * time.Minute
+
+// Retries requests that timed out or whose connection was refused or
+// reset, and requests that were refused with a status that suggests the
+// server is overloaded or temporarily unavailable.  Other errors, such as
+// a malformed URL, would only fail again.
+func DefaultRetryable(statusCode int, err error) bool {
+	switch {
+	case statusCode == 0:
+		return transientError(err)
+	case statusCode == http.StatusRequestTimeout,
+		statusCode == http.StatusTooManyRequests,
+		statusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// Whether err is a transport error that may not happen again.
+func transientError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// The number of attempts to make: Attempts, or one if that is less than
+// one.
+func (this RetryPolicy) MaxAttempts() int {
+	if this.Attempts < 1 {
+		return 1
+	}
+	return this.Attempts
+}
+
+// Whether a request that failed with the given status code (zero if no
+// response was received) or error should be tried again, as decided by
+// Retryable, or DefaultRetryable if that is nil.
+func (this RetryPolicy) ShouldRetry(statusCode int, err error) bool {
+	if this.Retryable != nil {
+		return this.Retryable(statusCode, err)
+	}
+	return DefaultRetryable(statusCode, err)
+}
+
+// The delay to wait after the given attempt (starting at 1) fails.
+func (this RetryPolicy) Delay(attempt int) time.Duration {
+	d := this.InitialDelay
+	for i := 1; i < attempt && (this.MaxDelay == 0 || d < this.MaxDelay); i++ {
+		d *= 2
+	}
+	if this.MaxDelay > 0 && d > this.MaxDelay {
+		d = this.MaxDelay
+	}
+	if this.Jitter > 0 && d > 0 {
+		random := time.Duration(this.Jitter * float64(d))
+		d = d - random + time.Duration(mathrand.Int63n(int64(random)+1))
+	}
+	return d
+}
+
+// Wait before the next attempt.  Returns ctx.Err() if the context is done
+// before the delay has passed.
+func (this RetryPolicy) Wait(ctx context.Context, attempt int) error {
+	t := time.NewTimer(this.Delay(attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Where ArvadosClient reports failed attempts.  *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+func (this ArvadosClient) logf(format string, v ...interface{}) {
+	if this.Logger != nil {
+		this.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// The header that carries the request ID.
+const X_Request_Id = "X-Request-Id"
+
+type requestIdKey struct{}
+
+// Return a context that makes ArvadosClient send 'id' as the request ID of
+// each request made with it, whether or not SendRequestIds is set.  Lets
+// the requests made for one task be found together in the API server's
+// logs.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// The request ID to send with a request made with ctx: the one given to
+// WithRequestId, a new one if SendRequestIds is set, or none.
+func (this ArvadosClient) requestId(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIdKey{}).(string); ok {
+		return id
+	}
+	if !this.SendRequestIds {
+		return ""
+	}
+	buf := make([]byte, 10)
+	rand.Read(buf)
+	return fmt.Sprintf("req-%x", buf)
+}
+
+// The HTTP status code of a failed attempt, or 0 if there was no
+// response.
+func statusCode(err error) int {
+	var apiErr ArvadosApiError
+	if errors.As(err, &apiErr) {
+		return apiErr.HttpStatusCode
+	}
+	return 0
+}
+
+// Cancels the context of a request when its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this cancelOnClose) Close() error {
+	defer this.cancel()
+	return this.ReadCloser.Close()
+}
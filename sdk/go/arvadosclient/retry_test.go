@@ -0,0 +1,183 @@
+package arvadosclient
+
+import (
+	"context"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Fails the first 'failures' requests with 'failStatus', or by sleeping for
+// 'delay' if failStatus is 0, then answers with an empty object.  Records
+// the method and request ID of each request.
+type StubFlakyHandler struct {
+	failures   int
+	failStatus int
+	delay      time.Duration
+
+	lock       sync.Mutex
+	methods    []string
+	requestIds []string
+}
+
+func (this *StubFlakyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	this.methods = append(this.methods, req.Method)
+	this.requestIds = append(this.requestIds, req.Header.Get(X_Request_Id))
+	fail := len(this.methods) <= this.failures
+	this.lock.Unlock()
+
+	if fail && this.failStatus == 0 {
+		time.Sleep(this.delay)
+	} else if fail {
+		http.Error(resp, `{"errors":["try again"]}`, this.failStatus)
+		return
+	}
+	resp.Write([]byte(`{}`))
+}
+
+func (this *StubFlakyHandler) Requests() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.methods)
+}
+
+// Records the messages logged.
+type StubLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (this *StubLogger) Printf(format string, v ...interface{}) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.messages = append(this.messages, fmt.Sprintf(format, v...))
+}
+
+func makeRetryTestClient(api http.Handler, attempts int) (arv ArvadosClient, logger *StubLogger, stop func()) {
+	arv, stop = makeStubClient(api)
+	arv.Retry = RetryPolicy{Attempts: attempts, InitialDelay: time.Millisecond}
+	logger = &StubLogger{}
+	arv.Logger = logger
+	return arv, logger, stop
+}
+
+func (s *StandaloneSuite) TestRetryIdempotent(c *C) {
+	api := &StubFlakyHandler{failures: 2, failStatus: 503}
+	arv, logger, stop := makeRetryTestClient(api, 3)
+	defer stop()
+	arv.SendRequestIds = true
+
+	c.Check(arv.Get("collections", "zzzzz-4zz18-000000000000000", nil, nil), IsNil)
+	c.Check(api.Requests(), Equals, 3)
+	c.Assert(logger.messages, HasLen, 2)
+	c.Check(logger.messages[0], Matches, `API request req-[0-9a-f]{20} GET /arvados/v1/collections/zzzzz-4zz18-000000000000000 attempt 1 failed, retrying: try again`)
+
+	// Every attempt has the same request ID.
+	c.Check(api.requestIds[0], Matches, `req-[0-9a-f]{20}`)
+	c.Check(api.requestIds[1], Equals, api.requestIds[0])
+	c.Check(api.requestIds[2], Equals, api.requestIds[0])
+}
+
+func (s *StandaloneSuite) TestRetryGivesUp(c *C) {
+	api := &StubFlakyHandler{failures: 5, failStatus: 502}
+	arv, logger, stop := makeRetryTestClient(api, 3)
+	defer stop()
+
+	err := arv.Update("collections", "zzzzz-4zz18-000000000000000", nil, nil)
+	c.Check(IsApiError(err, 502), Equals, true)
+	c.Check(api.Requests(), Equals, 3)
+	c.Check(logger.messages, HasLen, 3)
+	c.Check(logger.messages[2], Matches, `API request PUT .* failed after 3 attempts: try again`)
+	c.Check(api.requestIds[0], Equals, "")
+}
+
+func (s *StandaloneSuite) TestNoRetry(c *C) {
+	// A POST may have taken effect, so it is not retried.
+	api := &StubFlakyHandler{failures: 1, failStatus: 503}
+	arv, logger, stop := makeRetryTestClient(api, 3)
+	defer stop()
+	c.Check(IsApiError(arv.Create("collections", nil, nil), 503), Equals, true)
+	c.Check(api.Requests(), Equals, 1)
+	c.Check(logger.messages, HasLen, 0)
+
+	// Nor is a request the server refused for good.
+	api = &StubFlakyHandler{failures: 1, failStatus: 422}
+	arv, logger, stop2 := makeRetryTestClient(api, 3)
+	defer stop2()
+	c.Check(IsApiError(arv.Get("collections", "x", nil, nil), 422), Equals, true)
+	c.Check(api.Requests(), Equals, 1)
+}
+
+func (s *StandaloneSuite) TestRetryTimeout(c *C) {
+	api := &StubFlakyHandler{failures: 1, delay: 500 * time.Millisecond}
+	arv, logger, stop := makeRetryTestClient(api, 2)
+	defer stop()
+	arv.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	c.Check(arv.Get("collections", "x", nil, nil), IsNil)
+	c.Check(time.Since(start) < 500*time.Millisecond, Equals, true)
+	c.Check(api.Requests(), Equals, 2)
+	c.Check(logger.messages, HasLen, 1)
+}
+
+func (s *StandaloneSuite) TestRetryPolicyDelay(c *C) {
+	p := RetryPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second}
+	c.Check(p.Delay(1), Equals, time.Second)
+	c.Check(p.Delay(2), Equals, 2*time.Second)
+	c.Check(p.Delay(3), Equals, 4*time.Second)
+	c.Check(p.Delay(4), Equals, 5*time.Second)
+	c.Check(p.Delay(100), Equals, 5*time.Second)
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2)
+		c.Check(d >= time.Second && d <= 2*time.Second, Equals, true)
+	}
+
+	c.Check(RetryPolicy{}.MaxAttempts(), Equals, 1)
+	c.Check(RetryPolicy{}.ShouldRetry(503, nil), Equals, true)
+	c.Check(RetryPolicy{Retryable: func(int, error) bool { return false }}.ShouldRetry(503, nil), Equals, false)
+}
+
+func (s *StandaloneSuite) TestDefaultRetryable(c *C) {
+	c.Check(DefaultRetryable(503, nil), Equals, true)
+	c.Check(DefaultRetryable(429, nil), Equals, true)
+	c.Check(DefaultRetryable(404, nil), Equals, false)
+
+	_, err := http.Get("https:///arvados/v1/collections")
+	c.Assert(err, NotNil)
+	c.Check(DefaultRetryable(0, err), Equals, false)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := l.Addr().String()
+	l.Close()
+	_, err = http.Get("http://" + addr + "/")
+	c.Assert(err, NotNil)
+	c.Check(DefaultRetryable(0, err), Equals, true)
+}
+
+func (s *StandaloneSuite) TestRequestIdFromContext(c *C) {
+	api := &StubFlakyHandler{}
+	arv, _, stop := makeRetryTestClient(api, 1)
+	defer stop()
+
+	ctx := WithRequestId(context.Background(), "req-foo")
+	c.Check(arv.GetContext(ctx, "collections", "x", nil, nil), IsNil)
+	c.Check(api.requestIds, DeepEquals, []string{"req-foo"})
+
+	// Cancelling the context stops the retries.
+	api = &StubFlakyHandler{failures: 5, failStatus: 503}
+	arv, _, stop2 := makeRetryTestClient(api, 5)
+	defer stop2()
+	arv.Retry.InitialDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Check(arv.GetContext(ctx, "collections", "x", nil, nil), Equals, context.DeadlineExceeded)
+	c.Check(api.Requests(), Equals, 1)
+}
@@ -0,0 +1,109 @@
+/* Limits the bandwidth used for transfers to and from Keep servers. */
+package keepclient
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// A token bucket limiting the rate at which bytes are transferred.  Set
+// KeepClient.Bandwidth to limit the data sent in uploads and received in
+// downloads.  Copies of a KeepClient share the same bucket, so the limit
+// applies to all of them together.
+//
+// The bucket fills at Rate bytes per second, and holds up to Burst bytes.
+// Each transfer takes a token for each byte, and waits while the bucket is
+// empty.
+type TokenBucket struct {
+	Rate  int64
+	Burst int64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Create a TokenBucket allowing 'rate' bytes per second, with bursts of up
+// to 'burst' bytes.  If burst is not positive, it is the same as rate.
+func NewTokenBucket(rate int64, burst int64) *TokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{Rate: rate, Burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Take 'n' tokens, waiting until the bucket has refilled enough to cover
+// them.  Returns ctx.Err() if ctx is done first; the tokens are still
+// taken.  A bucket with no Rate does not limit anything.
+func (this *TokenBucket) take(ctx context.Context, n int) error {
+	if this.Rate <= 0 {
+		return nil
+	}
+	this.lock.Lock()
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * float64(this.Rate)
+	if this.tokens > float64(this.Burst) {
+		this.tokens = float64(this.Burst)
+	}
+	this.last = now
+	this.tokens -= float64(n)
+	deficit := -this.tokens
+	this.lock.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / float64(this.Rate) * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Passes reads through from a ReadCloser, taking a token from 'bucket' for
+// each byte read and calling 'count' with the number of bytes.  Either may
+// be nil.
+type meteredReader struct {
+	ctx    context.Context
+	reader io.ReadCloser
+	bucket *TokenBucket
+	count  func(n int64)
+}
+
+// Wrap 'reader' so that reads from it are limited by 'bucket' and counted
+// by 'count'.  Returns 'reader' itself if neither is set.
+func meterReader(ctx context.Context, reader io.ReadCloser, bucket *TokenBucket, count func(n int64)) io.ReadCloser {
+	if bucket == nil && count == nil {
+		return reader
+	}
+	return &meteredReader{ctx, reader, bucket, count}
+}
+
+func (this *meteredReader) Read(p []byte) (n int, err error) {
+	// Read no more than a burst at once, so that a large read does
+	// not overdraw the bucket by more than it can hold.
+	if this.bucket != nil && int64(len(p)) > this.bucket.Burst && this.bucket.Burst > 0 {
+		p = p[:this.bucket.Burst]
+	}
+	n, err = this.reader.Read(p)
+	if n > 0 {
+		if this.count != nil {
+			this.count(int64(n))
+		}
+		if this.bucket != nil {
+			if werr := this.bucket.take(this.ctx, n); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (this *meteredReader) Close() error {
+	return this.reader.Close()
+}
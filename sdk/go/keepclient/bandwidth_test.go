@@ -0,0 +1,54 @@
+package keepclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"time"
+)
+
+func (s *StandaloneSuite) TestTokenBucket(c *C) {
+	bucket := NewTokenBucket(10000, 1000)
+
+	// The first burst is not delayed, and the rest is limited to
+	// the rate.
+	start := time.Now()
+	c.Check(bucket.take(context.Background(), 1000), IsNil)
+	c.Check(time.Since(start) < 50*time.Millisecond, Equals, true)
+	c.Check(bucket.take(context.Background(), 2000), IsNil)
+	c.Check(time.Since(start) >= 190*time.Millisecond, Equals, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Check(bucket.take(ctx, 10000), Equals, context.Canceled)
+
+	unlimited := &TokenBucket{}
+	c.Check(unlimited.take(context.Background(), 1<<30), IsNil)
+}
+
+func (s *StandaloneSuite) TestBandwidthLimit(c *C) {
+	data := bytes.Repeat([]byte("x"), 4000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	kc, stop := makeRetryTestClient(1, &FlakyHandler{body: data})
+	defer stop()
+	kc.Want_replicas = 1
+	kc.Bandwidth = NewTokenBucket(20000, 1000)
+
+	start := time.Now()
+	_, replicas, err := kc.PutB(data)
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 1)
+	c.Check(time.Since(start) >= 140*time.Millisecond, Equals, true)
+
+	kc.Bandwidth = NewTokenBucket(20000, 1000)
+	start = time.Now()
+	r, _, _, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	got, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(got, DeepEquals, data)
+	c.Check(time.Since(start) >= 140*time.Millisecond, Equals, true)
+}
@@ -0,0 +1,154 @@
+/* Reads a series of blocks from Keep, fetching several at once. */
+package keepclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/locator"
+	"io"
+	"io/ioutil"
+)
+
+var BlockReaderClosed = errors.New("BlockReader is closed")
+
+// Number of blocks a BlockReader fetches at once, if no other number is
+// given.
+const DEFAULT_PREFETCH_BLOCKS = 4
+
+// An io.ReadCloser over the concatenated contents of a list of blocks.
+// While one block is being read, the next ones are fetched concurrently,
+// each from the servers in its RootSorter order, so the network is kept
+// busy while the data is consumed.
+//
+// At most 'prefetch' blocks are fetched at once, so no more than
+// prefetch+1 blocks are held in memory.  Each block is checked against its
+// hash and size hint before any of it is returned.
+//
+// A BlockReader is not safe for concurrent use.
+type BlockReader struct {
+	kc       *KeepClient
+	ctx      context.Context
+	cancel   context.CancelFunc
+	locators []string
+	prefetch int
+
+	// The index of the next block to start fetching
+	next int
+
+	// Fetches in progress, in the order of the blocks
+	pending []chan blockResult
+
+	// The unread part of the current block
+	current []byte
+
+	err error
+}
+
+type blockResult struct {
+	data []byte
+	err  error
+}
+
+// Create a BlockReader for the blocks with the given locators, fetching
+// up to 'prefetch' blocks at once.  If prefetch is less than 1,
+// DEFAULT_PREFETCH_BLOCKS is used.
+func NewBlockReader(kc *KeepClient, locators []string, prefetch int) *BlockReader {
+	return NewBlockReaderContext(context.Background(), kc, locators, prefetch)
+}
+
+// Like NewBlockReader, but the fetches are abandoned, and Read returns an
+// error, if ctx is cancelled or its deadline passes.
+func NewBlockReaderContext(ctx context.Context, kc *KeepClient, locators []string, prefetch int) *BlockReader {
+	if prefetch < 1 {
+		prefetch = DEFAULT_PREFETCH_BLOCKS
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &BlockReader{
+		kc:       kc,
+		ctx:      ctx,
+		cancel:   cancel,
+		locators: locators,
+		prefetch: prefetch,
+	}
+}
+
+func (this *BlockReader) Read(p []byte) (n int, err error) {
+	for len(this.current) == 0 {
+		if this.err != nil {
+			return 0, this.err
+		}
+		this.startFetches()
+		if len(this.pending) == 0 {
+			return 0, io.EOF
+		}
+		var result blockResult
+		select {
+		case result = <-this.pending[0]:
+		case <-this.ctx.Done():
+			result.err = this.ctx.Err()
+		}
+		this.pending = this.pending[1:]
+		if result.err != nil {
+			this.err = result.err
+			this.cancel()
+			return 0, this.err
+		}
+		this.current = result.data
+		this.startFetches()
+	}
+	n = copy(p, this.current)
+	this.current = this.current[n:]
+	return n, nil
+}
+
+// Start fetching blocks until 'prefetch' fetches are in progress.
+func (this *BlockReader) startFetches() {
+	for len(this.pending) < this.prefetch && this.next < len(this.locators) {
+		// Buffered, so the fetch finishes even if the result is
+		// never read.
+		done := make(chan blockResult, 1)
+		go func(locator string) {
+			data, err := this.kc.getBlock(this.ctx, locator)
+			done <- blockResult{data, err}
+		}(this.locators[this.next])
+		this.pending = append(this.pending, done)
+		this.next += 1
+	}
+}
+
+// Abandon any fetches in progress.  Read returns BlockReaderClosed
+// afterwards.
+func (this *BlockReader) Close() error {
+	this.cancel()
+	if this.err == nil {
+		this.err = BlockReaderClosed
+	}
+	this.current = nil
+	this.pending = nil
+	return nil
+}
+
+// Fetch a block from Keep and check its hash, and its size if the locator
+// has a size hint.
+func (this KeepClient) getBlock(ctx context.Context, locatorString string) ([]byte, error) {
+	loc, err := locator.Parse(locatorString)
+	if err != nil {
+		return nil, err
+	}
+	reader, _, _, err := this.AuthorizedGetContext(ctx, loc.Hash, loc.Signature, loc.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// HashCheckingReader returns BadChecksum instead of EOF if the
+	// data does not match the hash.
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if loc.Size >= 0 && len(data) != loc.Size {
+		return nil, fmt.Errorf("Block %s has size %d, expected %d", loc.Hash, len(data), loc.Size)
+	}
+	return data, nil
+}
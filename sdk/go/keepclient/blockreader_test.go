@@ -0,0 +1,109 @@
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Passes requests to another handler after a delay, recording the
+// largest number handled at once.
+type StubSlowHandler struct {
+	http.Handler
+
+	lock    sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (this *StubSlowHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	this.active += 1
+	if this.active > this.maxSeen {
+		this.maxSeen = this.active
+	}
+	this.lock.Unlock()
+	defer func() {
+		this.lock.Lock()
+		this.active -= 1
+		this.lock.Unlock()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	this.Handler.ServeHTTP(resp, req)
+}
+
+func (this *StubSlowHandler) MaxSeen() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.maxSeen
+}
+
+func (s *StandaloneSuite) TestBlockReader(c *C) {
+	st := &StubBlocksHandler{blocks: make(map[string][]byte), requests: make(map[string]int)}
+	var locators []string
+	var expect []byte
+	for i := 0; i < 6; i++ {
+		data := strings.Repeat(string(rune('a'+i)), 1000+i)
+		locators = append(locators, st.Add(data))
+		expect = append(expect, data...)
+	}
+	slow := &StubSlowHandler{Handler: st}
+	kc, stop := makeRetryTestClient(1, slow)
+	defer stop()
+
+	br := NewBlockReader(&kc, locators, 2)
+	got, err := ioutil.ReadAll(br)
+	c.Check(err, IsNil)
+	c.Check(got, DeepEquals, expect)
+	c.Check(slow.MaxSeen(), Equals, 2)
+
+	c.Check(br.Close(), IsNil)
+	_, err = br.Read(make([]byte, 10))
+	c.Check(err, Equals, BlockReaderClosed)
+
+	got, err = ioutil.ReadAll(NewBlockReader(&kc, nil, 0))
+	c.Check(err, IsNil)
+	c.Check(got, HasLen, 0)
+}
+
+func (s *StandaloneSuite) TestBlockReaderBadBlock(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	goodHash := MakeLocator(st.Add("foo")).Hash
+	badHash := fmt.Sprintf("%x", md5.Sum([]byte("bar")))
+	st.blocks[badHash] = []byte("baz")
+
+	br := NewBlockReader(&kc, []string{goodHash + "+3", badHash + "+3", goodHash + "+3"}, 0)
+	buf := make([]byte, 10)
+	n, err := br.Read(buf)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "foo")
+	_, err = br.Read(buf)
+	c.Check(err, Equals, BadChecksum)
+	_, err = br.Read(buf)
+	c.Check(err, Equals, BadChecksum)
+
+	// The size hint is checked too.
+	br = NewBlockReader(&kc, []string{goodHash + "+4"}, 0)
+	_, err = ioutil.ReadAll(br)
+	c.Check(err, ErrorMatches, "Block .* has size 3, expected 4")
+}
+
+func (s *StandaloneSuite) TestBlockReaderBareHash(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	hash := MakeLocator(st.Add("foo")).Hash
+	empty := fmt.Sprintf("%x", md5.Sum(nil))
+	st.blocks[empty] = []byte{}
+
+	// With no size hint, the block is read whatever its size.
+	got, err := ioutil.ReadAll(NewBlockReader(&kc, []string{hash, empty, hash}, 0))
+	c.Check(err, IsNil)
+	c.Check(string(got), Equals, "foofoo")
+}
@@ -0,0 +1,212 @@
+/* Uploads a stream of any size to Keep as a series of blocks. */
+package keepclient
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var BlockWriterClosed = errors.New("BlockWriter is closed")
+
+// An io.WriteCloser that splits the data written to it into blocks of
+// BlockSize bytes and uploads each one with PutHB as soon as it is full,
+// while the following data is being written.  Up to Parallelism blocks are
+// held in memory at once, including the one being filled, so Write blocks
+// while that many are waiting to be uploaded.
+//
+// Usage:
+//
+//   bw := NewBlockWriter(&kc)
+//   io.Copy(bw, bigFile)
+//   locators, err := bw.Finish()
+//
+// The locators are returned in the order of the data.  A BlockWriter is
+// not safe for concurrent use.
+type BlockWriter struct {
+	// Maximum number of blocks held in memory at once.
+	Parallelism int
+
+	// Maximum size of each block.  If less than 1 or more than
+	// BLOCKSIZE, BLOCKSIZE is used.
+	BlockSize int
+
+	kc  *KeepClient
+	ctx context.Context
+
+	// The blocks written so far
+	blocks []*writerBlock
+
+	// Data not yet written to a block.  Nil unless it holds one of
+	// the slots in 'buffers'.
+	buf []byte
+
+	// Limits the number of blocks held in memory
+	buffers chan bool
+
+	finished bool
+
+	// Uploads that have been started, and the first error from any
+	// of them
+	wg       sync.WaitGroup
+	errLock  sync.Mutex
+	firstErr error
+}
+
+// Create a BlockWriter that stores blocks using kc.
+func NewBlockWriter(kc *KeepClient) *BlockWriter {
+	return NewBlockWriterContext(context.Background(), kc)
+}
+
+// Like NewBlockWriter, but the uploads are abandoned, and Write returns an
+// error, if ctx is cancelled or its deadline passes.
+func NewBlockWriterContext(ctx context.Context, kc *KeepClient) *BlockWriter {
+	return &BlockWriter{
+		Parallelism: DEFAULT_UPLOAD_PARALLELISM,
+		BlockSize:   BLOCKSIZE,
+		kc:          kc,
+		ctx:         ctx,
+	}
+}
+
+// Add p to the data being uploaded.  Returns the first error from any
+// block upload that has failed so far.
+func (this *BlockWriter) Write(p []byte) (n int, err error) {
+	if this.finished {
+		return 0, BlockWriterClosed
+	}
+	if this.buffers == nil {
+		parallelism := this.Parallelism
+		if parallelism < 1 {
+			parallelism = 1
+		}
+		this.buffers = make(chan bool, parallelism)
+	}
+	for len(p) > 0 {
+		if err := this.err(); err != nil {
+			return n, err
+		}
+		if this.buf == nil {
+			select {
+			case this.buffers <- true:
+			case <-this.ctx.Done():
+				return n, this.ctx.Err()
+			}
+			this.buf = make([]byte, 0)
+		}
+
+		chunk := this.blockSize() - len(this.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		this.grow(len(this.buf) + chunk)
+		this.buf = append(this.buf, p[:chunk]...)
+		p = p[chunk:]
+		n += chunk
+
+		if len(this.buf) >= this.blockSize() {
+			this.flush()
+		}
+	}
+	return n, this.err()
+}
+
+// Make room in buf for 'size' bytes, doubling its capacity as needed but
+// never beyond the block size, so a block does not use more memory than it
+// holds.
+func (this *BlockWriter) grow(size int) {
+	if size <= cap(this.buf) {
+		return
+	}
+	newcap := 2 * cap(this.buf)
+	if newcap < 64*1024 {
+		newcap = 64 * 1024
+	}
+	if newcap < size {
+		newcap = size
+	}
+	if newcap > this.blockSize() {
+		newcap = this.blockSize()
+	}
+	buf := make([]byte, len(this.buf), newcap)
+	copy(buf, this.buf)
+	this.buf = buf
+}
+
+func (this *BlockWriter) blockSize() int {
+	if this.BlockSize < 1 || this.BlockSize > BLOCKSIZE {
+		return BLOCKSIZE
+	}
+	return this.BlockSize
+}
+
+// Start uploading the buffered data as a new block.  The upload releases
+// the buffer's slot when it is done.
+func (this *BlockWriter) flush() {
+	data := this.buf
+	this.buf = nil
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	block := &writerBlock{fmt.Sprintf("%s+%d", hash, len(data))}
+	this.blocks = append(this.blocks, block)
+
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+		defer func() { <-this.buffers }()
+		locator, _, err := this.kc.PutHBContext(this.ctx, hash, data)
+		if err != nil {
+			this.setErr(err)
+			return
+		}
+		if locator != "" {
+			// Use the locator returned by the server, which
+			// may include a permission signature.
+			block.locator = locator
+		}
+	}()
+}
+
+func (this *BlockWriter) setErr(err error) {
+	this.errLock.Lock()
+	defer this.errLock.Unlock()
+	if this.firstErr == nil {
+		this.firstErr = err
+	}
+}
+
+func (this *BlockWriter) err() error {
+	this.errLock.Lock()
+	defer this.errLock.Unlock()
+	return this.firstErr
+}
+
+// Upload any remaining data, wait for all uploads to finish, and return
+// the locators of the blocks in order.  If nothing was written, there are
+// no blocks.  Returns the first upload error, if any.
+func (this *BlockWriter) Finish() (locators []string, err error) {
+	if !this.finished {
+		this.finished = true
+		if len(this.buf) > 0 {
+			this.flush()
+		} else if this.buf != nil {
+			this.buf = nil
+			<-this.buffers
+		}
+	}
+	this.wg.Wait()
+	if err := this.err(); err != nil {
+		return nil, err
+	}
+	for _, b := range this.blocks {
+		locators = append(locators, b.locator)
+	}
+	return locators, nil
+}
+
+// Finish the upload, discarding the locators.
+func (this *BlockWriter) Close() error {
+	_, err := this.Finish()
+	return err
+}
@@ -0,0 +1,128 @@
+package keepclient
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Stores nothing, but answers PUTs slowly, recording the largest number
+// answered at once.
+type StubSlowPutHandler struct {
+	lock    sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (this *StubSlowPutHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	this.active += 1
+	if this.active > this.maxSeen {
+		this.maxSeen = this.active
+	}
+	this.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(req.Body)
+	time.Sleep(20 * time.Millisecond)
+	resp.Write([]byte(fmt.Sprintf("%x+%d", md5.Sum(body), len(body))))
+
+	this.lock.Lock()
+	this.active -= 1
+	this.lock.Unlock()
+}
+
+func (s *StandaloneSuite) TestBlockWriter(c *C) {
+	kc, stop := makeRetryTestClient(1, &FlakyHandler{})
+	defer stop()
+	kc.Want_replicas = 1
+
+	data := make([]byte, 9500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	bw := NewBlockWriter(&kc)
+	bw.BlockSize = 1000
+	n, err := io.Copy(bw, bytes.NewReader(data))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, int64(len(data)))
+	locators, err := bw.Finish()
+	c.Assert(err, IsNil)
+	c.Assert(locators, HasLen, 10)
+	for i, loc := range locators {
+		end := (i + 1) * 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i*1000 : end]
+		c.Check(loc, Equals, fmt.Sprintf("%x+%d", md5.Sum(chunk), len(chunk)))
+	}
+
+	_, err = bw.Write([]byte("foo"))
+	c.Check(err, Equals, BlockWriterClosed)
+
+	// Nothing written, no blocks.
+	locators, err = NewBlockWriter(&kc).Finish()
+	c.Check(err, IsNil)
+	c.Check(locators, HasLen, 0)
+}
+
+func (s *StandaloneSuite) TestBlockWriterBlockSize(c *C) {
+	kc, stop := makeRetryTestClient(1, &FlakyHandler{})
+	defer stop()
+	kc.Want_replicas = 1
+
+	for _, size := range []int{0, -1, BLOCKSIZE + 1} {
+		bw := NewBlockWriter(&kc)
+		bw.BlockSize = size
+		_, err := bw.Write([]byte("foo"))
+		c.Check(err, IsNil)
+		c.Check(bw.blockSize(), Equals, BLOCKSIZE)
+		locators, err := bw.Finish()
+		c.Check(err, IsNil)
+		c.Check(locators, DeepEquals, []string{"acbd18db4cc2f85cedef654fccc4a4d8+3"})
+	}
+}
+
+func (s *StandaloneSuite) TestBlockWriterParallelism(c *C) {
+	st := &StubSlowPutHandler{}
+	kc, stop := makeRetryTestClient(1, st)
+	defer stop()
+	kc.Want_replicas = 1
+
+	bw := NewBlockWriter(&kc)
+	bw.BlockSize = 100
+	bw.Parallelism = 3
+	for i := 0; i < 20; i++ {
+		_, err := bw.Write(bytes.Repeat([]byte{byte(i)}, 100))
+		c.Assert(err, IsNil)
+
+		// The block being filled holds one of the slots.
+		c.Check(len(bw.buffers) <= bw.Parallelism, Equals, true)
+	}
+	locators, err := bw.Finish()
+	c.Check(err, IsNil)
+	c.Check(locators, HasLen, 20)
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	c.Check(st.maxSeen, Equals, 3)
+}
+
+func (s *StandaloneSuite) TestBlockWriterError(c *C) {
+	kc, stop := makeRetryTestClient(1, &FlakyHandler{failures: 1000, failStatus: 500})
+	defer stop()
+	kc.Want_replicas = 1
+
+	bw := NewBlockWriter(&kc)
+	bw.BlockSize = 10
+	bw.Write(bytes.Repeat([]byte("x"), 25))
+	locators, err := bw.Finish()
+	c.Check(errors.Is(err, InsufficientReplicasError), Equals, true)
+	c.Check(locators, IsNil)
+}
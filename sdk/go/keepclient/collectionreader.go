@@ -0,0 +1,258 @@
+/* Reads files from a collection, given its manifest text. */
+package keepclient
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var CollectionFileNotFound = errors.New("File not found in collection")
+var InvalidManifestError = errors.New("Invalid manifest")
+
+// Number of blocks kept in memory by a CollectionReader, unless
+// CacheBlocks is changed.
+const DEFAULT_CACHE_BLOCKS = 4
+
+// Provides access to the files in a collection.  Blocks are fetched from
+// Keep only when a file that uses them is read, and each block is checked
+// against its hash before any of it is returned.  Recently used blocks are
+// cached, so reading several small files stored in the same block, or
+// re-reading part of a file after a Seek(), does not fetch the block again.
+//
+// A CollectionReader is safe for concurrent use, and so are the readers
+// returned by Open() as long as each one is used by a single goroutine.
+type CollectionReader struct {
+	// Maximum number of blocks to keep in memory.
+	CacheBlocks int
+
+	// Number of blocks beyond the current one to start fetching in the
+	// background when a file is being read.  Zero disables read-ahead.
+	ReadAhead int
+
+	kc    *KeepClient
+	files map[string]*collectionFile
+	cache blockCache
+}
+
+// A contiguous part of a file, stored in a single block.
+type fileSegment struct {
+	locator     string
+	fileOffset  int64
+	blockOffset int64
+	length      int64
+}
+
+type collectionFile struct {
+	size     int64
+	segments []fileSegment
+}
+
+// Create a CollectionReader for the collection described by manifestText,
+// which fetches blocks using kc.  Returns InvalidManifestError if the
+// manifest text cannot be parsed.
+func NewCollectionReader(kc *KeepClient, manifestText string) (*CollectionReader, error) {
+	this := &CollectionReader{
+		CacheBlocks: DEFAULT_CACHE_BLOCKS,
+		ReadAhead:   1,
+		kc:          kc,
+		files:       make(map[string]*collectionFile),
+	}
+	m := manifest.Manifest{Text: manifestText}
+	fileMap, err := m.FileMap()
+	if err != nil {
+		return nil, InvalidManifestError
+	}
+	for path, ranges := range fileMap {
+		f := &collectionFile{}
+		for _, r := range ranges {
+			f.segments = append(f.segments, fileSegment{
+				locator:     r.Block.String(),
+				fileOffset:  f.size,
+				blockOffset: r.Offset,
+				length:      r.Len,
+			})
+			f.size += r.Len
+		}
+		this.files[path] = f
+	}
+	return this, nil
+}
+
+// Convert a path within a collection to the form used as a key in
+// CollectionReader.files: no leading "./" or "/", and no "." components.
+func cleanCollectionPath(path string) string {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p != "" && p != "." {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// List the paths of the files in the collection, in no particular order.
+func (this *CollectionReader) Files() []string {
+	var paths []string
+	for path := range this.files {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Open a file in the collection for reading.  The path is relative to the
+// top of the collection; a leading "./" is optional.  Returns
+// CollectionFileNotFound if there is no such file.
+func (this *CollectionReader) Open(path string) (io.ReadSeeker, error) {
+	f, ok := this.files[cleanCollectionPath(path)]
+	if !ok {
+		return nil, CollectionFileNotFound
+	}
+	return &collectionFileReader{cr: this, file: f, readAhead: -1}, nil
+}
+
+// Get the contents of a block, from the cache if possible.
+func (this *CollectionReader) getBlock(locator string) ([]byte, error) {
+	return this.cache.get(locator, this.CacheBlocks, func() ([]byte, error) {
+		return this.fetchBlock(locator)
+	})
+}
+
+// Fetch a block from Keep and check its hash and size.
+func (this *CollectionReader) fetchBlock(locator string) ([]byte, error) {
+	return this.kc.getBlock(context.Background(), locator)
+}
+
+// Reads a single file from a collection.
+type collectionFileReader struct {
+	cr     *CollectionReader
+	file   *collectionFile
+	offset int64
+
+	// The highest segment for which read-ahead has been started
+	readAhead int
+}
+
+func (this *collectionFileReader) Read(p []byte) (n int, err error) {
+	segments := this.file.segments
+	if this.offset >= this.file.size {
+		return 0, io.EOF
+	}
+
+	// Find the segment containing the current offset.
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].fileOffset+segments[i].length > this.offset
+	})
+	seg := segments[i]
+	this.startReadAhead(i)
+
+	data, err := this.cr.getBlock(seg.locator)
+	if err != nil {
+		return 0, err
+	}
+	start := seg.blockOffset + (this.offset - seg.fileOffset)
+	n = copy(p, data[start:seg.blockOffset+seg.length])
+	this.offset += int64(n)
+	return n, nil
+}
+
+// Start fetching the blocks after segment i in the background.
+func (this *collectionFileReader) startReadAhead(i int) {
+	segments := this.file.segments
+	last := i + this.cr.ReadAhead
+	if last >= len(segments) {
+		last = len(segments) - 1
+	}
+	if this.readAhead < i {
+		this.readAhead = i
+	}
+	for ; this.readAhead < last; this.readAhead++ {
+		next := segments[this.readAhead+1].locator
+		if next != segments[this.readAhead].locator {
+			go this.cr.getBlock(next)
+		}
+	}
+}
+
+func (this *collectionFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += this.offset
+	case io.SeekEnd:
+		offset += this.file.size
+	default:
+		return this.offset, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return this.offset, fmt.Errorf("Invalid offset %d", offset)
+	}
+	this.offset = offset
+	this.readAhead = -1
+	return offset, nil
+}
+
+// A least-recently-used cache of block contents, keyed by locator.
+// Concurrent requests for the same block share a single fetch.
+type blockCache struct {
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	lru     list.List
+}
+
+type cacheEntry struct {
+	locator string
+	ready   chan bool
+	data    []byte
+	err     error
+	elem    *list.Element
+}
+
+// Return the block for 'locator', calling fetch to get it if it is not
+// already cached or being fetched.  The cache holds at most max blocks.
+// Failed fetches are not cached.
+func (this *blockCache) get(locator string, max int, fetch func() ([]byte, error)) ([]byte, error) {
+	this.lock.Lock()
+	if this.entries == nil {
+		this.entries = make(map[string]*cacheEntry)
+	}
+	e, ok := this.entries[locator]
+	if ok {
+		this.lru.MoveToFront(e.elem)
+		this.lock.Unlock()
+		<-e.ready
+		return e.data, e.err
+	}
+
+	e = &cacheEntry{locator: locator, ready: make(chan bool)}
+	e.elem = this.lru.PushFront(e)
+	this.entries[locator] = e
+	for this.lru.Len() > max && this.lru.Len() > 1 {
+		this.remove(this.lru.Back().Value.(*cacheEntry))
+	}
+	this.lock.Unlock()
+
+	e.data, e.err = fetch()
+	close(e.ready)
+
+	if e.err != nil {
+		this.lock.Lock()
+		if this.entries[locator] == e {
+			this.remove(e)
+		}
+		this.lock.Unlock()
+	}
+	return e.data, e.err
+}
+
+// Remove an entry.  Must be called with the lock held.
+func (this *blockCache) remove(e *cacheEntry) {
+	this.lru.Remove(e.elem)
+	delete(this.entries, e.locator)
+}
@@ -0,0 +1,224 @@
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Serves blocks from a map of hash to contents, and counts the GET and PUT
+// requests for each block, and separately the HEAD requests.  Blocks
+// written with PUT are added to the map.  If 'denied' is set, every GET
+// and HEAD is refused with 403.
+type StubBlocksHandler struct {
+	lock     sync.Mutex
+	blocks   map[string][]byte
+	requests map[string]int
+	asks     map[string]int
+	denied   bool
+}
+
+func (this *StubBlocksHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	hash := strings.SplitN(req.URL.Path[1:], "+", 2)[0]
+	if req.Method == "PUT" {
+		data, _ := ioutil.ReadAll(req.Body)
+		this.lock.Lock()
+		this.requests[hash] += 1
+		this.blocks[hash] = data
+		this.lock.Unlock()
+		resp.Write([]byte(fmt.Sprintf("%s+%d", hash, len(data))))
+		return
+	}
+	this.lock.Lock()
+	if req.Method == "HEAD" {
+		this.asks[hash] += 1
+	} else {
+		this.requests[hash] += 1
+	}
+	data, ok := this.blocks[hash]
+	denied := this.denied
+	this.lock.Unlock()
+	if denied {
+		http.Error(resp, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !ok {
+		http.Error(resp, "Not Found", http.StatusNotFound)
+		return
+	}
+	resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	if req.Method != "HEAD" {
+		resp.Write(data)
+	}
+}
+
+func (this *StubBlocksHandler) Requests(hash string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests[hash]
+}
+
+func (this *StubBlocksHandler) Asks(hash string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.asks[hash]
+}
+
+// Store 'data' on the stub server and return its locator.
+func (this *StubBlocksHandler) Add(data string) string {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	this.blocks[hash] = []byte(data)
+	return fmt.Sprintf("%s+%d", hash, len(data))
+}
+
+func makeCollectionTestClient() (kc KeepClient, st *StubBlocksHandler, stop func()) {
+	st = &StubBlocksHandler{blocks: make(map[string][]byte), requests: make(map[string]int), asks: make(map[string]int)}
+	ks := RunFakeKeepServer(st)
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	arv.ApiToken = "abc123"
+	kc, _ = MakeKeepClient(&arv)
+	kc.SetServiceRoots(map[string]string{"zzzzz-bi6l4-fakefakefake000": ks.url})
+	return kc, st, func() { ks.listener.Close() }
+}
+
+func (s *StandaloneSuite) TestCollectionReader(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+
+	abc := st.Add("abc")
+	def := st.Add("def")
+	hello := st.Add("hello")
+	mt := ". " + abc + " " + def + " 0:4:foo.txt 4:2:bar\\040baz.txt 0:0:empty\n" +
+		"./sub " + hello + " 1:4:x.txt 0:1:x.txt\n"
+
+	cr, err := NewCollectionReader(&kc, mt)
+	c.Assert(err, IsNil)
+	cr.ReadAhead = 0
+
+	files := cr.Files()
+	sort.Strings(files)
+	c.Check(files, DeepEquals, []string{"bar baz.txt", "empty", "foo.txt", "sub/x.txt"})
+
+	for path, expect := range map[string]string{
+		"foo.txt":       "abcd",
+		"./bar baz.txt": "ef",
+		"empty":         "",
+		"./sub/x.txt":   "elloh",
+	} {
+		r, err := cr.Open(path)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, expect, Commentf("%s", path))
+	}
+
+	// Each block was fetched once, even though "def" and "hello" are
+	// used by more than one read.
+	for _, locator := range []string{abc, def, hello} {
+		c.Check(st.Requests(locator[:32]), Equals, 1)
+	}
+
+	_, err = cr.Open("nonexistent")
+	c.Check(err, Equals, CollectionFileNotFound)
+}
+
+func (s *StandaloneSuite) TestCollectionReaderSeek(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+
+	mt := ". " + st.Add("0123456789") + " " + st.Add("abcdefghij") + " 0:20:f\n"
+	cr, err := NewCollectionReader(&kc, mt)
+	c.Assert(err, IsNil)
+
+	r, err := cr.Open("f")
+	c.Assert(err, IsNil)
+
+	buf := make([]byte, 4)
+	for _, t := range []struct {
+		offset int64
+		whence int
+		pos    int64
+		expect string
+	}{
+		{8, io.SeekStart, 8, "89"},
+		{-2, io.SeekEnd, 18, "ij"},
+		{-15, io.SeekCurrent, 5, "5678"},
+		{25, io.SeekStart, 25, ""},
+	} {
+		pos, err := r.Seek(t.offset, t.whence)
+		c.Check(err, IsNil)
+		c.Check(pos, Equals, t.pos)
+		n, err := r.Read(buf)
+		c.Check(string(buf[:n]), Equals, t.expect)
+		if t.expect == "" {
+			c.Check(err, Equals, io.EOF)
+		}
+	}
+
+	_, err = r.Seek(-1, io.SeekStart)
+	c.Check(err, NotNil)
+}
+
+func (s *StandaloneSuite) TestCollectionReaderBadChecksum(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+
+	locator := st.Add("foo")
+	st.blocks[locator[:32]] = []byte("bar")
+
+	cr, err := NewCollectionReader(&kc, ". "+locator+" 0:3:foo\n")
+	c.Assert(err, IsNil)
+
+	r, err := cr.Open("foo")
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(r)
+	c.Check(err, Equals, BadChecksum)
+
+	// Failed fetches are not cached.
+	_, err = ioutil.ReadAll(r)
+	c.Check(err, Equals, BadChecksum)
+	c.Check(st.Requests(locator[:32]), Equals, 2)
+}
+
+func (s *StandaloneSuite) TestCollectionReaderCacheEviction(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+
+	a, b, d := st.Add("a"), st.Add("b"), st.Add("d")
+	cr, err := NewCollectionReader(&kc, ". "+a+" "+b+" "+d+" 0:1:a 1:1:b 2:1:d\n")
+	c.Assert(err, IsNil)
+	cr.CacheBlocks = 2
+	cr.ReadAhead = 0
+
+	for _, path := range []string{"a", "b", "d", "a"} {
+		r, _ := cr.Open(path)
+		data, err := ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, path)
+	}
+	c.Check(st.Requests(a[:32]), Equals, 2)
+	c.Check(st.Requests(b[:32]), Equals, 1)
+	c.Check(st.Requests(d[:32]), Equals, 1)
+}
+
+func (s *StandaloneSuite) TestCollectionReaderInvalidManifest(c *C) {
+	kc, _, stop := makeCollectionTestClient()
+	defer stop()
+
+	for _, mt := range []string{
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 0:4:foo\n",
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 foo\n",
+		". acbd18db4cc2f85cedef654fccc4a4d8+3 x:3:foo\n",
+	} {
+		_, err := NewCollectionReader(&kc, mt)
+		c.Check(err, Equals, InvalidManifestError, Commentf("%q", mt))
+	}
+}
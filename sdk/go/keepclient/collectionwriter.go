@@ -0,0 +1,254 @@
+/* Builds a collection by writing files to Keep. */
+package keepclient
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Number of blocks a CollectionWriter uploads at once, unless Parallelism
+// is changed.
+const DEFAULT_UPLOAD_PARALLELISM = 4
+
+// The locator of the empty block, used for streams with no data.
+const EMPTY_BLOCK_LOCATOR = manifest.EMPTY_BLOCK_LOCATOR
+
+// Writes files to Keep and builds the manifest for a collection containing
+// them.
+//
+// Files in the same directory are stored in the same manifest stream, and
+// their contents are packed into blocks of up to BlockSize bytes.  Each
+// block is uploaded with PutHB as soon as it is full, while the following
+// data is being read, with up to Parallelism uploads in progress at once.
+// Only the stream most recently written to keeps a partly filled block in
+// memory: when a file in another stream is written, that block is uploaded
+// even though it is not full.
+//
+// Usage:
+//
+//   cw := NewCollectionWriter(&kc)
+//   cw.WriteFile("foo.txt", fooReader)
+//   cw.WriteFile("subdir/bar.txt", barReader)
+//   manifestText, err := cw.Finish()
+//
+// A CollectionWriter is safe for concurrent use, but files are written one
+// at a time.
+type CollectionWriter struct {
+	// Maximum number of blocks to upload at once.  If less than 1,
+	// DEFAULT_UPLOAD_PARALLELISM is used.
+	Parallelism int
+
+	// Maximum size of each block.  If less than 1 or more than
+	// BLOCKSIZE, BLOCKSIZE is used.
+	BlockSize int
+
+	kc      *KeepClient
+	lock    sync.Mutex
+	streams map[string]*writerStream
+
+	// The stream most recently written to
+	current *writerStream
+
+	// Limits the number of uploads in progress
+	uploads chan bool
+
+	// Uploads that have been started, and the first error from any
+	// of them
+	wg       sync.WaitGroup
+	errLock  sync.Mutex
+	firstErr error
+}
+
+// A manifest stream being built by a CollectionWriter.
+type writerStream struct {
+	// The blocks written so far
+	blocks []*writerBlock
+
+	// Data not yet written to a block, or nil if there is none
+	buf *bytes.Buffer
+
+	// Total size of the stream so far, including buf
+	size int64
+
+	files []string
+}
+
+// A block written by a CollectionWriter.  The locator is replaced with the
+// one returned by the Keep server when the upload completes, and must not
+// be read until then.
+type writerBlock struct {
+	locator string
+}
+
+// Create a CollectionWriter that stores blocks using kc.
+func NewCollectionWriter(kc *KeepClient) *CollectionWriter {
+	return &CollectionWriter{
+		Parallelism: DEFAULT_UPLOAD_PARALLELISM,
+		BlockSize:   BLOCKSIZE,
+		kc:          kc,
+		streams:     make(map[string]*writerStream),
+	}
+}
+
+// Add a file to the collection, with the contents read from r until EOF.
+// The path is relative to the top of the collection, and directories are
+// separated by "/".  Returns the error from r, if any, or the first error
+// from any block upload that has failed so far.
+func (this *CollectionWriter) WriteFile(path string, r io.Reader) error {
+	streamName, fileName := splitCollectionPath(path)
+	if fileName == "" || strings.HasSuffix(path, "/") {
+		return fmt.Errorf("Invalid file name %q", path)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.uploads == nil {
+		this.uploads = make(chan bool, this.parallelism())
+	}
+	s := this.streams[streamName]
+	if s == nil {
+		s = &writerStream{}
+		this.streams[streamName] = s
+	}
+	if this.current != nil && this.current != s && this.current.buf != nil {
+		this.flush(this.current)
+	}
+	this.current = s
+
+	blockSize := this.blockSize()
+	start := s.size
+	for {
+		if s.buf == nil {
+			s.buf = bytes.NewBuffer(make([]byte, 0, blockSize))
+		}
+		n, err := io.CopyN(s.buf, r, int64(blockSize-s.buf.Len()))
+		s.size += n
+		if s.buf.Len() >= blockSize {
+			this.flush(s)
+		} else if s.buf.Len() == 0 {
+			s.buf = nil
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	s.files = append(s.files, fmt.Sprintf("%d:%d:%s", start, s.size-start, manifest.EscapeName(fileName)))
+	return this.err()
+}
+
+func (this *CollectionWriter) parallelism() int {
+	if this.Parallelism < 1 {
+		return DEFAULT_UPLOAD_PARALLELISM
+	}
+	return this.Parallelism
+}
+
+func (this *CollectionWriter) blockSize() int {
+	if this.BlockSize < 1 || this.BlockSize > BLOCKSIZE {
+		return BLOCKSIZE
+	}
+	return this.BlockSize
+}
+
+// Start uploading the buffered data of stream s as a new block.  Must be
+// called with the lock held.
+func (this *CollectionWriter) flush(s *writerStream) {
+	data := s.buf.Bytes()
+	s.buf = nil
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	block := &writerBlock{fmt.Sprintf("%s+%d", hash, len(data))}
+	s.blocks = append(s.blocks, block)
+
+	this.uploads <- true
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+		defer func() { <-this.uploads }()
+		locator, _, err := this.kc.PutHB(hash, data)
+		if err != nil {
+			this.setErr(err)
+			return
+		}
+		if locator != "" {
+			// Use the locator returned by the server, which
+			// may include a permission signature.
+			block.locator = locator
+		}
+	}()
+}
+
+func (this *CollectionWriter) setErr(err error) {
+	this.errLock.Lock()
+	defer this.errLock.Unlock()
+	if this.firstErr == nil {
+		this.firstErr = err
+	}
+}
+
+func (this *CollectionWriter) err() error {
+	this.errLock.Lock()
+	defer this.errLock.Unlock()
+	return this.firstErr
+}
+
+// Upload any remaining data, wait for all uploads to finish, and return
+// the manifest text for the collection.  Streams appear in order of name,
+// and files within each stream in the order they were written.  Returns
+// the first upload error, if any.
+func (this *CollectionWriter) Finish() (manifestText string, err error) {
+	this.lock.Lock()
+	for _, s := range this.streams {
+		if s.buf != nil {
+			this.flush(s)
+		}
+	}
+	this.lock.Unlock()
+
+	this.wg.Wait()
+	if err := this.err(); err != nil {
+		return "", err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var names []string
+	for name := range this.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		s := this.streams[name]
+		var blocks []string
+		for _, b := range s.blocks {
+			blocks = append(blocks, b.locator)
+		}
+		if len(blocks) == 0 {
+			blocks = []string{EMPTY_BLOCK_LOCATOR}
+		}
+		fmt.Fprintf(&buf, "%s %s %s\n", manifest.EscapeName(name),
+			strings.Join(blocks, " "), strings.Join(s.files, " "))
+	}
+	return buf.String(), nil
+}
+
+// Split a path within a collection into the manifest stream name (such as
+// "." or "./foo/bar") and the file name.
+func splitCollectionPath(path string) (streamName string, fileName string) {
+	path = cleanCollectionPath(path)
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return "./" + path[:i], path[i+1:]
+	}
+	return ".", path
+}
@@ -0,0 +1,143 @@
+package keepclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+func (s *StandaloneSuite) TestCollectionWriter(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	kc.Want_replicas = 1
+
+	cw := NewCollectionWriter(&kc)
+	cw.BlockSize = 4
+	c.Check(cw.WriteFile("foo.txt", strings.NewReader("foo")), IsNil)
+	c.Check(cw.WriteFile("bar baz.txt", strings.NewReader("barbaz")), IsNil)
+	c.Check(cw.WriteFile("sub/dir/empty", strings.NewReader("")), IsNil)
+	c.Check(cw.WriteFile("./sub/x", strings.NewReader("x")), IsNil)
+
+	mt, err := cw.Finish()
+	c.Assert(err, IsNil)
+	c.Check(mt, Equals, ""+
+		". "+st.Add("foob")+" "+st.Add("arba")+" "+st.Add("z")+" 0:3:foo.txt 3:6:bar\\040baz.txt\n"+
+		"./sub "+st.Add("x")+" 0:1:x\n"+
+		"./sub/dir "+EMPTY_BLOCK_LOCATOR+" 0:0:empty\n")
+
+	// The manifest can be read back.
+	cr, err := NewCollectionReader(&kc, mt)
+	c.Assert(err, IsNil)
+	for path, expect := range map[string]string{
+		"foo.txt":       "foo",
+		"bar baz.txt":   "barbaz",
+		"sub/x":         "x",
+		"sub/dir/empty": "",
+	} {
+		r, err := cr.Open(path)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, expect)
+	}
+}
+
+func (s *StandaloneSuite) TestCollectionWriterSwitchStreams(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	kc.Want_replicas = 1
+
+	cw := NewCollectionWriter(&kc)
+	cw.BlockSize = 4
+	c.Check(cw.WriteFile("a/x", strings.NewReader("ab")), IsNil)
+	c.Check(cw.WriteFile("b/y", strings.NewReader("cdef")), IsNil)
+	c.Check(cw.WriteFile("a/z", strings.NewReader("gh")), IsNil)
+
+	// Only the stream written last holds a partial block.
+	c.Check(cw.streams["./a"].buf.Len(), Equals, 2)
+	c.Check(cw.streams["./b"].buf, IsNil)
+
+	mt, err := cw.Finish()
+	c.Assert(err, IsNil)
+	c.Check(mt, Equals, ""+
+		"./a "+st.Add("ab")+" "+st.Add("gh")+" 0:2:x 2:2:z\n"+
+		"./b "+st.Add("cdef")+" 0:4:y\n")
+}
+
+func (s *StandaloneSuite) TestCollectionWriterLargeFile(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	kc.Want_replicas = 1
+
+	var content bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+
+	cw := NewCollectionWriter(&kc)
+	cw.BlockSize = 1000
+	cw.Parallelism = 2
+	c.Check(cw.WriteFile("big", bytes.NewReader(content.Bytes())), IsNil)
+	mt, err := cw.Finish()
+	c.Assert(err, IsNil)
+
+	nblocks := (content.Len() + 999) / 1000
+	c.Check(len(strings.Split(mt, " ")), Equals, nblocks+2)
+	c.Check(len(st.blocks), Equals, nblocks)
+
+	cr, err := NewCollectionReader(&kc, mt)
+	c.Assert(err, IsNil)
+	r, err := cr.Open("big")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, content.Bytes())
+}
+
+func (s *StandaloneSuite) TestCollectionWriterInvalidSettings(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	kc.Want_replicas = 1
+
+	// Out-of-range settings fall back to the defaults.
+	cw := NewCollectionWriter(&kc)
+	cw.BlockSize = 0
+	cw.Parallelism = 0
+	c.Check(cw.WriteFile("foo.txt", strings.NewReader("foo")), IsNil)
+	mt, err := cw.Finish()
+	c.Assert(err, IsNil)
+	c.Check(mt, Equals, ". "+st.Add("foo")+" 0:3:foo.txt\n")
+	c.Check(cw.parallelism(), Equals, DEFAULT_UPLOAD_PARALLELISM)
+	c.Check(cw.blockSize(), Equals, BLOCKSIZE)
+
+	cw.BlockSize = BLOCKSIZE + 1
+	c.Check(cw.blockSize(), Equals, BLOCKSIZE)
+	cw.BlockSize = -1
+	c.Check(cw.blockSize(), Equals, BLOCKSIZE)
+}
+
+type errorReader struct{}
+
+func (errorReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func (s *StandaloneSuite) TestCollectionWriterErrors(c *C) {
+	kc, _, stop := makeCollectionTestClient()
+	defer stop()
+
+	cw := NewCollectionWriter(&kc)
+	c.Check(cw.WriteFile("foo", io.MultiReader(strings.NewReader("foo"), errorReader{})), ErrorMatches, "read error")
+	c.Check(cw.WriteFile("dir/", strings.NewReader("foo")), ErrorMatches, "Invalid file name.*")
+
+	// The stub server stores one replica, so the upload fails when
+	// two are wanted.
+	kc.Want_replicas = 2
+	c.Check(cw.WriteFile("bar", strings.NewReader("bar")), IsNil)
+	_, err := cw.Finish()
+	c.Check(errors.Is(err, InsufficientReplicasError), Equals, true)
+}
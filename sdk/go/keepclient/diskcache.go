@@ -0,0 +1,234 @@
+/* Caches blocks in a directory on local disk. */
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var cacheHashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// The file in the cache directory that records the total size of the
+// cached blocks.
+const cacheSizeFile = "size"
+
+// Stores blocks read from Keep in a directory on local disk, so that
+// KeepClients in any process on the same node can read them again without
+// going over the network.  Set KeepClient.Cache to use one.
+//
+// Each block is stored in a file named after its hash, and is checked
+// against the hash before it is added.  When the total size of the blocks
+// exceeds MaxSize, the least recently used ones are removed.  Processes
+// sharing a directory use a lock file to coordinate removals, and keep
+// the total size in a file so that it need not be added up on every
+// insert.
+//
+// A cached block is returned by KeepClient only once a Keep server has
+// confirmed that the client may read it, so a cache can be shared by
+// clients with different tokens.
+type DiskCache struct {
+	Dir     string
+	MaxSize int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// Counts of cache lookups and removals made by this process.
+type DiskCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// Create a DiskCache storing up to maxSize bytes in dir, which is created
+// if it does not exist.
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskCache{Dir: dir, MaxSize: maxSize}, nil
+}
+
+func (this *DiskCache) Stats() DiskCacheStats {
+	return DiskCacheStats{
+		Hits:      atomic.LoadInt64(&this.hits),
+		Misses:    atomic.LoadInt64(&this.misses),
+		Evictions: atomic.LoadInt64(&this.evictions),
+	}
+}
+
+func (this *DiskCache) path(hash string) string {
+	return filepath.Join(this.Dir, hash[0:3], hash)
+}
+
+// Open the cached copy of a block.  Returns ok=false if the block is not
+// in the cache.
+func (this *DiskCache) open(hash string) (reader io.ReadCloser, size int64, path string, ok bool) {
+	if !cacheHashPattern.MatchString(hash) {
+		return nil, 0, "", false
+	}
+	path = this.path(hash)
+	f, err := os.Open(path)
+	if err != nil {
+		atomic.AddInt64(&this.misses, 1)
+		return nil, 0, "", false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		atomic.AddInt64(&this.misses, 1)
+		return nil, 0, "", false
+	}
+	// The modification time records when the block was last used.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	atomic.AddInt64(&this.hits, 1)
+	return f, fi.Size(), path, true
+}
+
+// Copy a block from 'reader' into the cache, checking it against its
+// hash, and open the cached copy.  Returns BadChecksum, and does not cache
+// the data, if it does not match the hash.
+func (this *DiskCache) insert(hash string, reader io.Reader) (io.ReadCloser, int64, string, error) {
+	if !cacheHashPattern.MatchString(hash) {
+		return nil, 0, "", fmt.Errorf("Invalid hash %q", hash)
+	}
+	path := this.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, 0, "", err
+	}
+
+	// Write to a temporary file, and rename it into place once it is
+	// complete, so other processes never see part of a block.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, HashCheckingReader{reader, md5.New(), hash})
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	err = this.withLock(func() error {
+		var replaced int64
+		if fi, err := os.Stat(path); err == nil {
+			replaced = fi.Size()
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return err
+		}
+		total, ok := this.readTotal()
+		if !ok || total+size-replaced > this.MaxSize {
+			return this.evict(path)
+		}
+		return this.writeTotal(total + size - replaced)
+	})
+	if err != nil {
+		return nil, 0, "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return f, size, path, nil
+}
+
+// Call f while holding the lock on the cache directory, which is shared by
+// all processes using it.
+func (this *DiskCache) withLock(f func() error) error {
+	lockfile, err := os.OpenFile(filepath.Join(this.Dir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockfile.Close()
+	if err := syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lockfile.Fd()), syscall.LOCK_UN)
+	return f()
+}
+
+// The total size of the cached blocks, as last recorded.  Returns
+// ok=false if it has not been recorded.  Must be called with the lock
+// held.
+func (this *DiskCache) readTotal() (total int64, ok bool) {
+	buf, err := ioutil.ReadFile(filepath.Join(this.Dir, cacheSizeFile))
+	if err != nil {
+		return 0, false
+	}
+	total, err = strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+	return total, err == nil
+}
+
+// Record the total size of the cached blocks.  Must be called with the
+// lock held.
+func (this *DiskCache) writeTotal(total int64) error {
+	return ioutil.WriteFile(filepath.Join(this.Dir, cacheSizeFile), []byte(fmt.Sprintf("%d\n", total)), 0600)
+}
+
+// Add up the sizes of the cached blocks, remove the least recently used
+// ones until the cache is no larger than MaxSize, except for the block at
+// 'keep', and record the new total.  Must be called with the lock held.
+func (this *DiskCache) evict(keep string) error {
+	type entry struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var entries []entry
+	var total int64
+	dirs, _ := filepath.Glob(filepath.Join(this.Dir, "???"))
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range files {
+			if !cacheHashPattern.MatchString(fi.Name()) {
+				continue
+			}
+			entries = append(entries, entry{filepath.Join(dir, fi.Name()), fi.Size(), fi.ModTime()})
+			total += fi.Size()
+		}
+	}
+	if total <= this.MaxSize {
+		return this.writeTotal(total)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].mtime.Before(entries[j].mtime)
+	})
+	for _, e := range entries {
+		if total <= this.MaxSize {
+			break
+		}
+		if e.path == keep {
+			continue
+		}
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= e.size
+		atomic.AddInt64(&this.evictions, 1)
+	}
+	return this.writeTotal(total)
+}
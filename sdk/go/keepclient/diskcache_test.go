@@ -0,0 +1,138 @@
+package keepclient
+
+import (
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *StandaloneSuite) TestDiskCache(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	dir, _ := ioutil.TempDir("", "keepcache")
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(dir, 1000)
+	c.Assert(err, IsNil)
+	kc.Cache = cache
+
+	hash := st.Add("foo")[:32]
+	for i := 0; i < 3; i++ {
+		r, size, path, err := kc.Get(hash)
+		c.Assert(err, IsNil)
+		c.Check(size, Equals, int64(3))
+		c.Check(path, Equals, filepath.Join(dir, hash[:3], hash))
+		data, err := ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, "foo")
+		r.Close()
+	}
+	c.Check(st.Requests(hash), Equals, 1)
+	c.Check(st.Asks(hash), Equals, 2)
+	c.Check(cache.Stats(), Equals, DiskCacheStats{Hits: 2, Misses: 1})
+
+	// Another client sharing the directory finds the block too.
+	other, _ := NewDiskCache(dir, 1000)
+	kc.Cache = other
+	_, _, _, err = kc.Get(hash)
+	c.Check(err, IsNil)
+	c.Check(st.Requests(hash), Equals, 1)
+	c.Check(other.Stats().Hits, Equals, int64(1))
+}
+
+func (s *StandaloneSuite) TestDiskCacheEviction(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	dir, _ := ioutil.TempDir("", "keepcache")
+	defer os.RemoveAll(dir)
+	kc.Cache, _ = NewDiskCache(dir, 6)
+
+	a, b, d := st.Add("aaa")[:32], st.Add("bbb")[:32], st.Add("ddd")[:32]
+	for i, hash := range []string{a, b, a, d} {
+		r, _, _, err := kc.Get(hash)
+		c.Assert(err, IsNil)
+		r.Close()
+		// Make sure each use has a different modification time.
+		t := time.Now().Add(time.Duration(i-10) * time.Second)
+		if hash != d {
+			os.Chtimes(filepath.Join(dir, hash[:3], hash), t, t)
+		}
+	}
+
+	// "bbb" was the least recently used when "ddd" was added.
+	for hash, cached := range map[string]bool{a: true, b: false, d: true} {
+		_, err := os.Stat(filepath.Join(dir, hash[:3], hash))
+		c.Check(err == nil, Equals, cached)
+	}
+	c.Check(kc.Cache.Stats(), Equals, DiskCacheStats{Hits: 1, Misses: 3, Evictions: 1})
+}
+
+func (s *StandaloneSuite) TestDiskCacheBadChecksum(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	dir, _ := ioutil.TempDir("", "keepcache")
+	defer os.RemoveAll(dir)
+	kc.Cache, _ = NewDiskCache(dir, 1000)
+
+	hash := st.Add("foo")[:32]
+	st.blocks[hash] = []byte("bar")
+	_, _, _, err := kc.Get(hash)
+	c.Check(err, Equals, BadChecksum)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	c.Check(files, HasLen, 0)
+}
+
+func (s *StandaloneSuite) TestDiskCacheChecksPermission(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	dir, _ := ioutil.TempDir("", "keepcache")
+	defer os.RemoveAll(dir)
+	kc.Cache, _ = NewDiskCache(dir, 1000)
+
+	hash := st.Add("foo")[:32]
+	r, _, _, err := kc.Get(hash)
+	c.Assert(err, IsNil)
+	r.Close()
+
+	// Once the server refuses the block, the cached copy is not
+	// returned either.
+	st.lock.Lock()
+	st.denied = true
+	st.lock.Unlock()
+	r, _, _, err = kc.Get(hash)
+	c.Check(r, IsNil)
+	c.Check(IsPermissionDenied(err), Equals, true)
+	c.Check(st.Requests(hash), Equals, 1)
+	c.Check(st.Asks(hash), Equals, 1)
+}
+
+func (s *StandaloneSuite) TestDiskCacheSizeTotal(c *C) {
+	kc, st, stop := makeCollectionTestClient()
+	defer stop()
+	dir, _ := ioutil.TempDir("", "keepcache")
+	defer os.RemoveAll(dir)
+	kc.Cache, _ = NewDiskCache(dir, 1000)
+
+	a, b := st.Add("aaa")[:32], st.Add("bbbb")[:32]
+	for _, hash := range []string{a, b, a} {
+		r, _, _, err := kc.Get(hash)
+		c.Assert(err, IsNil)
+		r.Close()
+	}
+	total, _ := ioutil.ReadFile(filepath.Join(dir, "size"))
+	c.Check(string(total), Equals, "7\n")
+
+	// A process with a smaller limit sharing the directory finds the
+	// total, and evicts blocks to stay under its limit.
+	t := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, b[:3], b), t, t)
+	kc.Cache, _ = NewDiskCache(dir, 8)
+	r, _, _, err := kc.Get(st.Add("ddd")[:32])
+	c.Assert(err, IsNil)
+	r.Close()
+	c.Check(kc.Cache.Stats().Evictions, Equals, int64(1))
+	total, _ = ioutil.ReadFile(filepath.Join(dir, "size"))
+	c.Check(string(total), Equals, "6\n")
+}
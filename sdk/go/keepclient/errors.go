@@ -0,0 +1,129 @@
+/* Detailed errors from Keep operations. */
+package keepclient
+
+import (
+	"errors"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"net/http"
+	"strings"
+)
+
+// The reason a single Keep server failed a request.  StatusCode is zero
+// if no response was received, in which case Err is the transport error.
+type ServerError struct {
+	Url        string
+	StatusCode int
+	Err        error
+}
+
+func (e ServerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Url, e.Err)
+}
+
+// Describe a failed request to a single Keep server.  'resp' is nil if
+// no response was received; 'response' is the (possibly truncated)
+// response body.
+func makeServerError(url string, resp *http.Response, err error, response string) ServerError {
+	if resp == nil {
+		return ServerError{url, 0, err}
+	}
+	if err == nil {
+		msg := resp.Status
+		if response != "" {
+			msg = msg + ": " + response
+		}
+		err = errors.New(msg)
+	}
+	return ServerError{url, resp.StatusCode, err}
+}
+
+// Error returned when a Get, Ask or Put fails on every Keep server that
+// was tried.  Err is BlockNotFound for reads and InsufficientReplicasError
+// for writes, so errors.Is(err, BlockNotFound) works as expected.
+// Attempts is the number of attempts made under the client's
+// RetryPolicy, and Errors holds the final outcome from each server that
+// failed.
+type MultiError struct {
+	Err      error
+	Attempts int
+	Errors   []ServerError
+}
+
+func (e *MultiError) Error() string {
+	msg := e.Err.Error()
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" after %d attempts", e.Attempts)
+	}
+	if len(e.Errors) > 0 {
+		var details []string
+		for _, se := range e.Errors {
+			details = append(details, se.Error())
+		}
+		msg += ": " + strings.Join(details, "; ")
+	}
+	return msg
+}
+
+func (e *MultiError) Unwrap() error {
+	return e.Err
+}
+
+// True if every server answered that it does not have the block.
+func (e *MultiError) NotFound() bool {
+	for _, se := range e.Errors {
+		if se.StatusCode != http.StatusNotFound {
+			return false
+		}
+	}
+	return len(e.Errors) > 0
+}
+
+// True if at least one server refused the request for lack of
+// permission, and every other server either refused it too or does not
+// have the block.
+func (e *MultiError) PermissionDenied() bool {
+	denied := false
+	for _, se := range e.Errors {
+		switch se.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			denied = true
+		case http.StatusNotFound:
+		default:
+			return false
+		}
+	}
+	return denied
+}
+
+// True if at least one server failed in a way that might not recur,
+// such as a timeout or a 503, so the operation may succeed if tried
+// again later.
+func (e *MultiError) Temporary() bool {
+	for _, se := range e.Errors {
+		if arvadosclient.DefaultRetryable(se.StatusCode, se.Err) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether err is a MultiError for which every server answered
+// that it does not have the block.
+func IsNotFound(err error) bool {
+	var me *MultiError
+	return errors.As(err, &me) && me.NotFound()
+}
+
+// Report whether err is a MultiError caused by servers refusing
+// permission to access the block.
+func IsPermissionDenied(err error) bool {
+	var me *MultiError
+	return errors.As(err, &me) && me.PermissionDenied()
+}
+
+// Report whether err is a MultiError that includes a temporary failure.
+func IsTemporary(err error) bool {
+	var me *MultiError
+	return errors.As(err, &me) && me.Temporary()
+}
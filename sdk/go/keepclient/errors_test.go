@@ -0,0 +1,48 @@
+package keepclient
+
+import (
+	"errors"
+	. "gopkg.in/check.v1"
+	"syscall"
+)
+
+func (s *StandaloneSuite) TestMultiErrorClassification(c *C) {
+	notFound := ServerError{"http://a/x", 404, errors.New("404 Not Found")}
+	forbidden := ServerError{"http://b/x", 403, errors.New("403 Forbidden")}
+	unavailable := ServerError{"http://c/x", 503, errors.New("503 Service Unavailable")}
+	refused := ServerError{"http://d/x", 0, syscall.ECONNREFUSED}
+	badRequest := ServerError{"http://e/x", 400, errors.New("400 Bad Request")}
+
+	for _, t := range []struct {
+		errs      []ServerError
+		notFound  bool
+		denied    bool
+		temporary bool
+	}{
+		{[]ServerError{notFound, notFound}, true, false, false},
+		{[]ServerError{forbidden, notFound}, false, true, false},
+		{[]ServerError{forbidden, unavailable}, false, false, true},
+		{[]ServerError{notFound, refused}, false, false, true},
+		{[]ServerError{badRequest}, false, false, false},
+		{nil, false, false, false},
+	} {
+		err := &MultiError{BlockNotFound, 1, t.errs}
+		c.Check(IsNotFound(err), Equals, t.notFound, Commentf("%v", err))
+		c.Check(IsPermissionDenied(err), Equals, t.denied, Commentf("%v", err))
+		c.Check(IsTemporary(err), Equals, t.temporary, Commentf("%v", err))
+	}
+
+	c.Check(IsNotFound(BlockNotFound), Equals, false)
+	c.Check(IsTemporary(nil), Equals, false)
+}
+
+func (s *StandaloneSuite) TestMultiErrorMessage(c *C) {
+	err := &MultiError{BlockNotFound, 2, []ServerError{
+		{"http://a/x", 404, errors.New("404 Not Found")},
+		{"http://b/x", 0, errors.New("connection refused")}}}
+	c.Check(err.Error(), Equals,
+		"Block not found after 2 attempts: http://a/x: 404 Not Found; http://b/x: connection refused")
+
+	err = &MultiError{InsufficientReplicasError, 1, nil}
+	c.Check(err.Error(), Equals, InsufficientReplicasError.Error())
+}
@@ -0,0 +1,151 @@
+/* Tracks failing Keep services, and keeps the service list up to date. */
+package keepclient
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// How long a Keep service is moved to the end of the probe order after it
+// fails.  Each further consecutive failure doubles the time, up to
+// MAX_DEMOTION_TIME.
+const DEMOTION_TIME = 10 * time.Second
+const MAX_DEMOTION_TIME = 5 * time.Minute
+
+// Recent failures of each Keep service, keyed by service root.  Shared by
+// all copies of a KeepClient.
+type rootHealth struct {
+	lock  sync.Mutex
+	roots map[string]*rootFailures
+}
+
+type rootFailures struct {
+	// Consecutive failures
+	count int
+
+	// Time until which the root is demoted
+	until time.Time
+}
+
+func newRootHealth() *rootHealth {
+	return &rootHealth{roots: make(map[string]*rootFailures)}
+}
+
+// Record the outcome of a request to 'root'.  statusCode is the HTTP
+// status of the response, or 0 (or less) if there was no response.  A
+// response with a 5xx status, or none at all, counts as a failure; any
+// other response shows the service is working.
+func (this *rootHealth) record(root string, statusCode int) {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if statusCode > 0 && statusCode < 500 {
+		delete(this.roots, root)
+		return
+	}
+	f := this.roots[root]
+	if f == nil {
+		f = &rootFailures{}
+		this.roots[root] = f
+	}
+	f.count += 1
+	demotion := DEMOTION_TIME
+	for i := 1; i < f.count && demotion < MAX_DEMOTION_TIME; i++ {
+		demotion *= 2
+	}
+	if demotion > MAX_DEMOTION_TIME {
+		demotion = MAX_DEMOTION_TIME
+	}
+	f.until = time.Now().Add(demotion)
+}
+
+// Move the roots that have failed recently to the end of 'roots', keeping
+// the order of the others, and of the failing ones among themselves.
+func (this *rootHealth) demote(roots []string) []string {
+	if this == nil {
+		return roots
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.roots) == 0 {
+		return roots
+	}
+	now := time.Now()
+	healthy := make([]string, 0, len(roots))
+	var failing []string
+	for _, root := range roots {
+		if f, ok := this.roots[root]; ok && now.Before(f.until) {
+			failing = append(failing, root)
+		} else {
+			healthy = append(healthy, root)
+		}
+	}
+	return append(healthy, failing...)
+}
+
+// Return the roots that are currently demoted because of recent failures.
+func (this *KeepClient) FailingRoots() []string {
+	var failing []string
+	if this.health == nil {
+		return failing
+	}
+	this.health.lock.Lock()
+	defer this.health.lock.Unlock()
+	now := time.Now()
+	for root, f := range this.health.roots {
+		if now.Before(f.until) {
+			failing = append(failing, root)
+		}
+	}
+	return failing
+}
+
+// The service roots in the order they should be tried for the block with
+// the given hash: the order given by RootSorter, except that roots which
+// have failed recently come last.
+func (this *KeepClient) sortedRoots(hash string) []string {
+	return this.health.demote(NewRootSorter(this.ServiceRoots(), hash).GetSortedRoots())
+}
+
+// Like sortedRoots, but only the roots of services that accept writes.
+func (this *KeepClient) sortedWritableRoots(hash string) []string {
+	return this.health.demote(NewRootSorter(this.WritableRoots(), hash).GetSortedRoots())
+}
+
+// Fetch the list of Keep services from the API server every 'interval', so
+// that services added or removed after the KeepClient was created are
+// used.  Errors are logged, and the previous list is kept.  Runs until the
+// returned function is called.
+func (this *KeepClient) RefreshServiceRoots(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			services, _, err := this.listServices(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Refreshing Keep service list failed: %v", err)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(services, this.Services()) {
+				log.Printf("Updated Keep service list to %v", services)
+				this.SetServices(services)
+			}
+		}
+	}()
+	return cancel
+}
@@ -0,0 +1,116 @@
+package keepclient
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func (s *StandaloneSuite) TestRootHealthDemote(c *C) {
+	h := newRootHealth()
+	roots := []string{"a", "b", "c", "d"}
+
+	h.record("a", 503)
+	h.record("c", 0)
+	h.record("d", 404)
+	c.Check(h.demote(roots), DeepEquals, []string{"b", "d", "a", "c"})
+
+	// A response other than a server error restores the root.
+	h.record("a", 200)
+	c.Check(h.demote(roots), DeepEquals, []string{"a", "b", "d", "c"})
+
+	// Demotion expires, and lasts longer after repeated failures.
+	h.roots["c"].until = time.Now()
+	c.Check(h.demote(roots), DeepEquals, roots)
+	for i := 0; i < 3; i++ {
+		h.record("b", 502)
+	}
+	c.Check(h.roots["b"].until.Sub(time.Now()) > 3*DEMOTION_TIME, Equals, true)
+	for i := 0; i < 10; i++ {
+		h.record("b", 502)
+	}
+	c.Check(h.roots["b"].until.Sub(time.Now()) <= MAX_DEMOTION_TIME, Equals, true)
+
+	var nilHealth *rootHealth
+	nilHealth.record("a", 0)
+	c.Check(nilHealth.demote(roots), DeepEquals, roots)
+}
+
+func (s *StandaloneSuite) TestGetDemotesFailingRoot(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	handlers := []*FlakyHandler{{body: []byte("foo")}, {body: []byte("foo")}}
+	kc, stop := makeRetryTestClient(1, handlers[0], handlers[1])
+	defer stop()
+
+	// Make the first server in the probe order fail.
+	first := kc.sortedRoots(hash)[0]
+	bad, good := handlers[0], handlers[1]
+	if first != kc.ServiceRoots()["zzzzz-bi6l4-fakefakefake000"] {
+		bad, good = good, bad
+	}
+	bad.failures, bad.failStatus = 1000, 503
+
+	for i := 0; i < 3; i++ {
+		r, _, _, err := kc.Get(hash)
+		c.Assert(err, IsNil)
+		r.Close()
+	}
+	c.Check(bad.Requests(), Equals, 1)
+	c.Check(good.Requests(), Equals, 3)
+	c.Check(kc.FailingRoots(), DeepEquals, []string{first})
+	c.Check(kc.sortedRoots(hash)[1], Equals, first)
+}
+
+// Stands in for the API server's keep_services list.
+type StubServicesHandler struct {
+	lock  sync.Mutex
+	roots []string
+}
+
+func (this *StubServicesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var items []keepDisk
+	for i, host := range this.roots {
+		items = append(items, keepDisk{
+			Uuid:     fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i),
+			Hostname: host,
+			Port:     25107,
+			SvcType:  "disk"})
+	}
+	json.NewEncoder(resp).Encode(map[string]interface{}{"items": items})
+}
+
+func (this *StubServicesHandler) SetRoots(roots ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.roots = roots
+}
+
+func (s *StandaloneSuite) TestRefreshServiceRoots(c *C) {
+	api := &StubServicesHandler{roots: []string{"keep0"}}
+	arv, stopApi := makeStubApiClient(api)
+	defer stopApi()
+
+	kc, err := MakeKeepClient(&arv)
+	c.Assert(err, IsNil)
+	c.Check(kc.ServiceRoots(), DeepEquals, map[string]string{
+		"zzzzz-bi6l4-fakefakefake000": "http://keep0:25107"})
+
+	stop := kc.RefreshServiceRoots(time.Millisecond)
+	defer stop()
+	api.SetRoots("keep0", "keep1")
+	expect := map[string]string{
+		"zzzzz-bi6l4-fakefakefake000": "http://keep0:25107",
+		"zzzzz-bi6l4-fakefakefake001": "http://keep1:25107"}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if fmt.Sprint(kc.ServiceRoots()) == fmt.Sprint(expect) {
+			break
+		}
+	}
+	c.Check(kc.ServiceRoots(), DeepEquals, expect)
+}
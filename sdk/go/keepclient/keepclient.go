@@ -2,11 +2,15 @@
 package keepclient
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/locator"
 	"git.curoverse.com/arvados.git/sdk/go/streamer"
 	"io"
 	"io/ioutil"
@@ -29,6 +33,7 @@ var InsufficientReplicasError = errors.New("Could not write sufficient replicas"
 var OversizeBlockError = errors.New("Block too big")
 var MissingArvadosApiHost = errors.New("Missing required environment variable ARVADOS_API_HOST")
 var MissingArvadosApiToken = errors.New("Missing required environment variable ARVADOS_API_TOKEN")
+var NoServersAnswered = errors.New("No Keep server answered")
 
 const X_Keep_Desired_Replicas = "X-Keep-Desired-Replicas"
 const X_Keep_Replicas_Stored = "X-Keep-Replicas-Stored"
@@ -38,20 +43,48 @@ type KeepClient struct {
 	Arvados       *arvadosclient.ArvadosClient
 	Want_replicas int
 	Using_proxy   bool
-	service_roots *map[string]string
+	services      *serviceList
 	lock          sync.Mutex
 	Client        *http.Client
+	Retry         RetryPolicy
+
+	// If set, a GET of a signed locator that every server refuses
+	// because of its permission signature is tried once more, with the
+	// signed locator returned by RefreshSignature (such as
+	// SignatureRefresher.Refresh).
+	RefreshSignature func(hash string, signature string) (locator string, err error)
+
+	// If set, blocks are read from this cache when possible, and blocks
+	// read from Keep servers are added to it.  Reading a cached block
+	// still takes a request to a server, to check permission.
+	Cache *DiskCache
+
+	// If set, called with the progress of each upload whenever it
+	// changes.  Calls for the same upload are made one at a time.
+	Progress func(UploadProgress)
+
+	// If set, limits the rate at which data is sent to and received
+	// from Keep servers.
+	Bandwidth *TokenBucket
+
+	// Recent failures of each service root
+	health *rootHealth
 }
 
+// The number of replicas to write, if the API server does not say.
+const DEFAULT_REPLICAS = 2
+
 // Create a new KeepClient.  This will contact the API server to discover Keep
-// servers.
+// servers, and the number of replicas to write by default.
 func MakeKeepClient(arv *arvadosclient.ArvadosClient) (kc KeepClient, err error) {
 	var matchTrue = regexp.MustCompile("^(?i:1|yes|true)$")
 	insecure := matchTrue.MatchString(os.Getenv("ARVADOS_API_HOST_INSECURE"))
 	kc = KeepClient{
 		Arvados:       arv,
-		Want_replicas: 2,
+		Want_replicas: defaultReplicas(arv),
 		Using_proxy:   false,
+		Retry:         DefaultRetryPolicy,
+		health:        newRootHealth(),
 		Client: &http.Client{Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}}},
 	}
@@ -60,12 +93,38 @@ func MakeKeepClient(arv *arvadosclient.ArvadosClient) (kc KeepClient, err error)
 	return kc, err
 }
 
+// How long MakeKeepClient waits for the API server's discovery document
+// before using DEFAULT_REPLICAS.
+const DISCOVERY_TIMEOUT = 5 * time.Second
+
+// The number of replicas of each block the API server asks clients to
+// write, or DEFAULT_REPLICAS if it does not say.  A client can work without
+// the discovery document, so it is asked for only once, without retries,
+// and for no longer than DISCOVERY_TIMEOUT.
+func defaultReplicas(arv *arvadosclient.ArvadosClient) int {
+	once := *arv
+	once.Retry = arvadosclient.RetryPolicy{}
+	ctx, cancel := context.WithTimeout(context.Background(), DISCOVERY_TIMEOUT)
+	defer cancel()
+	if doc, err := once.DiscoveryContext(ctx); err == nil && doc.DefaultCollectionReplication > 0 {
+		return doc.DefaultCollectionReplication
+	}
+	return DEFAULT_REPLICAS
+}
+
 // Put a block given the block hash, a reader with the block data, and the
 // expected length of that data.  The desired number of replicas is given in
 // KeepClient.Want_replicas.  Returns the number of replicas that were written
 // and if there was an error.  Note this will return InsufficientReplias
 // whenever 0 <= replicas < this.Wants_replicas.
 func (this KeepClient) PutHR(hash string, r io.Reader, expectedLength int64) (locator string, replicas int, err error) {
+	return this.PutHRContext(context.Background(), hash, r, expectedLength)
+}
+
+// Like PutHR, but the upload is abandoned if ctx is cancelled or its deadline
+// passes before enough replicas have been written.  In that case the error is
+// ctx.Err() and replicas is the number of replicas written so far.
+func (this KeepClient) PutHRContext(ctx context.Context, hash string, r io.Reader, expectedLength int64) (locator string, replicas int, err error) {
 
 	// Buffer for reads from 'r'
 	var bufsize int
@@ -78,10 +137,15 @@ func (this KeepClient) PutHR(hash string, r io.Reader, expectedLength int64) (lo
 		bufsize = BLOCKSIZE
 	}
 
+	progress := newProgressTracker(hash, this.Progress)
+	if progress != nil {
+		r = meterReader(ctx, ioutil.NopCloser(r), nil, progress.read)
+	}
+
 	t := streamer.AsyncStreamFromReader(bufsize, HashCheckingReader{r, md5.New(), hash})
 	defer t.Close()
 
-	return this.putReplicas(hash, t, expectedLength)
+	return this.putReplicas(ctx, hash, t, expectedLength, progress)
 }
 
 // Put a block given the block hash and a byte buffer.  The desired number of
@@ -89,10 +153,19 @@ func (this KeepClient) PutHR(hash string, r io.Reader, expectedLength int64) (lo
 // replicas that were written and if there was an error.  Note this will return
 // InsufficientReplias whenever 0 <= replicas < this.Wants_replicas.
 func (this KeepClient) PutHB(hash string, buf []byte) (locator string, replicas int, err error) {
+	return this.PutHBContext(context.Background(), hash, buf)
+}
+
+// Like PutHB, but the upload is abandoned if ctx is cancelled or its deadline
+// passes.
+func (this KeepClient) PutHBContext(ctx context.Context, hash string, buf []byte) (locator string, replicas int, err error) {
+	progress := newProgressTracker(hash, this.Progress)
+	progress.read(int64(len(buf)))
+
 	t := streamer.AsyncStreamFromSlice(buf)
 	defer t.Close()
 
-	return this.putReplicas(hash, t, int64(len(buf)))
+	return this.putReplicas(ctx, hash, t, int64(len(buf)), progress)
 }
 
 // Put a block given a buffer.  The hash will be computed.  The desired number
@@ -100,8 +173,14 @@ func (this KeepClient) PutHB(hash string, buf []byte) (locator string, replicas
 // replicas that were written and if there was an error.  Note this will return
 // InsufficientReplias whenever 0 <= replicas < this.Wants_replicas.
 func (this KeepClient) PutB(buffer []byte) (locator string, replicas int, err error) {
+	return this.PutBContext(context.Background(), buffer)
+}
+
+// Like PutB, but the upload is abandoned if ctx is cancelled or its deadline
+// passes.
+func (this KeepClient) PutBContext(ctx context.Context, buffer []byte) (locator string, replicas int, err error) {
 	hash := fmt.Sprintf("%x", md5.Sum(buffer))
-	return this.PutHB(hash, buffer)
+	return this.PutHBContext(ctx, hash, buffer)
 }
 
 // Put a block, given a Reader.  This will read the entire reader into a buffer
@@ -111,10 +190,16 @@ func (this KeepClient) PutB(buffer []byte) (locator string, replicas int, err er
 // whenever 0 <= replicas < this.Wants_replicas.  Also nhote that if the block
 // hash and data size are available, PutHR() is more efficient.
 func (this KeepClient) PutR(r io.Reader) (locator string, replicas int, err error) {
+	return this.PutRContext(context.Background(), r)
+}
+
+// Like PutR, but the upload is abandoned if ctx is cancelled or its deadline
+// passes.
+func (this KeepClient) PutRContext(ctx context.Context, r io.Reader) (locator string, replicas int, err error) {
 	if buffer, err := ioutil.ReadAll(r); err != nil {
 		return "", 0, err
 	} else {
-		return this.PutB(buffer)
+		return this.PutBContext(ctx, buffer)
 	}
 }
 
@@ -124,7 +209,15 @@ func (this KeepClient) PutR(r io.Reader) (locator string, replicas int, err erro
 // method will return a BadChecksum error instead of EOF.
 func (this KeepClient) Get(hash string) (reader io.ReadCloser,
 	contentLength int64, url string, err error) {
-	return this.AuthorizedGet(hash, "", "")
+	return this.AuthorizedGetContext(context.Background(), hash, "", "")
+}
+
+// Like Get, but gives up if ctx is cancelled or its deadline passes.  The
+// context also governs reads from the returned reader: once it is done, Read()
+// returns an error.
+func (this KeepClient) GetContext(ctx context.Context, hash string) (reader io.ReadCloser,
+	contentLength int64, url string, err error) {
+	return this.AuthorizedGetContext(ctx, hash, "", "")
 }
 
 // Get a block given a hash, with additional authorization provided by
@@ -136,116 +229,518 @@ func (this KeepClient) AuthorizedGet(hash string,
 	signature string,
 	timestamp string) (reader io.ReadCloser,
 	contentLength int64, url string, err error) {
+	return this.AuthorizedGetContext(context.Background(), hash, signature, timestamp)
+}
+
+// Like AuthorizedGet, but gives up if ctx is cancelled or its deadline
+// passes.  The context also governs reads from the returned reader, unless
+// Cache is set: then the reader and URL returned are for the cached copy of
+// the block.  A block found in the cache is returned only if a server
+// confirms, with a HEAD request, that the client may read it.
+func (this KeepClient) AuthorizedGetContext(ctx context.Context, hash string,
+	signature string,
+	timestamp string) (reader io.ReadCloser,
+	contentLength int64, url string, err error) {
+
+	if this.Cache == nil {
+		return this.getRefreshingSignature(ctx, hash, signature, timestamp)
+	}
+	if reader, contentLength, path, ok := this.Cache.open(hash); ok {
+		// The cache may hold blocks read by other users, so a server
+		// must still confirm that this client can read the block.
+		if _, _, err := this.askRefreshingSignature(ctx, hash, signature, timestamp); err != nil {
+			reader.Close()
+			return nil, 0, "", err
+		}
+		return reader, contentLength, path, nil
+	}
+	reader, contentLength, url, err = this.getRefreshingSignature(ctx, hash, signature, timestamp)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	cached, size, path, err := this.Cache.insert(hash, reader)
+	if err == nil {
+		return cached, size, path, nil
+	} else if err == BadChecksum || ctx.Err() != nil {
+		return nil, 0, url, err
+	}
+	log.Printf("Caching block %s failed: %v", hash, err)
+	return this.getRefreshingSignature(ctx, hash, signature, timestamp)
+}
+
+// Get a block, and if every server refuses it because of its permission
+// signature, try once more with the signature from RefreshSignature.
+func (this KeepClient) getRefreshingSignature(ctx context.Context, hash string,
+	signature string,
+	timestamp string) (reader io.ReadCloser,
+	contentLength int64, url string, err error) {
+
+	reader, contentLength, url, err = this.authorizedGet(ctx, hash, signature, timestamp)
+	if err == nil || !IsPermissionDenied(err) {
+		return
+	}
+	if signature, timestamp, ok := this.refreshSignature(hash, signature); ok {
+		return this.authorizedGet(ctx, hash, signature, timestamp)
+	}
+	return
+}
+
+// Like getRefreshingSignature, but only asks whether the block is
+// available.
+func (this KeepClient) askRefreshingSignature(ctx context.Context, hash string,
+	signature string,
+	timestamp string) (contentLength int64, url string, err error) {
+
+	contentLength, url, err = this.AuthorizedAskContext(ctx, hash, signature, timestamp)
+	if err == nil || !IsPermissionDenied(err) {
+		return
+	}
+	if signature, timestamp, ok := this.refreshSignature(hash, signature); ok {
+		return this.AuthorizedAskContext(ctx, hash, signature, timestamp)
+	}
+	return
+}
+
+// Get a new signature for a block from RefreshSignature.  Returns
+// ok=false if there is no RefreshSignature, or it fails, or it returns
+// no signature or the same one.
+func (this KeepClient) refreshSignature(hash string, signature string) (newSignature string, timestamp string, ok bool) {
+	if signature == "" || this.RefreshSignature == nil {
+		return "", "", false
+	}
+	fresh, err := this.RefreshSignature(hash, signature)
+	if err != nil {
+		log.Printf("Refreshing signature for %s failed: %v", hash, err)
+		return "", "", false
+	}
+	loc := MakeLocator(fresh)
+	if loc.Hash != hash || loc.Signature == "" || loc.Signature == signature {
+		return "", "", false
+	}
+	return loc.Signature, loc.Timestamp, true
+}
+
+func (this KeepClient) authorizedGet(ctx context.Context, hash string,
+	signature string,
+	timestamp string) (reader io.ReadCloser,
+	contentLength int64, url string, err error) {
 
 	// Take the hash of locator and timestamp in order to identify this
 	// specific transaction in log statements.
 	requestId := fmt.Sprintf("%x", md5.Sum([]byte(hash+time.Now().String())))[0:8]
 
 	// Calculate the ordering for asking servers
-	sv := NewRootSorter(this.ServiceRoots(), hash).GetSortedRoots()
-
-	for _, host := range sv {
-		var req *http.Request
-		var err error
-		var url string
-		if signature != "" {
-			url = fmt.Sprintf("%s/%s+A%s@%s", host, hash,
-				signature, timestamp)
-		} else {
-			url = fmt.Sprintf("%s/%s", host, hash)
-		}
-		if req, err = http.NewRequest("GET", url, nil); err != nil {
-			continue
-		}
+	sv := this.sortedRoots(hash)
+
+	// Failures that will not be retried
+	var errs []ServerError
+
+	for attempt := 1; ; attempt++ {
+		// Servers that failed in a way that is worth retrying, and
+		// how they failed
+		var retry []string
+		var retryErrs []ServerError
+
+		for _, host := range sv {
+			if ctx.Err() != nil {
+				return nil, 0, "", ctx.Err()
+			}
+
+			var req *http.Request
+			var err error
+			var url string
+			if signature != "" {
+				url = fmt.Sprintf("%s/%s+A%s@%s", host, hash,
+					signature, timestamp)
+			} else {
+				url = fmt.Sprintf("%s/%s", host, hash)
+			}
+			if req, err = http.NewRequestWithContext(ctx, "GET", url, nil); err != nil {
+				errs = append(errs, makeServerError(url, nil, err, ""))
+				continue
+			}
 
-		req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", this.Arvados.ApiToken))
+			req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", this.Arvados.ApiToken))
 
-		log.Printf("[%v] Begin download %s", requestId, url)
+			log.Printf("[%v] Begin download %s", requestId, url)
 
-		var resp *http.Response
-		if resp, err = this.Client.Do(req); err != nil || resp.StatusCode != http.StatusOK {
-			statusCode := -1
-			var respbody []byte
-			if resp != nil {
-				statusCode = resp.StatusCode
-				if resp.Body != nil {
-					respbody, _ = ioutil.ReadAll(&io.LimitedReader{resp.Body, 4096})
+			var resp *http.Response
+			if resp, err = this.Client.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+				statusCode := -1
+				var respbody []byte
+				if resp != nil {
+					statusCode = resp.StatusCode
+					if resp.Body != nil {
+						respbody, _ = ioutil.ReadAll(&io.LimitedReader{resp.Body, 4096})
+						resp.Body.Close()
+					}
 				}
+				response := strings.TrimSpace(string(respbody))
+				log.Printf("[%v] Download %v status code: %v error: \"%v\" response: \"%v\"",
+					requestId, url, statusCode, err, response)
+				if ctx.Err() != nil {
+					return nil, 0, "", ctx.Err()
+				}
+				serr := makeServerError(url, resp, err, response)
+				this.health.record(host, serr.StatusCode)
+				if this.Retry.ShouldRetry(serr.StatusCode, err) {
+					retry = append(retry, host)
+					retryErrs = append(retryErrs, serr)
+				} else {
+					errs = append(errs, serr)
+				}
+				continue
+			}
+
+			if resp.StatusCode == http.StatusOK {
+				this.health.record(host, resp.StatusCode)
+				log.Printf("[%v] Download %v status code: %v", requestId, url, resp.StatusCode)
+				body := meterReader(ctx, resp.Body, this.Bandwidth, nil)
+				return HashCheckingReader{body, md5.New(), hash}, resp.ContentLength, url, nil
 			}
-			response := strings.TrimSpace(string(respbody))
-			log.Printf("[%v] Download %v status code: %v error: \"%v\" response: \"%v\"",
-				requestId, url, statusCode, err, response)
-			continue
 		}
 
-		if resp.StatusCode == http.StatusOK {
-			log.Printf("[%v] Download %v status code: %v", requestId, url, resp.StatusCode)
-			return HashCheckingReader{resp.Body, md5.New(), hash}, resp.ContentLength, url, nil
+		if len(retry) == 0 || attempt >= this.Retry.MaxAttempts() {
+			return nil, 0, "", &MultiError{BlockNotFound, attempt, append(errs, retryErrs...)}
 		}
+		log.Printf("[%v] Download attempt %v failed, retrying %v servers", requestId, attempt, len(retry))
+		if err := this.Retry.Wait(ctx, attempt); err != nil {
+			return nil, 0, "", err
+		}
+		sv = retry
 	}
-
-	return nil, 0, "", BlockNotFound
 }
 
 // Determine if a block with the given hash is available and readable, but does
 // not return the block contents.
 func (this KeepClient) Ask(hash string) (contentLength int64, url string, err error) {
-	return this.AuthorizedAsk(hash, "", "")
+	return this.AuthorizedAskContext(context.Background(), hash, "", "")
+}
+
+// Like Ask, but gives up if ctx is cancelled or its deadline passes.
+func (this KeepClient) AskContext(ctx context.Context, hash string) (contentLength int64, url string, err error) {
+	return this.AuthorizedAskContext(ctx, hash, "", "")
 }
 
 // Determine if a block with the given hash is available and readable with the
 // given signature and timestamp, but does not return the block contents.
 func (this KeepClient) AuthorizedAsk(hash string, signature string,
+	timestamp string) (contentLength int64, url string, err error) {
+	return this.AuthorizedAskContext(context.Background(), hash, signature, timestamp)
+}
+
+// Like AuthorizedAsk, but gives up if ctx is cancelled or its deadline
+// passes.
+func (this KeepClient) AuthorizedAskContext(ctx context.Context, hash string, signature string,
 	timestamp string) (contentLength int64, url string, err error) {
 	// Calculate the ordering for asking servers
-	sv := NewRootSorter(this.ServiceRoots(), hash).GetSortedRoots()
-
-	for _, host := range sv {
-		var req *http.Request
-		var err error
-		if signature != "" {
-			url = fmt.Sprintf("%s/%s+A%s@%s", host, hash,
-				signature, timestamp)
-		} else {
-			url = fmt.Sprintf("%s/%s", host, hash)
+	sv := this.sortedRoots(hash)
+
+	// Failures that will not be retried
+	var errs []ServerError
+
+	for attempt := 1; ; attempt++ {
+		// Servers that failed in a way that is worth retrying, and
+		// how they failed
+		var retry []string
+		var retryErrs []ServerError
+
+		for _, host := range sv {
+			var req *http.Request
+			var err error
+			if signature != "" {
+				url = fmt.Sprintf("%s/%s+A%s@%s", host, hash,
+					signature, timestamp)
+			} else {
+				url = fmt.Sprintf("%s/%s", host, hash)
+			}
+
+			if req, err = http.NewRequestWithContext(ctx, "HEAD", url, nil); err != nil {
+				errs = append(errs, makeServerError(url, nil, err, ""))
+				continue
+			}
+
+			req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", this.Arvados.ApiToken))
+
+			var resp *http.Response
+			if resp, err = this.Client.Do(req); err != nil {
+				if ctx.Err() != nil {
+					return 0, "", ctx.Err()
+				}
+			} else {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					this.health.record(host, resp.StatusCode)
+					return resp.ContentLength, url, nil
+				}
+			}
+
+			serr := makeServerError(url, resp, err, "")
+			this.health.record(host, serr.StatusCode)
+			if this.Retry.ShouldRetry(serr.StatusCode, err) {
+				retry = append(retry, host)
+				retryErrs = append(retryErrs, serr)
+			} else {
+				errs = append(errs, serr)
+			}
+		}
+
+		if len(retry) == 0 || attempt >= this.Retry.MaxAttempts() {
+			return 0, "", &MultiError{BlockNotFound, attempt, append(errs, retryErrs...)}
 		}
+		if err := this.Retry.Wait(ctx, attempt); err != nil {
+			return 0, "", err
+		}
+		sv = retry
+	}
+}
+
+// The most locators a Keep server or proxy accepts in one existence
+// check, and the largest request body it reads.  AskMany splits larger
+// batches.
+const MAX_EXISTS_LOCATORS = 1000
+const MAX_EXISTS_REQUEST_SIZE = 1 << 20
+
+// The existence of a block on a Keep server, as reported by AskMany.
+// Size and Mtime (in seconds since the Unix epoch) are set only if
+// Exists is true.  Error is set if a server rejected the locator, for
+// example because its permission signature was invalid.  Url is the
+// address of the server that gave the answer.
+type BlockExistence struct {
+	Locator string `json:"locator"`
+	Exists  bool   `json:"exists"`
+	Size    int64  `json:"size"`
+	Mtime   int64  `json:"mtime"`
+	Error   string `json:"error"`
+	Url     string `json:"-"`
+}
 
-		if req, err = http.NewRequest("HEAD", url, nil); err != nil {
-			continue
+// Determine which of the given blocks are available, without
+// retrieving them.  Locators may include size hints and, when the
+// servers enforce permissions, signatures.
+//
+// Each locator is first checked on the server that comes first in its
+// RootSorter order, with the locators for each server sent in a single
+// batch request.  Locators that are not found are then checked on the
+// next server in their order, and so on until every server has been
+// asked.  The results are returned in the same order as the locators.
+//
+// Returns NoServersAnswered if no server could be asked about any of
+// the locators.
+func (this KeepClient) AskMany(locators []string) (results []BlockExistence, err error) {
+	return this.AskManyContext(context.Background(), locators)
+}
+
+// Like AskMany, but gives up if ctx is cancelled or its deadline passes.  In
+// that case the error is ctx.Err(), and results holds the answers received so
+// far.
+func (this KeepClient) AskManyContext(ctx context.Context, locators []string) (results []BlockExistence, err error) {
+	results = make([]BlockExistence, len(locators))
+	sortedRoots := make([][]string, len(locators))
+	tried := make([]int, len(locators))
+	pending := make([]int, len(locators))
+	for i, locator := range locators {
+		results[i].Locator = locator
+		hash := locator
+		if len(hash) > 32 {
+			hash = hash[0:32]
+		}
+		sortedRoots[i] = this.sortedRoots(hash)
+		pending[i] = i
+	}
+
+	type batchResult struct {
+		host    string
+		indexes []int
+		results []BlockExistence
+		err     error
+	}
+
+	answered := len(locators) == 0
+	for len(pending) > 0 {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+
+		// Send each pending locator to the next server in its order.
+		batches := make(map[string][]int)
+		for _, i := range pending {
+			if tried[i] < len(sortedRoots[i]) {
+				host := sortedRoots[i][tried[i]]
+				batches[host] = append(batches[host], i)
+				tried[i] += 1
+			}
+		}
+
+		done := make(chan batchResult)
+		for host, indexes := range batches {
+			go func(host string, indexes []int) {
+				batch := make([]string, len(indexes))
+				for k, i := range indexes {
+					batch[k] = locators[i]
+				}
+				res, err := this.askBatch(ctx, host, batch)
+				done <- batchResult{host, indexes, res, err}
+			}(host, indexes)
+		}
+
+		pending = pending[:0]
+		for _ = range batches {
+			b := <-done
+			if b.err != nil {
+				log.Printf("Batch existence check on %v error: %v", b.host, b.err)
+				pending = append(pending, b.indexes...)
+				continue
+			}
+			answered = true
+			for k, i := range b.indexes {
+				if b.results[k].Exists {
+					results[i] = b.results[k]
+					results[i].Locator = locators[i]
+					results[i].Url = b.host
+				} else {
+					if b.results[k].Error != "" {
+						results[i].Error = b.results[k].Error
+						results[i].Url = b.host
+					}
+					pending = append(pending, i)
+				}
+			}
 		}
+	}
 
-		req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", this.Arvados.ApiToken))
+	if !answered {
+		return results, NoServersAnswered
+	}
+	return results, nil
+}
 
-		var resp *http.Response
-		if resp, err = this.Client.Do(req); err != nil {
-			continue
+// Send a batch existence check for locators to a single Keep server, in
+// requests of at most MAX_EXISTS_LOCATORS each.
+func (this KeepClient) askBatch(ctx context.Context, host string, locators []string) ([]BlockExistence, error) {
+	var results []BlockExistence
+	for len(locators) > 0 {
+		n := len(locators)
+		if n > MAX_EXISTS_LOCATORS {
+			n = MAX_EXISTS_LOCATORS
 		}
+		res, err := this.askServer(ctx, host, locators[:n])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res...)
+		locators = locators[n:]
+	}
+	return results, nil
+}
+
+func (this KeepClient) askServer(ctx context.Context, host string, locators []string) ([]BlockExistence, error) {
+	body, err := json.Marshal(locators)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", host+"/exists", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", this.Arvados.ApiToken))
+	req.Header.Add("Content-Type", "application/json")
 
-		if resp.StatusCode == http.StatusOK {
-			return resp.ContentLength, url, nil
+	resp, err := this.Client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			this.health.record(host, 0)
 		}
+		return nil, err
+	}
+	this.health.record(host, resp.StatusCode)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errors.New(resp.Status)
+	}
+
+	var results []BlockExistence
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
 	}
+	if len(results) != len(locators) {
+		return nil, fmt.Errorf("Expected %d results, got %d", len(locators), len(results))
+	}
+	return results, nil
+}
+
+// A Keep service listed by the API server.
+type KeepService struct {
+	// Base URL, such as "http://keep0.zzzzz.arvadosapi.com:25107"
+	Root string
 
-	return 0, "", BlockNotFound
+	// If true, blocks are read from the service but never written to it.
+	ReadOnly bool
+
+	// Number of replicas the service stores of each block written to
+	// it, or 0 if it stores as many as the client asks for, as a proxy
+	// does.
+	Replication int
+}
 
+// The Keep services known to a KeepClient, keyed by UUID, with the maps of
+// UUID to root derived from them.
+type serviceList struct {
+	services map[string]KeepService
+	roots    map[string]string
+	writable map[string]string
 }
 
-// Atomically read the service_roots field.
+func (this *KeepClient) loadServices() *serviceList {
+	return (*serviceList)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&this.services))))
+}
+
+// Atomically read the roots of all services, keyed by UUID.
 func (this *KeepClient) ServiceRoots() map[string]string {
-	r := (*map[string]string)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&this.service_roots))))
-	return *r
+	return this.loadServices().roots
+}
+
+// Atomically read the roots of the services that accept writes, keyed by
+// UUID.
+func (this *KeepClient) WritableRoots() map[string]string {
+	return this.loadServices().writable
+}
+
+// Atomically read the list of services, keyed by UUID.
+func (this *KeepClient) Services() map[string]KeepService {
+	return this.loadServices().services
 }
 
-// Atomically update the service_roots field.  Enables you to update
-// service_roots without disrupting any GET or PUT operations that might
+// Atomically update the list of services, making each root writable and
+// storing one replica of each block written to it.  Enables you to update
+// the list without disrupting any GET or PUT operations that might
 // already be in progress.
 func (this *KeepClient) SetServiceRoots(new_roots map[string]string) {
-	roots := make(map[string]string)
+	services := make(map[string]KeepService)
 	for uuid, root := range new_roots {
-		roots[uuid] = root
+		services[uuid] = KeepService{Root: root, Replication: 1}
 	}
-	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&this.service_roots)),
-		unsafe.Pointer(&roots))
+	this.SetServices(services)
+}
+
+// Atomically update the list of services, keyed by UUID.
+func (this *KeepClient) SetServices(new_services map[string]KeepService) {
+	list := &serviceList{
+		services: make(map[string]KeepService),
+		roots:    make(map[string]string),
+		writable: make(map[string]string),
+	}
+	for uuid, svc := range new_services {
+		list.services[uuid] = svc
+		list.roots[uuid] = svc.Root
+		if !svc.ReadOnly {
+			list.writable[uuid] = svc.Root
+		}
+	}
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&this.services)),
+		unsafe.Pointer(list))
 }
 
 type Locator struct {
@@ -255,28 +750,22 @@ type Locator struct {
 	Timestamp string
 }
 
-func MakeLocator2(hash string, hints string) (locator Locator) {
-	locator.Hash = hash
-	if hints != "" {
-		signature_pat, _ := regexp.Compile("^A([[:xdigit:]]+)@([[:xdigit:]]{8})$")
-		for _, hint := range strings.Split(hints, "+") {
-			if hint != "" {
-				if match, _ := regexp.MatchString("^[[:digit:]]+$", hint); match {
-					fmt.Sscanf(hint, "%d", &locator.Size)
-				} else if m := signature_pat.FindStringSubmatch(hint); m != nil {
-					locator.Signature = m[1]
-					locator.Timestamp = m[2]
-				} else if match, _ := regexp.MatchString("^[:upper:]", hint); match {
-					// Any unknown hint that starts with an uppercase letter is
-					// presumed to be valid and ignored, to permit forward compatibility.
-				} else {
-					// Unknown format; not a valid locator.
-					return Locator{"", 0, "", ""}
-				}
-			}
-		}
+// Parse a block hash and the hints that follow it, such as
+// "3+A...@...".  Returns an empty Locator if any of them is invalid.
+func MakeLocator2(hash string, hints string) Locator {
+	s := hash
+	if hints = strings.TrimPrefix(hints, "+"); hints != "" {
+		s += "+" + hints
+	}
+	loc, err := locator.Parse(s)
+	if err != nil {
+		return Locator{"", 0, "", ""}
+	}
+	size := loc.Size
+	if size < 0 {
+		size = 0
 	}
-	return locator
+	return Locator{loc.Hash, size, loc.Signature, loc.Timestamp}
 }
 
 func MakeLocator(path string) Locator {
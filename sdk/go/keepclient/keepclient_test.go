@@ -1,7 +1,10 @@
 package keepclient
 
 import (
+	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
@@ -15,6 +18,7 @@ import (
 	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 // Gocheck boilerplate
@@ -129,7 +133,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServer(c *C) {
 		func(kc KeepClient, url string, reader io.ReadCloser,
 			writer io.WriteCloser, upload_status chan uploadStatus) {
 
-			go kc.uploadToKeepServer(url, st.expectPath, reader, upload_status, int64(len("foo")), "TestUploadToStubKeepServer")
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, reader, upload_status, int64(len("foo")), "TestUploadToStubKeepServer")
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -161,7 +165,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServerBufferReader(c *C) {
 
 			br1 := tr.MakeStreamReader()
 
-			go kc.uploadToKeepServer(url, st.expectPath, br1, upload_status, 3, "TestUploadToStubKeepServerBufferReader")
+			go kc.uploadToKeepServer(context.Background(), url, st.expectPath, br1, upload_status, 3, "TestUploadToStubKeepServerBufferReader")
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -196,7 +200,7 @@ func (s *StandaloneSuite) TestFailedUploadToStubKeepServer(c *C) {
 		func(kc KeepClient, url string, reader io.ReadCloser,
 			writer io.WriteCloser, upload_status chan uploadStatus) {
 
-			go kc.uploadToKeepServer(url, hash, reader, upload_status, 3, "TestFailedUploadToStubKeepServer")
+			go kc.uploadToKeepServer(context.Background(), url, hash, reader, upload_status, 3, "TestFailedUploadToStubKeepServer")
 
 			writer.Write([]byte("foo"))
 			writer.Close()
@@ -319,6 +323,54 @@ func (s *StandaloneSuite) TestPutHR(c *C) {
 	log.Printf("TestPutHR done")
 }
 
+// Accepts a request, then waits until the client gives up on it.
+type StubHangHandler struct {
+	started chan string
+}
+
+func (this StubHangHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.started <- fmt.Sprintf("http://%s", req.Host)
+	<-req.Context().Done()
+}
+
+func (s *StandaloneSuite) TestPutHRContextCancel(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+
+	st := StubHangHandler{make(chan string, 5)}
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+
+	kc.Want_replicas = 2
+	arv.ApiToken = "abc123"
+	service_roots := make(map[string]string)
+
+	ks := RunSomeFakeKeepServers(st, 5)
+
+	for i, k := range ks {
+		service_roots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = k.url
+		defer k.listener.Close()
+	}
+
+	kc.SetServiceRoots(service_roots)
+
+	// The source never finishes, so the uploads block reading it.
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte("f"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-st.started
+		<-st.started
+		cancel()
+	}()
+
+	_, replicas, err := kc.PutHRContext(ctx, hash, reader, 3)
+	c.Check(err, Equals, context.Canceled)
+	c.Check(replicas, Equals, 0)
+}
+
 func (s *StandaloneSuite) TestPutWithFail(c *C) {
 	log.Printf("TestPutWithFail")
 
@@ -392,6 +444,7 @@ func (s *StandaloneSuite) TestPutWithTooManyFail(c *C) {
 
 	arv, err := arvadosclient.MakeArvadosClient()
 	kc, _ := MakeKeepClient(&arv)
+	kc.Retry = RetryPolicy{Attempts: 1}
 
 	kc.Want_replicas = 2
 	arv.ApiToken = "abc123"
@@ -413,7 +466,7 @@ func (s *StandaloneSuite) TestPutWithTooManyFail(c *C) {
 
 	_, replicas, err := kc.PutB([]byte("foo"))
 
-	c.Check(err, Equals, InsufficientReplicasError)
+	c.Check(errors.Is(err, InsufficientReplicasError), Equals, true)
 	c.Check(replicas, Equals, 1)
 	c.Check(<-st.handled, Equals, ks1[0].url)
 
@@ -476,14 +529,45 @@ func (s *StandaloneSuite) TestGetFail(c *C) {
 
 	arv, err := arvadosclient.MakeArvadosClient()
 	kc, _ := MakeKeepClient(&arv)
+	kc.Retry = RetryPolicy{Attempts: 1}
 	arv.ApiToken = "abc123"
 	kc.SetServiceRoots(map[string]string{"x": ks.url})
 
 	r, n, url2, err := kc.Get(hash)
-	c.Check(err, Equals, BlockNotFound)
+	c.Check(errors.Is(err, BlockNotFound), Equals, true)
+	c.Check(err.(*MultiError).Errors, DeepEquals, []ServerError{
+		{fmt.Sprintf("%s/%s", ks.url, hash), 500, errors.New("500 Internal Server Error")}})
+	c.Check(IsTemporary(err), Equals, true)
+	c.Check(IsNotFound(err), Equals, false)
+	c.Check(n, Equals, int64(0))
+	c.Check(url2, Equals, "")
+	c.Check(r, Equals, nil)
+}
+
+func (s *StandaloneSuite) TestGetContextTimeout(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+
+	st := StubHangHandler{make(chan string, 1)}
+
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks.url})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	r, n, url2, err := kc.GetContext(ctx, hash)
+	c.Check(err, Equals, context.DeadlineExceeded)
 	c.Check(n, Equals, int64(0))
 	c.Check(url2, Equals, "")
 	c.Check(r, Equals, nil)
+
+	_, _, err = kc.AskContext(ctx, hash)
+	c.Check(err, Equals, context.DeadlineExceeded)
 }
 
 type BarHandler struct {
@@ -587,7 +671,7 @@ func (s *ServerRequiredSuite) TestPutGetHead(c *C) {
 
 	{
 		n, _, err := kc.Ask(hash)
-		c.Check(err, Equals, BlockNotFound)
+		c.Check(IsNotFound(err), Equals, true)
 		c.Check(n, Equals, int64(0))
 	}
 	{
@@ -678,12 +762,90 @@ func (s *StandaloneSuite) TestPutProxyInsufficientReplicas(c *C) {
 	_, replicas, err := kc.PutB([]byte("foo"))
 	<-st.handled
 
-	c.Check(err, Equals, InsufficientReplicasError)
+	c.Check(errors.Is(err, InsufficientReplicasError), Equals, true)
 	c.Check(replicas, Equals, 2)
 
 	log.Printf("TestPutProxy done")
 }
 
+type StubExistsHandler struct {
+	c              *C
+	expectApiToken string
+	blocks         map[string]int64
+	handled        chan string
+}
+
+func (this StubExistsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.c.Check(req.Method, Equals, "POST")
+	this.c.Check(req.URL.Path, Equals, "/exists")
+	this.c.Check(req.Header.Get("Authorization"), Equals, fmt.Sprintf("OAuth2 %s", this.expectApiToken))
+	var locators []string
+	this.c.Check(json.NewDecoder(req.Body).Decode(&locators), IsNil)
+	results := make([]BlockExistence, len(locators))
+	for i, locator := range locators {
+		results[i].Locator = locator
+		if size, ok := this.blocks[locator[0:32]]; ok {
+			results[i].Exists = true
+			results[i].Size = size
+			results[i].Mtime = 1388894303
+		}
+	}
+	json.NewEncoder(resp).Encode(results)
+	this.handled <- fmt.Sprintf("http://%s", req.Host)
+}
+
+func (s *StandaloneSuite) TestAskMany(c *C) {
+	foo := Md5String("foo")
+	bar := Md5String("bar")
+	baz := Md5String("baz")
+
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+
+	// The first server has no blocks and the second has "foo" and
+	// "bar"; the third fails every request.
+	st1 := StubExistsHandler{c, "abc123", map[string]int64{}, make(chan string, 10)}
+	st2 := StubExistsHandler{c, "abc123", map[string]int64{foo: 3, bar: 3}, make(chan string, 10)}
+	st3 := FailHandler{make(chan string, 10)}
+
+	ks1 := RunFakeKeepServer(st1)
+	ks2 := RunFakeKeepServer(st2)
+	ks3 := RunFakeKeepServer(st3)
+	defer ks1.listener.Close()
+	defer ks2.listener.Close()
+	defer ks3.listener.Close()
+
+	kc.SetServiceRoots(map[string]string{
+		"zzzzz-bi6l4-fakefakefake000": ks1.url,
+		"zzzzz-bi6l4-fakefakefake001": ks2.url,
+		"zzzzz-bi6l4-fakefakefake002": ks3.url,
+	})
+
+	results, err := kc.AskMany([]string{foo + "+3", baz, bar})
+	c.Assert(err, IsNil)
+	c.Assert(len(results), Equals, 3)
+	c.Check(results[0], DeepEquals, BlockExistence{foo + "+3", true, 3, 1388894303, "", ks2.url})
+	c.Check(results[1].Locator, Equals, baz)
+	c.Check(results[1].Exists, Equals, false)
+	c.Check(results[2], DeepEquals, BlockExistence{bar, true, 3, 1388894303, "", ks2.url})
+}
+
+func (s *StandaloneSuite) TestAskManyNoServers(c *C) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+
+	st := FailHandler{make(chan string, 10)}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	kc.SetServiceRoots(map[string]string{"zzzzz-bi6l4-fakefakefake000": ks.url})
+
+	results, err := kc.AskMany([]string{Md5String("foo")})
+	c.Check(err, Equals, NoServersAnswered)
+	c.Check(results[0].Exists, Equals, false)
+}
+
 func (s *StandaloneSuite) TestMakeLocator(c *C) {
 	l := MakeLocator("91f372a266fe2bf2823cb8ec7fda31ce+3+Aabcde@12345678")
 
@@ -692,3 +854,13 @@ func (s *StandaloneSuite) TestMakeLocator(c *C) {
 	c.Check(l.Signature, Equals, "abcde")
 	c.Check(l.Timestamp, Equals, "12345678")
 }
+
+func (s *StandaloneSuite) TestMakeLocatorHints(c *C) {
+	l := MakeLocator2("91f372a266fe2bf2823cb8ec7fda31ce", "3+K@qr1hi+Aabcde@12345678")
+	c.Check(l.Hash, Equals, "91f372a266fe2bf2823cb8ec7fda31ce")
+	c.Check(l.Size, Equals, 3)
+	c.Check(l.Signature, Equals, "abcde")
+
+	l = MakeLocator2("91f372a266fe2bf2823cb8ec7fda31ce", "3+bad")
+	c.Check(l.Hash, Equals, "")
+}
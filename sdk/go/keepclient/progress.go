@@ -0,0 +1,101 @@
+/* Reports the progress of uploads to Keep servers. */
+package keepclient
+
+import (
+	"sync"
+)
+
+// The progress of an upload, as reported to KeepClient.Progress.
+type UploadProgress struct {
+	Hash string
+
+	// Bytes read from the source of the block
+	BytesRead int64
+
+	// Bytes sent to each Keep server, keyed by service root
+	BytesSent map[string]int64
+
+	// Bytes each Keep server has acknowledged storing, keyed by service
+	// root.  A server acknowledges the whole block at once, when it
+	// reports that its replicas are stored.
+	BytesAcknowledged map[string]int64
+}
+
+// Tracks the progress of a single upload, and reports it each time it
+// changes.  The methods do nothing on a nil tracker.
+type progressTracker struct {
+	lock     sync.Mutex
+	report   func(UploadProgress)
+	progress UploadProgress
+}
+
+// Returns nil if 'report' is nil.
+func newProgressTracker(hash string, report func(UploadProgress)) *progressTracker {
+	if report == nil {
+		return nil
+	}
+	return &progressTracker{
+		report: report,
+		progress: UploadProgress{
+			Hash:              hash,
+			BytesSent:         make(map[string]int64),
+			BytesAcknowledged: make(map[string]int64),
+		},
+	}
+}
+
+// Call 'report' with a copy of the progress, so that it can keep it.
+// Must be called with the lock held, so reports are made one at a time
+// and in order.
+func (this *progressTracker) changed() {
+	p := this.progress
+	p.BytesSent = make(map[string]int64)
+	for root, n := range this.progress.BytesSent {
+		p.BytesSent[root] = n
+	}
+	p.BytesAcknowledged = make(map[string]int64)
+	for root, n := range this.progress.BytesAcknowledged {
+		p.BytesAcknowledged[root] = n
+	}
+	this.report(p)
+}
+
+// Count 'n' bytes read from the source.
+func (this *progressTracker) read(n int64) {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.progress.BytesRead += n
+	this.changed()
+}
+
+// Start counting the bytes sent to 'root', from zero if it is being tried
+// again.  Returns the function to count them with.
+func (this *progressTracker) start(root string) func(n int64) {
+	if this == nil {
+		return nil
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.progress.BytesSent[root] = 0
+	this.changed()
+	return func(n int64) {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		this.progress.BytesSent[root] += n
+		this.changed()
+	}
+}
+
+// Record that 'root' has stored the bytes sent to it.
+func (this *progressTracker) acknowledged(root string) {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.progress.BytesAcknowledged[root] = this.progress.BytesSent[root]
+	this.changed()
+}
@@ -0,0 +1,57 @@
+package keepclient
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"sync"
+)
+
+func (s *StandaloneSuite) TestPutProgress(c *C) {
+	data := bytes.Repeat([]byte("x"), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	kc, stop := makeRetryTestClient(1, &FlakyHandler{}, &FlakyHandler{})
+	defer stop()
+	kc.Want_replicas = 2
+
+	var lock sync.Mutex
+	var reports []UploadProgress
+	kc.Progress = func(p UploadProgress) {
+		lock.Lock()
+		defer lock.Unlock()
+		reports = append(reports, p)
+	}
+	_, replicas, err := kc.PutHR(hash, bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, IsNil)
+	c.Check(replicas, Equals, 2)
+
+	lock.Lock()
+	defer lock.Unlock()
+	c.Assert(len(reports) > 4, Equals, true)
+	// The counts never go down.
+	for i := 1; i < len(reports); i++ {
+		c.Check(reports[i].BytesRead >= reports[i-1].BytesRead, Equals, true)
+		for root, n := range reports[i-1].BytesSent {
+			c.Check(reports[i].BytesSent[root] >= n, Equals, true)
+		}
+	}
+	last := reports[len(reports)-1]
+	c.Check(last.Hash, Equals, hash)
+	c.Check(last.BytesRead, Equals, int64(len(data)))
+	c.Check(last.BytesSent, HasLen, 2)
+	c.Check(last.BytesAcknowledged, HasLen, 2)
+	for _, root := range kc.ServiceRoots() {
+		c.Check(last.BytesSent[root], Equals, int64(len(data)))
+		c.Check(last.BytesAcknowledged[root], Equals, int64(len(data)))
+	}
+
+	// A buffer is read all at once.
+	reports = nil
+	lock.Unlock()
+	_, _, err = kc.PutB([]byte("foo"))
+	lock.Lock()
+	c.Check(err, IsNil)
+	c.Check(reports[0].BytesRead, Equals, int64(3))
+	c.Check(reports[len(reports)-1].BytesAcknowledged, HasLen, 2)
+}
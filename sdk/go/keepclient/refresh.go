@@ -0,0 +1,86 @@
+/* Refreshes the permission signatures on collection manifests. */
+package keepclient
+
+import (
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/locator"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"sync"
+	"time"
+)
+
+// Fetch the manifest text of a collection from the API server.  The block
+// locators in it carry new permission signatures for the client's API
+// token.
+func GetSignedManifest(arv *arvadosclient.ArvadosClient, uuid string) (string, error) {
+	var collection struct {
+		ManifestText string `json:"manifest_text"`
+	}
+	if err := arv.Get("collections", uuid, nil, &collection); err != nil {
+		return "", err
+	}
+	return collection.ManifestText, nil
+}
+
+// Return manifestText, the manifest of collection 'uuid', unchanged if its
+// permission signatures are good for at least 'margin'.  Otherwise return
+// the newly signed manifest text from the API server.
+func RefreshManifest(arv *arvadosclient.ArvadosClient, uuid string, manifestText string, margin time.Duration) (string, error) {
+	m := manifest.Manifest{Text: manifestText}
+	if !m.ExpiresWithin(margin) {
+		return manifestText, nil
+	}
+	return GetSignedManifest(arv, uuid)
+}
+
+// Provides new permission signatures for the blocks in a collection, by
+// fetching its manifest from the API server again.  Its Refresh method can
+// be used as KeepClient.RefreshSignature.
+type SignatureRefresher struct {
+	arv  *arvadosclient.ArvadosClient
+	uuid string
+
+	lock sync.Mutex
+
+	// The signed locator for each block hash, from the manifest
+	// fetched most recently
+	locators map[string]locator.Locator
+}
+
+func NewSignatureRefresher(arv *arvadosclient.ArvadosClient, uuid string) *SignatureRefresher {
+	return &SignatureRefresher{arv: arv, uuid: uuid}
+}
+
+// Return a signed locator for the block with the given hash, which has a
+// different signature from the one given.  The manifest is fetched from
+// the API server only if the last one fetched does not provide one, so
+// many blocks can be refreshed with a single request.
+func (this *SignatureRefresher) Refresh(hash string, signature string) (string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if loc, ok := this.locators[hash]; ok && loc.Signature != signature {
+		return loc.String(), nil
+	}
+
+	manifestText, err := GetSignedManifest(this.arv, this.uuid)
+	if err != nil {
+		return "", err
+	}
+	this.locators = make(map[string]locator.Locator)
+	m := manifest.Manifest{Text: manifestText}
+	for stream := range m.StreamIter() {
+		for _, block := range stream.Blocks {
+			if loc, err := locator.Parse(block); err == nil && loc.IsSigned() {
+				this.locators[loc.Hash] = loc
+			}
+		}
+	}
+
+	loc, ok := this.locators[hash]
+	if !ok {
+		return "", fmt.Errorf("Block %s is not in collection %s", hash, this.uuid)
+	}
+	return loc.String(), nil
+}
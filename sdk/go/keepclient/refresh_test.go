@@ -0,0 +1,118 @@
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves "foo" to requests that use the signature 'good', and refuses all
+// others with 403.
+type StubSignedHandler struct {
+	good string
+}
+
+func (this *StubSignedHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !strings.Contains(req.URL.Path, "+A"+this.good+"@") {
+		http.Error(resp, "Forbidden", http.StatusForbidden)
+		return
+	}
+	resp.Write([]byte("foo"))
+}
+
+// Stands in for the API server, serving a collection with the given
+// manifest text, and counts the requests for it.
+type StubCollectionHandler struct {
+	lock         sync.Mutex
+	manifestText string
+	requests     int
+}
+
+func (this *StubCollectionHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if strings.HasPrefix(req.URL.Path, "/arvados/v1/collections/") {
+		this.requests += 1
+	}
+	fmt.Fprintf(resp, `{"manifest_text":%q}`, this.manifestText)
+}
+
+func (this *StubCollectionHandler) Requests() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests
+}
+
+func makeStubApiClient(api http.Handler) (arv arvadosclient.ArvadosClient, stop func()) {
+	ts := httptest.NewTLSServer(api)
+	arv = arvadosclient.ArvadosClient{
+		ApiServer: strings.TrimPrefix(ts.URL, "https://"),
+		ApiToken:  "abc123",
+		Client:    ts.Client()}
+	return arv, ts.Close
+}
+
+func (s *StandaloneSuite) TestGetRefreshSignature(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	good := strings.Repeat("1", 40)
+	api := &StubCollectionHandler{
+		manifestText: ". " + hash + "+3+A" + good + "@7fffffff 0:3:foo\n"}
+	arv, stopApi := makeStubApiClient(api)
+	defer stopApi()
+
+	ks := RunFakeKeepServer(&StubSignedHandler{good})
+	defer ks.listener.Close()
+	kc, _ := MakeKeepClient(&arv)
+	kc.SetServiceRoots(map[string]string{"zzzzz-bi6l4-fakefakefake000": ks.url})
+
+	stale := strings.Repeat("0", 40)
+	_, _, _, err := kc.AuthorizedGet(hash, stale, "7fffffff")
+	c.Check(IsPermissionDenied(err), Equals, true)
+
+	kc.RefreshSignature = NewSignatureRefresher(&arv, "zzzzz-4zz18-fakefakefake000").Refresh
+	for i := 0; i < 2; i++ {
+		r, _, url, err := kc.AuthorizedGet(hash, stale, "7fffffff")
+		c.Assert(err, IsNil)
+		c.Check(url, Matches, ".*\\+A"+good+"@7fffffff")
+		data, err := ioutil.ReadAll(r)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, "foo")
+	}
+	// The second refresh used the manifest already fetched.
+	c.Check(api.Requests(), Equals, 1)
+
+	// The signature from the API server is retried only once.
+	api.manifestText = ". " + hash + "+3+A" + strings.Repeat("2", 40) + "@7fffffff 0:3:foo\n"
+	kc.RefreshSignature = NewSignatureRefresher(&arv, "zzzzz-4zz18-fakefakefake000").Refresh
+	_, _, _, err = kc.AuthorizedGet(hash, stale, "7fffffff")
+	c.Check(IsPermissionDenied(err), Equals, true)
+	c.Check(api.Requests(), Equals, 2)
+}
+
+func (s *StandaloneSuite) TestRefreshManifest(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	fresh := ". " + hash + "+3+A" + strings.Repeat("1", 40) + "@" +
+		fmt.Sprintf("%08x", time.Now().Add(time.Hour).Unix()) + " 0:3:foo\n"
+	api := &StubCollectionHandler{manifestText: fresh}
+	arv, stop := makeStubApiClient(api)
+	defer stop()
+
+	mt, err := RefreshManifest(&arv, "zzzzz-4zz18-fakefakefake000", fresh, time.Minute)
+	c.Check(err, IsNil)
+	c.Check(mt, Equals, fresh)
+	c.Check(api.Requests(), Equals, 0)
+
+	expiring := ". " + hash + "+3+A" + strings.Repeat("1", 40) + "@" +
+		fmt.Sprintf("%08x", time.Now().Add(time.Minute).Unix()) + " 0:3:foo\n"
+	mt, err = RefreshManifest(&arv, "zzzzz-4zz18-fakefakefake000", expiring, 10*time.Minute)
+	c.Check(err, IsNil)
+	c.Check(mt, Equals, fresh)
+	c.Check(api.Requests(), Equals, 1)
+}
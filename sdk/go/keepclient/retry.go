@@ -0,0 +1,29 @@
+/* Retry policy for Keep requests. */
+package keepclient
+
+import (
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"time"
+)
+
+// How KeepClient retries reads and writes that fail with a transient
+// error, such as a 503 from a busy Keep server or a dropped connection.
+//
+// On each attempt, every server that has not yet answered definitively is
+// tried once, in RootSorter order.  If the operation has not succeeded by
+// the end of an attempt, and at least one server failed with an error that
+// Retryable accepts, KeepClient waits and then tries those servers again.
+// If the operation still fails, the MultiError returned records the number
+// of attempts made.
+//
+// The zero value makes a single attempt.
+type RetryPolicy = arvadosclient.RetryPolicy
+
+// The policy set by MakeKeepClient: three attempts, waiting about a
+// quarter of a second and then half a second between them.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:     3,
+	InitialDelay: 250 * time.Millisecond,
+	MaxDelay:     10 * time.Second,
+	Jitter:       0.5,
+}
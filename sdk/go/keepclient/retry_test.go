@@ -0,0 +1,162 @@
+package keepclient
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Responds with 'failStatus' to the first 'failures' requests, then
+// succeeds: GET returns 'body', and PUT stores one replica.
+type FlakyHandler struct {
+	lock       sync.Mutex
+	failures   int
+	failStatus int
+	body       []byte
+	requests   int
+}
+
+func (this *FlakyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	this.requests += 1
+	fail := this.requests <= this.failures
+	this.lock.Unlock()
+
+	if fail {
+		resp.WriteHeader(this.failStatus)
+		return
+	}
+	if req.Method == "PUT" {
+		body, _ := ioutil.ReadAll(req.Body)
+		resp.Write([]byte(fmt.Sprintf("%x+%d", md5.Sum(body), len(body))))
+		return
+	}
+	resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(this.body)))
+	resp.Write(this.body)
+}
+
+func (this *FlakyHandler) Requests() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests
+}
+
+func makeRetryTestClient(attempts int, handlers ...http.Handler) (kc KeepClient, stop func()) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	arv.ApiToken = "abc123"
+	kc, _ = MakeKeepClient(&arv)
+	kc.Retry = RetryPolicy{Attempts: attempts, InitialDelay: time.Millisecond}
+
+	service_roots := make(map[string]string)
+	var servers []KeepServer
+	for i, h := range handlers {
+		ks := RunFakeKeepServer(h)
+		servers = append(servers, ks)
+		service_roots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = ks.url
+	}
+	kc.SetServiceRoots(service_roots)
+	return kc, func() {
+		for _, ks := range servers {
+			ks.listener.Close()
+		}
+	}
+}
+
+func (s *StandaloneSuite) TestGetRetry(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	st := &FlakyHandler{failures: 2, failStatus: 503, body: []byte("foo")}
+
+	kc, stop := makeRetryTestClient(3, st)
+	defer stop()
+
+	r, n, _, err := kc.Get(hash)
+	c.Assert(err, Equals, nil)
+	defer r.Close()
+	c.Check(n, Equals, int64(3))
+	content, err := ioutil.ReadAll(r)
+	c.Check(err, Equals, nil)
+	c.Check(content, DeepEquals, []byte("foo"))
+	c.Check(st.Requests(), Equals, 3)
+
+	n, _, err = kc.Ask(hash)
+	c.Check(err, Equals, nil)
+	c.Check(n, Equals, int64(3))
+}
+
+func (s *StandaloneSuite) TestGetRetryGiveUp(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	st := &FlakyHandler{failures: 10, failStatus: 503, body: []byte("foo")}
+
+	kc, stop := makeRetryTestClient(3, st)
+	defer stop()
+
+	_, _, _, err := kc.Get(hash)
+	c.Check(errors.Is(err, BlockNotFound), Equals, true)
+	c.Check(err.(*MultiError).Attempts, Equals, 3)
+	c.Check(len(err.(*MultiError).Errors), Equals, 1)
+	c.Check(IsTemporary(err), Equals, true)
+	c.Check(st.Requests(), Equals, 3)
+}
+
+func (s *StandaloneSuite) TestGetNotFoundNotRetried(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	st := &FlakyHandler{failures: 10, failStatus: 404}
+
+	kc, stop := makeRetryTestClient(3, st)
+	defer stop()
+
+	_, _, _, err := kc.Get(hash)
+	c.Check(err.(*MultiError).Attempts, Equals, 1)
+	c.Check(IsNotFound(err), Equals, true)
+	_, _, err = kc.Ask(hash)
+	c.Check(err.(*MultiError).Attempts, Equals, 1)
+	c.Check(IsNotFound(err), Equals, true)
+	c.Check(st.Requests(), Equals, 2)
+}
+
+func (s *StandaloneSuite) TestPutRetry(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	st1 := &FlakyHandler{failures: 1, failStatus: 503}
+	st2 := &FlakyHandler{failures: 2, failStatus: 503}
+
+	kc, stop := makeRetryTestClient(3, st1, st2)
+	defer stop()
+	kc.Want_replicas = 2
+
+	locator, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(err, Equals, nil)
+	c.Check(locator, Equals, hash+"+3")
+	c.Check(replicas, Equals, 2)
+	c.Check(st1.Requests(), Equals, 2)
+	c.Check(st2.Requests(), Equals, 3)
+}
+
+func (s *StandaloneSuite) TestPutRetryGiveUp(c *C) {
+	st1 := &FlakyHandler{failures: 10, failStatus: 503}
+	st2 := &FlakyHandler{failures: 10, failStatus: 403}
+
+	kc, stop := makeRetryTestClient(2, st1, st2)
+	defer stop()
+	kc.Want_replicas = 1
+
+	_, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(errors.Is(err, InsufficientReplicasError), Equals, true)
+	c.Check(err.(*MultiError).Attempts, Equals, 2)
+	c.Check(len(err.(*MultiError).Errors), Equals, 2)
+	c.Check(IsTemporary(err), Equals, true)
+	c.Check(replicas, Equals, 0)
+	c.Check(st1.Requests(), Equals, 2)
+	c.Check(st2.Requests(), Equals, 1)
+}
+
+func (s *StandaloneSuite) TestMakeKeepClientRetryPolicy(c *C) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	c.Check(kc.Retry, DeepEquals, DefaultRetryPolicy)
+}
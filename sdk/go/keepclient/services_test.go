@@ -0,0 +1,228 @@
+package keepclient
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Stores blocks written with PUT, reporting 'replicas' replicas stored,
+// and counts the requests.
+type StubReplicasHandler struct {
+	lock     sync.Mutex
+	replicas int
+	requests int
+}
+
+func (this *StubReplicasHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	this.requests += 1
+	this.lock.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	resp.Header().Set(X_Keep_Replicas_Stored, fmt.Sprint(this.replicas))
+	resp.Write([]byte(fmt.Sprintf("%x+%d", md5.Sum(body), len(body))))
+}
+
+func (this *StubReplicasHandler) Requests() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests
+}
+
+// Run a fake Keep server for each handler, and make them the client's
+// services, with the attributes given in 'services' apart from Root.
+func setStubServices(kc *KeepClient, services []KeepService, handlers ...http.Handler) (stop func()) {
+	var servers []KeepServer
+	list := make(map[string]KeepService)
+	for i, h := range handlers {
+		ks := RunFakeKeepServer(h)
+		servers = append(servers, ks)
+		services[i].Root = ks.url
+		list[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = services[i]
+	}
+	kc.SetServices(list)
+	return func() {
+		for _, ks := range servers {
+			ks.listener.Close()
+		}
+	}
+}
+
+func (s *StandaloneSuite) TestPutSkipsReadOnlyServices(c *C) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(&arv)
+	writable := &StubReplicasHandler{replicas: 1}
+	readonly := &StubReplicasHandler{replicas: 1}
+	stop := setStubServices(&kc, []KeepService{{Replication: 1}, {ReadOnly: true, Replication: 1}},
+		writable, readonly)
+	defer stop()
+
+	c.Check(kc.WritableRoots(), HasLen, 1)
+	c.Check(kc.ServiceRoots(), HasLen, 2)
+
+	kc.Want_replicas = 2
+	_, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(errors.Is(err, InsufficientReplicasError), Equals, true)
+	c.Check(replicas, Equals, 1)
+	c.Check(writable.Requests(), Equals, 1)
+	c.Check(readonly.Requests(), Equals, 0)
+}
+
+func (s *StandaloneSuite) TestPutMultipleReplicaServices(c *C) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(&arv)
+	handlers := []*StubReplicasHandler{{replicas: 2}, {replicas: 2}, {replicas: 2}}
+	stop := setStubServices(&kc, []KeepService{{Replication: 2}, {Replication: 2}, {Replication: 2}},
+		handlers[0], handlers[1], handlers[2])
+	defer stop()
+
+	// One service stores both of the replicas wanted.
+	kc.Want_replicas = 2
+	_, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 2)
+	c.Check(handlers[0].Requests()+handlers[1].Requests()+handlers[2].Requests(), Equals, 1)
+
+	// Two services are needed for three replicas, and the count
+	// includes the extra one stored.
+	kc.Want_replicas = 3
+	_, replicas, err = kc.PutB([]byte("bar"))
+	c.Check(err, IsNil)
+	c.Check(replicas, Equals, 4)
+	c.Check(handlers[0].Requests()+handlers[1].Requests()+handlers[2].Requests(), Equals, 3)
+}
+
+func (s *StandaloneSuite) TestDiscoverServiceAttributes(c *C) {
+	api := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(resp, `{"items":[`+
+			`{"uuid":"zzzzz-bi6l4-000000000000000","service_host":"keep0","service_port":25107,"service_type":"disk"},`+
+			`{"uuid":"zzzzz-bi6l4-000000000000001","service_host":"keep1","service_port":25107,"service_type":"disk","read_only":true},`+
+			`{"uuid":"zzzzz-bi6l4-000000000000002","service_host":"keep2","service_port":25107,"service_type":"disk","replication":3},`+
+			`{"uuid":"zzzzz-bi6l4-000000000000003","service_host":"proxy","service_port":443,"service_ssl_flag":true,"service_type":"proxy"}]}`)
+	})
+	arv, stop := makeStubApiClient(api)
+	defer stop()
+
+	kc, err := MakeKeepClient(&arv)
+	c.Assert(err, IsNil)
+	c.Check(kc.Services(), DeepEquals, map[string]KeepService{
+		"zzzzz-bi6l4-000000000000000": {"http://keep0:25107", false, 1},
+		"zzzzz-bi6l4-000000000000001": {"http://keep1:25107", true, 1},
+		"zzzzz-bi6l4-000000000000002": {"http://keep2:25107", false, 3},
+		"zzzzz-bi6l4-000000000000003": {"https://proxy:443", false, 0},
+	})
+	c.Check(kc.ServiceRoots(), HasLen, 4)
+	c.Check(kc.WritableRoots(), HasLen, 3)
+	c.Check(kc.Using_proxy, Equals, true)
+}
+
+func (s *StandaloneSuite) TestDefaultReplicasFromDiscovery(c *C) {
+	api := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == arvadosclient.DISCOVERY_PATH {
+			fmt.Fprint(resp, `{"defaultCollectionReplication":3}`)
+			return
+		}
+		fmt.Fprint(resp, `{"items":[]}`)
+	})
+	arv, stop := makeStubApiClient(api)
+	defer stop()
+	kc, err := MakeKeepClient(&arv)
+	c.Check(err, IsNil)
+	c.Check(kc.Want_replicas, Equals, 3)
+
+	// If the API server does not advertise a default, DEFAULT_REPLICAS is used.
+	arv, stop2 := makeStubApiClient(&StubServicesHandler{})
+	defer stop2()
+	kc, err = MakeKeepClient(&arv)
+	c.Check(err, IsNil)
+	c.Check(kc.Want_replicas, Equals, DEFAULT_REPLICAS)
+}
+
+func (s *StandaloneSuite) TestDefaultReplicasDiscoveryFails(c *C) {
+	var lock sync.Mutex
+	discoveryRequests := 0
+	api := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == arvadosclient.DISCOVERY_PATH {
+			lock.Lock()
+			discoveryRequests += 1
+			lock.Unlock()
+			http.Error(resp, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(resp, `{"items":[]}`)
+	})
+	arv, stop := makeStubApiClient(api)
+	defer stop()
+	arv.Retry = arvadosclient.RetryPolicy{Attempts: 5, InitialDelay: time.Second}
+
+	// The discovery document is asked for once, without waiting to
+	// retry, and DEFAULT_REPLICAS is used.
+	start := time.Now()
+	kc, err := MakeKeepClient(&arv)
+	c.Check(err, IsNil)
+	c.Check(time.Since(start) < time.Second, Equals, true)
+	c.Check(kc.Want_replicas, Equals, DEFAULT_REPLICAS)
+	lock.Lock()
+	c.Check(discoveryRequests, Equals, 1)
+	lock.Unlock()
+}
+
+// Stores blocks written with PUT, reporting two replicas stored, but holds
+// back the response to every request after the first until 'release' is
+// closed.
+type StubHoldingHandler struct {
+	lock     sync.Mutex
+	requests int
+	release  chan struct{}
+}
+
+func (this *StubHoldingHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	this.requests += 1
+	first := this.requests == 1
+	this.lock.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	if !first {
+		<-this.release
+	}
+	resp.Header().Set(X_Keep_Replicas_Stored, "2")
+	resp.Write([]byte(fmt.Sprintf("%x+%d", md5.Sum(body), len(body))))
+}
+
+func (s *StandaloneSuite) TestPutWaitsForAllUploads(c *C) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	arv.ApiToken = "abc123"
+	kc, _ := MakeKeepClient(&arv)
+	h := &StubHoldingHandler{release: make(chan struct{})}
+	stop := setStubServices(&kc, []KeepService{{Replication: 1}, {Replication: 1}}, h, h)
+	defer stop()
+
+	// Both uploads start, and the first stores both replicas wanted,
+	// but PutB still waits for the second.
+	kc.Want_replicas = 2
+	done := make(chan int)
+	go func() {
+		_, replicas, _ := kc.PutB([]byte("foo"))
+		done <- replicas
+	}()
+	select {
+	case <-done:
+		c.Fatal("PutB returned while an upload was still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(h.release)
+	select {
+	case replicas := <-done:
+		c.Check(replicas, Equals, 2)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Timed out waiting for PutB")
+	}
+}
@@ -2,9 +2,11 @@
 package keepclient
 
 import (
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/streamer"
 	"io"
 	"io/ioutil"
@@ -21,6 +23,10 @@ type keepDisk struct {
 	Port     int    `json:"service_port"`
 	SSL      bool   `json:"service_ssl_flag"`
 	SvcType  string `json:"service_type"`
+
+	// Only in keep_services
+	ReadOnly    bool `json:"read_only"`
+	Replication int  `json:"replication"`
 }
 
 func Md5String(s string) string {
@@ -77,21 +83,54 @@ func (this *KeepClient) setClientSettingsStore() {
 }
 
 func (this *KeepClient) DiscoverKeepServers() (map[string]string, error) {
+	return this.DiscoverKeepServersContext(context.Background())
+}
+
+// Like DiscoverKeepServers, but gives up if ctx is cancelled or its deadline
+// passes.
+func (this *KeepClient) DiscoverKeepServersContext(ctx context.Context) (map[string]string, error) {
+	services, using_proxy, err := this.listServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if using_proxy {
+		this.Using_proxy = true
+		this.setClientSettingsProxy()
+	} else {
+		this.setClientSettingsStore()
+	}
+
+	this.SetServices(services)
+
+	return this.ServiceRoots(), nil
+}
+
+// Get the list of Keep services from the API server, and report whether
+// any of them is a proxy.
+func (this *KeepClient) listServices(ctx context.Context) (services map[string]KeepService, using_proxy bool, err error) {
 	type svcList struct {
 		Items []keepDisk `json:"items"`
 	}
 	var m svcList
 
-	err := this.Arvados.Call("GET", "keep_services", "", "accessible", nil, &m)
+	err = this.Arvados.CallContext(ctx, "GET", "keep_services", "", "accessible", nil, &m)
 
 	if err != nil {
-		if err := this.Arvados.List("keep_disks", nil, &m); err != nil {
-			return nil, err
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		// Older API servers only have keep_disks.  The request above
+		// has already used up the retries, so ask just once.
+		arv := *this.Arvados
+		arv.Retry = arvadosclient.RetryPolicy{}
+		if err := arv.ListContext(ctx, "keep_disks", nil, &m); err != nil {
+			return nil, false, err
 		}
 	}
 
 	listed := make(map[string]bool)
-	service_roots := make(map[string]string)
+	services = make(map[string]KeepService)
 
 	for _, element := range m.Items {
 		n := ""
@@ -103,25 +142,23 @@ func (this *KeepClient) DiscoverKeepServers() (map[string]string, error) {
 		// Construct server URL
 		url := fmt.Sprintf("http%s://%s:%d", n, element.Hostname, element.Port)
 
+		// A proxy stores as many replicas as it is asked to, and
+		// other services store one unless they say otherwise.
+		replication := element.Replication
+		if replication <= 0 && element.SvcType != "proxy" {
+			replication = 1
+		}
+
 		// Skip duplicates
 		if !listed[url] {
 			listed[url] = true
-			service_roots[element.Uuid] = url
+			services[element.Uuid] = KeepService{url, element.ReadOnly, replication}
 		}
 		if element.SvcType == "proxy" {
-			this.Using_proxy = true
+			using_proxy = true
 		}
 	}
-
-	if this.Using_proxy {
-		this.setClientSettingsProxy()
-	} else {
-		this.setClientSettingsStore()
-	}
-
-	this.SetServiceRoots(service_roots)
-
-	return service_roots, nil
+	return services, using_proxy, nil
 }
 
 type uploadStatus struct {
@@ -132,13 +169,13 @@ type uploadStatus struct {
 	response        string
 }
 
-func (this KeepClient) uploadToKeepServer(host string, hash string, body io.ReadCloser,
+func (this KeepClient) uploadToKeepServer(ctx context.Context, host string, hash string, body io.ReadCloser,
 	upload_status chan<- uploadStatus, expectedLength int64, requestId string) {
 
 	var req *http.Request
 	var err error
 	var url = fmt.Sprintf("%s/%s", host, hash)
-	if req, err = http.NewRequest("PUT", url, nil); err != nil {
+	if req, err = http.NewRequestWithContext(ctx, "PUT", url, nil); err != nil {
 		log.Printf("[%v] Error creating request PUT %v error: %v", requestId, url, err.Error())
 		upload_status <- uploadStatus{err, url, 0, 0, ""}
 		body.Close()
@@ -167,11 +204,16 @@ func (this KeepClient) uploadToKeepServer(host string, hash string, body io.Read
 
 	var resp *http.Response
 	if resp, err = this.Client.Do(req); err != nil {
+		if ctx.Err() == nil {
+			this.health.record(host, 0)
+		}
 		log.Printf("[%v] Upload failed %v error: %v", requestId, url, err.Error())
 		upload_status <- uploadStatus{err, url, 0, 0, ""}
 		return
 	}
 
+	this.health.record(host, resp.StatusCode)
+
 	rep := 1
 	if xr := resp.Header.Get(X_Keep_Replicas_Stored); xr != "" {
 		fmt.Sscanf(xr, "%d", &rep)
@@ -194,42 +236,96 @@ func (this KeepClient) uploadToKeepServer(host string, hash string, body io.Read
 	}
 }
 
+// Write replicas of the block read from 'tr' to Keep servers.  If ctx is
+// cancelled or its deadline passes, the stream is cancelled first so that
+// uploads blocked reading it fail, then the uploads themselves are aborted.
+// putReplicas waits for all upload goroutines to finish before returning,
+// even once enough replicas have been stored, so the caller can close 'tr'
+// safely.  The data sent to each server is
+// counted by 'progress', which may be nil.
 func (this KeepClient) putReplicas(
+	ctx context.Context,
 	hash string,
 	tr *streamer.AsyncStream,
-	expectedLength int64) (locator string, replicas int, err error) {
+	expectedLength int64,
+	progress *progressTracker) (locator string, replicas int, err error) {
 
 	// Take the hash of locator and timestamp in order to identify this
 	// specific transaction in log statements.
 	requestId := fmt.Sprintf("%x", md5.Sum([]byte(locator+time.Now().String())))[0:8]
 
-	// Calculate the ordering for uploading to servers
-	sv := NewRootSorter(this.ServiceRoots(), hash).GetSortedRoots()
+	// Calculate the ordering for uploading to servers, and how many
+	// replicas each one is expected to store
+	sv := this.sortedWritableRoots(hash)
+	replication := make(map[string]int)
+	for _, svc := range this.Services() {
+		replication[svc.Root] = svc.Replication
+	}
 
 	// The next server to try contacting
 	next_server := 0
 
-	// The number of active writers
+	// The number of active writers, the number of replicas they are
+	// expected to store, and the number expected from each one
 	active := 0
+	pending_replicas := 0
+	expected := make(map[string]int)
 
 	// Used to communicate status from the upload goroutines
 	upload_status := make(chan uploadStatus)
-	defer close(upload_status)
+
+	// The uploads get their own context, which is cancelled only after
+	// the stream has been cancelled.  Otherwise the HTTP client might
+	// close a StreamReader while a Read on it is still waiting for data.
+	upload_ctx, cancel_uploads := context.WithCancel(context.Background())
+	defer cancel_uploads()
+
+	// Wait for the uploads still running when putReplicas returns,
+	// before their context is cancelled.
+	defer func() {
+		for ; active > 0; active-- {
+			<-upload_status
+		}
+	}()
 
 	// Desired number of replicas
 	remaining_replicas := this.Want_replicas
 
+	// The current attempt, the servers that failed in a way that is
+	// worth retrying on the next one and how they failed, and the
+	// failures that will not be retried
+	attempt := 1
+	var retry []string
+	var retryErrs []ServerError
+	var errs []ServerError
+
 	for remaining_replicas > 0 {
-		for active < remaining_replicas {
+		for pending_replicas < remaining_replicas {
 			// Start some upload requests
 			if next_server < len(sv) {
-				log.Printf("[%v] Begin upload %s to %s", requestId, hash, sv[next_server])
-				go this.uploadToKeepServer(sv[next_server], hash, tr.MakeStreamReader(), upload_status, expectedLength, requestId)
+				host := sv[next_server]
+				expected[host] = replication[host]
+				if expected[host] <= 0 {
+					expected[host] = remaining_replicas - pending_replicas
+				}
+				log.Printf("[%v] Begin upload %s to %s", requestId, hash, host)
+				body := meterReader(upload_ctx, tr.MakeStreamReader(), this.Bandwidth, progress.start(host))
+				go this.uploadToKeepServer(upload_ctx, host, hash, body, upload_status, expectedLength, requestId)
 				next_server += 1
 				active += 1
+				pending_replicas += expected[host]
 			} else {
 				if active == 0 {
-					return locator, (this.Want_replicas - remaining_replicas), InsufficientReplicasError
+					if len(retry) == 0 || attempt >= this.Retry.MaxAttempts() {
+						return locator, (this.Want_replicas - remaining_replicas),
+							&MultiError{InsufficientReplicasError, attempt, append(errs, retryErrs...)}
+					}
+					log.Printf("[%v] Upload attempt %v failed, retrying %v servers", requestId, attempt, len(retry))
+					if err := this.Retry.Wait(ctx, attempt); err != nil {
+						return locator, (this.Want_replicas - remaining_replicas), err
+					}
+					attempt += 1
+					sv, retry, retryErrs, next_server = retry, nil, nil, 0
 				} else {
 					break
 				}
@@ -239,15 +335,41 @@ func (this KeepClient) putReplicas(
 			requestId, remaining_replicas, active)
 
 		// Now wait for something to happen.
-		status := <-upload_status
+		var status uploadStatus
+		select {
+		case status = <-upload_status:
+		case <-ctx.Done():
+			log.Printf("[%v] Upload %s abandoned: %v", requestId, hash, ctx.Err())
+			tr.Cancel(ctx.Err())
+			cancel_uploads()
+			for active > 0 {
+				if status := <-upload_status; status.statusCode == 200 {
+					remaining_replicas -= status.replicas_stored
+				}
+				active -= 1
+			}
+			return locator, (this.Want_replicas - remaining_replicas), ctx.Err()
+		}
 		active -= 1
+		host := strings.TrimSuffix(status.url, "/"+hash)
+		pending_replicas -= expected[host]
+		delete(expected, host)
 
 		if status.statusCode == 200 {
 			// good news!
+			progress.acknowledged(host)
 			remaining_replicas -= status.replicas_stored
 			locator = status.response
+		} else {
+			serr := ServerError{status.url, status.statusCode, status.err}
+			if this.Retry.ShouldRetry(status.statusCode, status.err) {
+				retry = append(retry, host)
+				retryErrs = append(retryErrs, serr)
+			} else {
+				errs = append(errs, serr)
+			}
 		}
 	}
 
-	return locator, this.Want_replicas, nil
+	return locator, this.Want_replicas - remaining_replicas, nil
 }
@@ -0,0 +1,176 @@
+/* Parses, signs and verifies Keep block locators.
+
+A locator has the form
+
+    hash[+size][+hint...]
+
+where hash is the MD5 digest of the block as 32 hexadecimal digits, and
+size is its length in bytes.  A permission hint of the form
+
+    +A[signature]@[timestamp]
+
+grants access to the block, until the time given by the timestamp, to
+clients using the API token that was used to make the signature.  The
+signature is an HMAC-SHA1 of the hash, the token and the timestamp, keyed
+with the permission secret shared by the API server and Keep servers.
+Other hints start with an upper case letter, and are kept as they are, so
+that hints added later do not make a locator invalid.
+*/
+
+package locator
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var InvalidLocator = errors.New("Invalid locator")
+var Unsigned = errors.New("Locator has no permission signature")
+var SignatureExpired = errors.New("Permission signature has expired")
+var BadSignature = errors.New("Invalid permission signature")
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var sizePattern = regexp.MustCompile(`^[0-9]+$`)
+var signaturePattern = regexp.MustCompile(`^A([[:xdigit:]]+)@([[:xdigit:]]{8})$`)
+var hintPattern = regexp.MustCompile(`^[A-Z][^+]*$`)
+
+type Locator struct {
+	Hash string
+
+	// Size of the block, or -1 if the locator has no size hint
+	Size int
+
+	// Permission signature and expiry timestamp, in hexadecimal as
+	// they appear in the locator, or "" if the locator is unsigned
+	Signature string
+	Timestamp string
+
+	// Any other hints, without the leading "+"
+	Hints []string
+}
+
+// Parse and validate a locator.  Returns an error wrapping
+// InvalidLocator if the hash is malformed, or if a hint is neither a size
+// nor starts with an upper case letter.  The first size hint and the first
+// well-formed permission signature are interpreted; any further size
+// hints are ignored, and other hints are kept in Hints.
+func Parse(s string) (loc Locator, err error) {
+	tokens := strings.Split(s, "+")
+	if !hashPattern.MatchString(tokens[0]) {
+		return loc, fmt.Errorf("%w %q: bad hash", InvalidLocator, s)
+	}
+	loc.Hash = tokens[0]
+	loc.Size = -1
+	for _, hint := range tokens[1:] {
+		if sizePattern.MatchString(hint) {
+			if loc.Size < 0 {
+				loc.Size, err = strconv.Atoi(hint)
+				if err != nil {
+					return Locator{}, fmt.Errorf("%w %q: bad size", InvalidLocator, s)
+				}
+			}
+		} else if m := signaturePattern.FindStringSubmatch(hint); m != nil && loc.Signature == "" {
+			loc.Signature, loc.Timestamp = m[1], m[2]
+		} else if hintPattern.MatchString(hint) {
+			// Unknown hints are kept, to permit forward
+			// compatibility.
+			loc.Hints = append(loc.Hints, hint)
+		} else {
+			return Locator{}, fmt.Errorf("%w %q: bad hint %q", InvalidLocator, s, hint)
+		}
+	}
+	return loc, nil
+}
+
+// Return the locator as a string: the hash, then the size, the permission
+// signature and any other hints.
+func (this Locator) String() string {
+	s := this.Hash
+	if this.Size >= 0 {
+		s += "+" + strconv.Itoa(this.Size)
+	}
+	if this.Signature != "" {
+		s += "+A" + this.Signature + "@" + this.Timestamp
+	}
+	for _, hint := range this.Hints {
+		s += "+" + hint
+	}
+	return s
+}
+
+func (this Locator) IsSigned() bool {
+	return this.Signature != ""
+}
+
+// Return the time the permission signature expires.  Returns Unsigned if
+// there is no signature.
+func (this Locator) Expiry() (time.Time, error) {
+	if this.Signature == "" {
+		return time.Time{}, Unsigned
+	}
+	return ParseHexTimestamp(this.Timestamp)
+}
+
+// Return a copy of the locator without its permission signature.
+func (this Locator) StripSignature() Locator {
+	this.Signature, this.Timestamp = "", ""
+	return this
+}
+
+// Return a copy of the locator signed with 'key' for 'token', which
+// expires after ttl.  Any existing signature is replaced.
+func (this Locator) Sign(key []byte, token string, ttl time.Duration) Locator {
+	return this.SignUntil(key, token, time.Now().Add(ttl))
+}
+
+// Return a copy of the locator signed with 'key' for 'token', which
+// expires at 'expiry'.  Any existing signature is replaced.
+func (this Locator) SignUntil(key []byte, token string, expiry time.Time) Locator {
+	this.Timestamp = fmt.Sprintf("%08x", expiry.Unix())
+	this.Signature = MakeSignature(key, this.Hash, token, this.Timestamp)
+	return this
+}
+
+// Check that the locator has an unexpired permission signature made with
+// 'key' for 'token'.  Returns Unsigned, SignatureExpired or BadSignature
+// if not.
+func (this Locator) Verify(key []byte, token string) error {
+	expiry, err := this.Expiry()
+	if err == Unsigned {
+		return err
+	} else if err != nil || expiry.Before(time.Now()) {
+		return SignatureExpired
+	}
+	if !hmac.Equal([]byte(this.Signature), []byte(MakeSignature(key, this.Hash, token, this.Timestamp))) {
+		return BadSignature
+	}
+	return nil
+}
+
+// Return the permission signature for a block hash, API token and expiry
+// timestamp (in hexadecimal), made with 'key'.
+func MakeSignature(key []byte, hash string, token string, timestamp string) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(hash))
+	mac.Write([]byte("@"))
+	mac.Write([]byte(token))
+	mac.Write([]byte("@"))
+	mac.Write([]byte(timestamp))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// Convert a hexadecimal Unix timestamp, as used in permission hints, to
+// a time.
+func ParseHexTimestamp(timestamp string) (time.Time, error) {
+	t, err := strconv.ParseInt(timestamp, 16, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(t, 0), nil
+}
@@ -0,0 +1,114 @@
+package locator
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	knownHash   = "acbd18db4cc2f85cedef654fccc4a4d8"
+	knownToken  = "hocfupkn2pjhrpgp2vxv8rsku7tvtx49arbc9s4bvu7p7wxqvk"
+	knownKey    = "13u9fkuccnboeewr0ne3mvapk28epf68a3bhj9q8sb4l6e4e5mkk"
+	testSigHint = "+A5ba6ab3d11e8ecb4bca1b4dc2bc4cd77b69e4bc4@7fffffff"
+)
+
+func TestParse(t *testing.T) {
+	loc, err := Parse(knownHash + "+3+K@qr1hi" + testSigHint + "+Zfoo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if loc.Hash != knownHash || loc.Size != 3 || loc.Timestamp != "7fffffff" ||
+		len(loc.Hints) != 2 || loc.Hints[0] != "K@qr1hi" || loc.Hints[1] != "Zfoo" {
+		t.Fatalf("Parsed incorrectly: %#v", loc)
+	}
+	if s := loc.String(); s != knownHash+"+3"+testSigHint+"+K@qr1hi+Zfoo" {
+		t.Fatalf("Unexpected string %q", s)
+	}
+
+	loc, err = Parse(knownHash)
+	if err != nil || loc.Size != -1 || loc.IsSigned() || loc.String() != knownHash {
+		t.Fatalf("Parsed %q incorrectly: %#v, %v", knownHash, loc, err)
+	}
+}
+
+func TestParseUnknownHints(t *testing.T) {
+	for _, test := range []struct {
+		s     string
+		size  int
+		hints []string
+	}{
+		{knownHash + "+3+K@zzzzz.example:25107", 3, []string{"K@zzzzz.example:25107"}},
+		{knownHash + "+K", -1, []string{"K"}},
+		{knownHash + "+3+Afoo+Aabc@123", 3, []string{"Afoo", "Aabc@123"}},
+		{knownHash + "+K@qr1hi+3", 3, []string{"K@qr1hi"}},
+		{knownHash + "+3+4", 3, nil},
+		{knownHash + testSigHint + testSigHint, -1, []string{testSigHint[1:]}},
+	} {
+		loc, err := Parse(test.s)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.s, err)
+			continue
+		}
+		if loc.Size != test.size || len(loc.Hints) != len(test.hints) {
+			t.Errorf("Parsed %q incorrectly: %#v", test.s, loc)
+			continue
+		}
+		for i, hint := range test.hints {
+			if loc.Hints[i] != hint {
+				t.Errorf("Parsed %q incorrectly: %#v", test.s, loc)
+			}
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"acbd18db4cc2f85cedef654fccc4a4d",
+		"ACBD18DB4CC2F85CEDEF654FCCC4A4D8+3",
+		knownHash + "+",
+		knownHash + "+3+",
+		knownHash + "+3+k@qr1hi",
+		knownHash + "+3+@qr1hi",
+	} {
+		if loc, err := Parse(s); err == nil {
+			t.Errorf("Expected an error parsing %q, got %#v", s, loc)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	loc, _ := Parse(knownHash + "+3+K@qr1hi")
+	expiry, _ := ParseHexTimestamp("7fffffff")
+	signed := loc.SignUntil([]byte(knownKey), knownToken, expiry)
+	if err := signed.Verify([]byte(knownKey), knownToken); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := signed.Verify([]byte(knownKey), "wrongtoken"); err != BadSignature {
+		t.Errorf("Expected BadSignature with the wrong token, got %v", err)
+	}
+	if err := signed.Verify([]byte("wrongkey"), knownToken); err != BadSignature {
+		t.Errorf("Expected BadSignature with the wrong key, got %v", err)
+	}
+	if err := loc.Verify([]byte(knownKey), knownToken); err != Unsigned {
+		t.Errorf("Expected Unsigned, got %v", err)
+	}
+
+	// Signing again replaces the signature.
+	resigned := signed.Sign([]byte(knownKey), knownToken, time.Hour)
+	if resigned.Signature == signed.Signature || resigned.Verify([]byte(knownKey), knownToken) != nil {
+		t.Errorf("Re-signing failed: %v", resigned)
+	}
+	if e, _ := resigned.Expiry(); e.Before(time.Now().Add(59*time.Minute)) || e.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Unexpected expiry %v", e)
+	}
+
+	expired := loc.Sign([]byte(knownKey), knownToken, -time.Hour)
+	if err := expired.Verify([]byte(knownKey), knownToken); err != SignatureExpired {
+		t.Errorf("Expected SignatureExpired, got %v", err)
+	}
+
+	if s := signed.StripSignature().String(); s != knownHash+"+3+K@qr1hi" {
+		t.Errorf("Unexpected stripped locator %q", s)
+	}
+}
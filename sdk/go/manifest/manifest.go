@@ -7,10 +7,12 @@ package manifest
 import (
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/blockdigest"
+	"git.curoverse.com/arvados.git/sdk/go/locator"
 	"log"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var LocatorPattern = regexp.MustCompile(
@@ -116,3 +118,29 @@ func (m *Manifest) BlockIterWithDuplicates() <-chan BlockLocator {
 	}(m.StreamIter())
 	return blockChannel
 }
+
+// Report whether any of the permission signatures on the manifest's block
+// locators expires within d from now, so the manifest should be fetched
+// again from the API server before its blocks are read.  A signature with
+// an invalid timestamp is treated as expired.
+func (m *Manifest) ExpiresWithin(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	expiring := false
+	for stream := range m.StreamIter() {
+		// Keep reading after an expiring signature is found, so
+		// the iterator's goroutine can exit.
+		for _, block := range stream.Blocks {
+			if expiring {
+				break
+			}
+			loc, err := locator.Parse(block)
+			if err != nil || !loc.IsSigned() {
+				continue
+			}
+			if expiry, err := loc.Expiry(); err != nil || expiry.Before(deadline) {
+				expiring = true
+			}
+		}
+	}
+	return expiring
+}
@@ -1,10 +1,13 @@
 package manifest
 
 import (
+	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/blockdigest"
 	"io/ioutil"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func getStackTrace() (string) {
@@ -176,3 +179,213 @@ func TestBlockIterLongManifest(t *testing.T) {
 			Size: 31367794,
 			Hints: []string{"E53f903684239bcc114f7bf8ff9bd6089f33058db@5441920c"}})
 }
+
+func TestParseStreamFileSegments(t *testing.T) {
+	s, err := ParseStream("./foo\\040bar acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3+K@qr1hi 0:4:a\\040b.txt 4:2:sub/c 6:0:empty")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing stream: %v", err)
+	}
+	expectEqual(t, s.Name, "./foo bar")
+	expectEqual(t, len(s.Blocks), 2)
+	expectEqual(t, s.Blocks[1].String(), "37b51d194a7513e45b56f6524f2d51f2+3+K@qr1hi")
+	expectEqual(t, s.Size(), int64(6))
+	expectEqual(t, len(s.Files), 3)
+	expectEqual(t, s.Files[0], FileSegment{0, 4, "a b.txt"})
+	expectEqual(t, s.Files[1], FileSegment{4, 2, "sub/c"})
+	expectEqual(t, s.Files[2], FileSegment{6, 0, "empty"})
+}
+
+func TestParseStreamErrors(t *testing.T) {
+	for _, test := range []struct {
+		line  string
+		token int
+	}{
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3", 0},
+		{". 0:3:foo 0:0:bar", 2},
+		{"foo acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo", 1},
+		{"./foo/../bar acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo", 1},
+		{".  acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo", 2},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo acbd18db4cc2f85cedef654fccc4a4d8+3", 4},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3", 3},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 x:3:foo", 3},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:-1:foo", 3},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo 1:3:bar", 4},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:", 3},
+		{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:a//b", 3},
+	} {
+		_, err := ParseStream(test.line)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("Expected *ParseError for %q, got %v", test.line, err)
+		}
+		if perr.Token != test.token {
+			t.Fatalf("Expected error at token %d for %q, got %v", test.token, test.line, err)
+		}
+	}
+}
+
+func TestStreamsErrorLine(t *testing.T) {
+	m := Manifest{". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n\n. acbd18db4cc2f85cedef654fccc4a4d8+3 0:4:foo\n"}
+	_, err := m.Streams()
+	expectEqual(t, err.Error(), "Invalid manifest at line 3, token 3: "+
+		"File segment \"0:4:foo\" extends past the end of the stream (3 bytes)")
+}
+
+func TestFileMap(t *testing.T) {
+	m := Manifest{". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 2:3:foo 0:0:empty\n" +
+		"./sub acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:bar 1:1:bar\n" +
+		". 37b51d194a7513e45b56f6524f2d51f2+3 1:2:foo\n"}
+	files, err := m.FileMap()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectEqual(t, len(files), 3)
+	expectEqual(t, len(files["empty"]), 0)
+
+	expectBlockRanges(t, files["foo"], []string{
+		"acbd18db4cc2f85cedef654fccc4a4d8+3 2 1",
+		"37b51d194a7513e45b56f6524f2d51f2+3 0 2",
+		"37b51d194a7513e45b56f6524f2d51f2+3 1 2"})
+	expectBlockRanges(t, files["sub/bar"], []string{
+		"acbd18db4cc2f85cedef654fccc4a4d8+3 0 3",
+		"acbd18db4cc2f85cedef654fccc4a4d8+3 1 1"})
+}
+
+func expectBlockRanges(t *testing.T, actual []BlockRange, expected []string) {
+	var s []string
+	for _, r := range actual {
+		s = append(s, fmt.Sprintf("%s %d %d", r.Block, r.Offset, r.Len))
+	}
+	expectStringSlicesEqual(t, s, expected)
+}
+
+func TestUnescapeName(t *testing.T) {
+	expectEqual(t, UnescapeName("foo\\040bar"), "foo bar")
+	expectEqual(t, UnescapeName("a\\072b\\134c"), "a:b\\c")
+	expectEqual(t, UnescapeName("trailing\\04"), "trailing\\04")
+	expectEqual(t, UnescapeName("not\\999octal"), "not\\999octal")
+}
+
+func TestEscapeName(t *testing.T) {
+	for _, name := range []string{"foo", "foo bar", "a:b\\c", "tab\there", "\x01"} {
+		escaped := EscapeName(name)
+		if strings.ContainsAny(escaped, " :\t\x01") {
+			t.Fatalf("Escaped name %q contains special characters", escaped)
+		}
+		expectEqual(t, UnescapeName(escaped), name)
+	}
+	expectEqual(t, EscapeName("foo bar"), "foo\\040bar")
+}
+
+func TestStreamText(t *testing.T) {
+	line := "./foo\\040bar acbd18db4cc2f85cedef654fccc4a4d8+3+K@qr1hi 37b51d194a7513e45b56f6524f2d51f2+3 0:4:a\\072b 4:2:c"
+	s, err := ParseStream(line)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing stream: %v", err)
+	}
+	expectEqual(t, s.Text(), line+"\n")
+	expectEqual(t, FromStreams([]Stream{s, s}).Text, line+"\n"+line+"\n")
+}
+
+// Blocks for the normalization tests: "foo", "bar" and "baz".
+const (
+	fooBlock = "acbd18db4cc2f85cedef654fccc4a4d8+3"
+	barBlock = "37b51d194a7513e45b56f6524f2d51f2+3"
+	bazBlock = "73feffa4b7f6bb68e44cf984c85f6e88+3"
+)
+
+func expectManifest(t *testing.T, m Manifest, err error, expected string) {
+	if err != nil {
+		t.Fatalf("Unexpected error: %v. %s", err, getStackTrace())
+	}
+	expectEqual(t, m.Text, expected)
+}
+
+func TestNormalize(t *testing.T) {
+	m := Manifest{"./sub " + bazBlock + " 0:3:z\n" +
+		". " + fooBlock + " " + barBlock + " 3:3:b 0:3:a 0:0:empty\n" +
+		". " + barBlock + " " + bazBlock + " 0:6:a\n"}
+	normalized, err := m.Normalize()
+	expectManifest(t, normalized, err, ""+
+		". "+fooBlock+" "+barBlock+" "+bazBlock+" 0:9:a 3:3:b 0:0:empty\n"+
+		"./sub "+bazBlock+" 0:3:z\n")
+
+	// Normalizing again makes no changes.
+	again, err := normalized.Normalize()
+	expectManifest(t, again, err, normalized.Text)
+
+	// A directory holding only empty files gets the empty block.
+	m = Manifest{". " + fooBlock + " 0:3:foo 0:0:dir/empty\n"}
+	normalized, err = m.Normalize()
+	expectManifest(t, normalized, err, ". "+fooBlock+" 0:3:foo\n"+
+		"./dir "+EMPTY_BLOCK_LOCATOR+" 0:0:empty\n")
+
+	m = Manifest{". " + fooBlock + " 0:4:foo\n"}
+	if _, err = m.Normalize(); err == nil {
+		t.Fatalf("Expected an error normalizing an invalid manifest")
+	}
+}
+
+func TestSubset(t *testing.T) {
+	m := Manifest{". " + fooBlock + " 0:3:foo\n" +
+		"./dir " + barBlock + " " + bazBlock + " 0:3:bar 3:3:baz\n" +
+		"./dirx " + bazBlock + " 0:3:baz\n"}
+	subset, err := m.Subset("./dir", "foo")
+	expectManifest(t, subset, err, ""+
+		". "+fooBlock+" 0:3:foo\n"+
+		"./dir "+barBlock+" "+bazBlock+" 0:3:bar 3:3:baz\n")
+
+	subset, err = m.Subset("dir/baz")
+	expectManifest(t, subset, err, "./dir "+bazBlock+" 0:3:baz\n")
+
+	_, err = m.Subset("foo", "di")
+	expectEqual(t, err, PathNotFound)
+}
+
+func TestRename(t *testing.T) {
+	m := Manifest{". " + fooBlock + " 0:3:foo\n" +
+		"./dir " + barBlock + " 0:3:bar\n"}
+	renamed, err := m.Rename("foo", "new dir/foo")
+	expectManifest(t, renamed, err, ""+
+		"./dir "+barBlock+" 0:3:bar\n"+
+		"./new\\040dir "+fooBlock+" 0:3:foo\n")
+
+	renamed, err = m.Rename("./dir", "other")
+	expectManifest(t, renamed, err, ""+
+		". "+fooBlock+" 0:3:foo\n"+
+		"./other "+barBlock+" 0:3:bar\n")
+
+	renamed, err = m.Rename("foo", "dir/sub")
+	expectManifest(t, renamed, err, "./dir "+barBlock+" "+fooBlock+" 0:3:bar 3:3:sub\n")
+
+	_, err = m.Rename("nonexistent", "x")
+	expectEqual(t, err, PathNotFound)
+	for _, newPath := range []string{"dir", "dir/bar", "foo/x", "", "a/../b"} {
+		if _, err = m.Rename("foo", newPath); err == nil {
+			t.Fatalf("Expected an error renaming foo to %q", newPath)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	m1 := Manifest{". " + fooBlock + " 0:3:foo 0:3:both\n"}
+	m2 := Manifest{". " + barBlock + " 0:3:bar 0:3:both\n"}
+	merged, err := Merge(m1, m2)
+	expectManifest(t, merged, err, ". "+barBlock+" "+fooBlock+" 0:3:bar 3:3:both 0:3:both 3:3:foo\n")
+
+	merged, err = Merge(m2, m1)
+	expectManifest(t, merged, err, ". "+barBlock+" "+fooBlock+" 0:3:bar 0:6:both 3:3:foo\n")
+}
+
+func TestExpiresWithin(t *testing.T) {
+	signed := func(expiry time.Time) string {
+		return fooBlock + "+A" + strings.Repeat("1", 40) + fmt.Sprintf("@%08x", expiry.Unix())
+	}
+	soon := Manifest{". " + signed(time.Now().Add(time.Minute)) + " " + barBlock + " 0:6:foo\n" +
+		"./dir " + signed(time.Now().Add(time.Hour)) + " 0:3:bar\n"}
+	expectEqual(t, soon.ExpiresWithin(time.Second), false)
+	expectEqual(t, soon.ExpiresWithin(10*time.Minute), true)
+
+	unsigned := Manifest{". " + fooBlock + " 0:3:foo\n"}
+	expectEqual(t, unsigned.ExpiresWithin(time.Hour), false)
+}
@@ -0,0 +1,226 @@
+/* Builds, normalizes and rearranges manifests. */
+
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The locator of the empty block, used for streams with no data.
+const EMPTY_BLOCK_LOCATOR = "d41d8cd98f00b204e9800998ecf8427e+0"
+
+var PathNotFound = errors.New("Path not found in manifest")
+
+// Encode a stream or file name for use in a manifest: backslash, colon,
+// and whitespace and control characters are written as octal escapes
+// (such as "\040" for a space).
+func EscapeName(s string) string {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '\\' || c == ':' {
+			out = append(out, fmt.Sprintf("\\%03o", c)...)
+		} else {
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
+
+// Return the manifest line for the stream, including the trailing
+// newline.  The stream must have at least one block and one file.
+func (this *Stream) Text() string {
+	tokens := []string{EscapeName(this.Name)}
+	for _, b := range this.Blocks {
+		tokens = append(tokens, b.String())
+	}
+	for _, f := range this.Files {
+		tokens = append(tokens, fmt.Sprintf("%d:%d:%s", f.Pos, f.Len, EscapeName(f.Name)))
+	}
+	return strings.Join(tokens, " ") + "\n"
+}
+
+// Build a manifest from a list of streams, in the order given.
+func FromStreams(streams []Stream) Manifest {
+	var text []string
+	for i := range streams {
+		text = append(text, streams[i].Text())
+	}
+	return Manifest{strings.Join(text, "")}
+}
+
+// Build the streams of a normalized manifest from a file-level view, as
+// returned by FileMap().  This is the same form as the Python SDK's
+// normalized manifests: there is one stream per directory, in order of
+// name, and each file is in the stream for its directory.  Files are in
+// order of name, and adjacent ranges of a file are merged into a single
+// file token.  Each block appears once in its stream, in the order it is
+// first used by the files.
+func NormalizeFiles(files map[string][]BlockRange) []Stream {
+	dirs := make(map[string][]string)
+	for path := range files {
+		dir, name := splitPath(path)
+		dirs[dir] = append(dirs[dir], name)
+	}
+	var dirNames []string
+	for dir := range dirs {
+		dirNames = append(dirNames, dir)
+	}
+	sort.Strings(dirNames)
+
+	var streams []Stream
+	for _, dir := range dirNames {
+		names := dirs[dir]
+		sort.Strings(names)
+		s := Stream{Name: dir}
+
+		// Offset of each block within the stream, by locator
+		blockPos := make(map[string]int64)
+		var size int64
+		for _, name := range names {
+			for _, r := range files[joinPath(dir, name)] {
+				loc := r.Block.String()
+				if _, ok := blockPos[loc]; !ok {
+					blockPos[loc] = size
+					s.Blocks = append(s.Blocks, r.Block)
+					size += int64(r.Block.Size)
+				}
+			}
+		}
+		if len(s.Blocks) == 0 {
+			empty, _ := ParseBlockLocator(EMPTY_BLOCK_LOCATOR)
+			s.Blocks = append(s.Blocks, empty)
+		}
+
+		for _, name := range names {
+			ranges := files[joinPath(dir, name)]
+			if len(ranges) == 0 {
+				s.Files = append(s.Files, FileSegment{0, 0, name})
+				continue
+			}
+			var current *FileSegment
+			for _, r := range ranges {
+				pos := blockPos[r.Block.String()] + r.Offset
+				if current != nil && current.Pos+current.Len == pos {
+					current.Len += r.Len
+					continue
+				}
+				s.Files = append(s.Files, FileSegment{pos, r.Len, name})
+				current = &s.Files[len(s.Files)-1]
+			}
+		}
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// Split a path from FileMap() into the name of the stream for its
+// directory, such as "." or "./foo", and the file name.
+func splitPath(path string) (dir string, name string) {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return "./" + path[:i], path[i+1:]
+	}
+	return ".", path
+}
+
+func joinPath(dir string, name string) string {
+	return strings.TrimPrefix(dir+"/"+name, "./")
+}
+
+// Convert a path within a collection to the form used by FileMap(): no
+// leading "./" or "/", and no "." components.
+func cleanPath(path string) string {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p != "" && p != "." {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Check whether 'path' is the file or directory 'target', or is inside
+// it.  An empty target is the top of the collection.
+func pathWithin(path string, target string) bool {
+	return target == "" || path == target || strings.HasPrefix(path, target+"/")
+}
+
+// Return the normalized form of the manifest.  See NormalizeFiles().
+func (m *Manifest) Normalize() (Manifest, error) {
+	files, err := m.FileMap()
+	if err != nil {
+		return Manifest{}, err
+	}
+	return FromStreams(NormalizeFiles(files)), nil
+}
+
+// Return a normalized manifest containing only the given files and
+// directories (with everything in them).  Returns PathNotFound if one of
+// the paths is not in the manifest.
+func (m *Manifest) Subset(paths ...string) (Manifest, error) {
+	files, err := m.FileMap()
+	if err != nil {
+		return Manifest{}, err
+	}
+	subset := make(map[string][]BlockRange)
+	for _, target := range paths {
+		target = cleanPath(target)
+		found := false
+		for path, ranges := range files {
+			if pathWithin(path, target) {
+				subset[path] = ranges
+				found = true
+			}
+		}
+		if !found {
+			return Manifest{}, PathNotFound
+		}
+	}
+	return FromStreams(NormalizeFiles(subset)), nil
+}
+
+// Return a normalized manifest with the file or directory oldPath moved to
+// newPath.  Returns PathNotFound if oldPath is not in the manifest, and an
+// error if newPath is invalid or already exists.
+func (m *Manifest) Rename(oldPath string, newPath string) (Manifest, error) {
+	files, err := m.FileMap()
+	if err != nil {
+		return Manifest{}, err
+	}
+	oldPath, newPath = cleanPath(oldPath), cleanPath(newPath)
+	if !validPath(newPath) || pathWithin(newPath, oldPath) {
+		return Manifest{}, fmt.Errorf("Cannot rename %q to %q", oldPath, newPath)
+	}
+	renamed := make(map[string][]BlockRange)
+	found := false
+	for path, ranges := range files {
+		if pathWithin(path, oldPath) {
+			path = newPath + strings.TrimPrefix(path, oldPath)
+			found = true
+		}
+		renamed[path] = ranges
+	}
+	if !found {
+		return Manifest{}, PathNotFound
+	}
+	for path := range files {
+		if !pathWithin(path, oldPath) && (pathWithin(path, newPath) || pathWithin(newPath, path)) {
+			return Manifest{}, fmt.Errorf("Cannot rename %q to %q: %q already exists", oldPath, newPath, path)
+		}
+	}
+	return FromStreams(NormalizeFiles(renamed)), nil
+}
+
+// Combine the files in several manifests into one normalized manifest.
+// A file that appears in more than one of them has their contents
+// concatenated, in the order given.
+func Merge(manifests ...Manifest) (Manifest, error) {
+	var text []string
+	for _, m := range manifests {
+		text = append(text, m.Text)
+	}
+	combined := Manifest{strings.Join(text, "\n")}
+	return combined.Normalize()
+}
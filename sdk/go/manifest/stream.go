@@ -0,0 +1,240 @@
+/* Parses manifest streams into blocks and file segments. */
+
+package manifest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A stream from a manifest, with its blocks and file tokens parsed.
+type Stream struct {
+	// Unescaped stream name, such as "." or "./foo bar"
+	Name   string
+	Blocks []BlockLocator
+	Files  []FileSegment
+}
+
+// A file token from a manifest stream: Len bytes of the file called Name,
+// starting at offset Pos in the stream.  Name is unescaped, and may
+// contain "/" if the file is in a subdirectory of the stream.
+type FileSegment struct {
+	Pos  int64
+	Len  int64
+	Name string
+}
+
+// A range of bytes within a single block.
+type BlockRange struct {
+	Block  BlockLocator
+	Offset int64
+	Len    int64
+}
+
+// Describes a problem with a manifest, and where it was found.
+type ParseError struct {
+	// Line number, starting at 1
+	Line int
+
+	// Position of the token within the line, starting at 1, or 0 if the
+	// problem is with the line as a whole
+	Token int
+
+	Msg string
+}
+
+func (this *ParseError) Error() string {
+	where := "Invalid manifest"
+	if this.Line > 0 {
+		where += fmt.Sprintf(" at line %d", this.Line)
+	}
+	if this.Token > 0 {
+		where += fmt.Sprintf(", token %d", this.Token)
+	}
+	return where + ": " + this.Msg
+}
+
+// Return the locator in the form used in manifests.
+func (b BlockLocator) String() string {
+	s := fmt.Sprintf("%s+%d", b.Digest, b.Size)
+	for _, hint := range b.Hints {
+		s += "+" + hint
+	}
+	return s
+}
+
+// Parse all of the streams in the manifest.  Blank lines are skipped.
+// Returns a *ParseError for the first invalid line.
+func (m *Manifest) Streams() ([]Stream, error) {
+	var streams []Stream
+	for i, line := range strings.Split(m.Text, "\n") {
+		if line == "" {
+			continue
+		}
+		s, err := ParseStream(line)
+		if err != nil {
+			err.(*ParseError).Line = i + 1
+			return nil, err
+		}
+		streams = append(streams, s)
+	}
+	return streams, nil
+}
+
+// Map the path of each file in the manifest, such as "foo/bar.txt", to the
+// ranges of blocks which hold its contents, in order.  A file which
+// appears in several streams or file tokens has the ranges from each of
+// them, in the order they appear in the manifest.
+func (m *Manifest) FileMap() (map[string][]BlockRange, error) {
+	streams, err := m.Streams()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]BlockRange)
+	for _, s := range streams {
+		for _, f := range s.Files {
+			path := strings.TrimPrefix(s.Name+"/"+f.Name, "./")
+			files[path] = append(files[path], s.BlockRanges(f.Pos, f.Len)...)
+		}
+	}
+	return files, nil
+}
+
+// Parse a single manifest line, without the trailing newline.  The Line
+// field of a returned *ParseError is 0.
+func ParseStream(line string) (s Stream, err error) {
+	tokens := strings.Split(line, " ")
+	if len(tokens) < 3 {
+		return s, &ParseError{Msg: "Stream must have a name, at least one block, and at least one file"}
+	}
+	for i, token := range tokens {
+		if token == "" {
+			return s, &ParseError{Token: i + 1, Msg: "Empty token"}
+		}
+	}
+
+	s.Name = UnescapeName(tokens[0])
+	if s.Name != "." && (!strings.HasPrefix(s.Name, "./") || !validPath(s.Name[2:])) {
+		return s, &ParseError{Token: 1, Msg: fmt.Sprintf("Invalid stream name %q", tokens[0])}
+	}
+
+	var size int64
+	i := 1
+	for ; i < len(tokens) && LocatorPattern.MatchString(tokens[i]); i++ {
+		b, err := ParseBlockLocator(tokens[i])
+		if err != nil {
+			return s, &ParseError{Token: i + 1, Msg: err.Error()}
+		}
+		s.Blocks = append(s.Blocks, b)
+		size += int64(b.Size)
+	}
+	if len(s.Blocks) == 0 {
+		return s, &ParseError{Token: 2, Msg: fmt.Sprintf("Invalid block locator %q", tokens[1])}
+	}
+	if i == len(tokens) {
+		return s, &ParseError{Msg: "Stream has no files"}
+	}
+
+	for ; i < len(tokens); i++ {
+		f, err := parseFileSegment(tokens[i])
+		if err != nil {
+			if LocatorPattern.MatchString(tokens[i]) {
+				err = fmt.Errorf("Block locator %q after file tokens", tokens[i])
+			}
+			return s, &ParseError{Token: i + 1, Msg: err.Error()}
+		}
+		if f.Pos+f.Len > size {
+			return s, &ParseError{Token: i + 1,
+				Msg: fmt.Sprintf("File segment %q extends past the end of the stream (%d bytes)", tokens[i], size)}
+		}
+		s.Files = append(s.Files, f)
+	}
+	return s, nil
+}
+
+// Parse a "pos:len:name" file token.
+func parseFileSegment(token string) (f FileSegment, err error) {
+	parts := strings.SplitN(token, ":", 3)
+	if len(parts) != 3 {
+		return f, fmt.Errorf("Invalid file token %q", token)
+	}
+	f.Pos, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || f.Pos < 0 {
+		return f, fmt.Errorf("Invalid position in file token %q", token)
+	}
+	f.Len, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || f.Len < 0 {
+		return f, fmt.Errorf("Invalid length in file token %q", token)
+	}
+	f.Name = UnescapeName(parts[2])
+	if !validPath(f.Name) {
+		return f, fmt.Errorf("Invalid file name in file token %q", token)
+	}
+	return f, nil
+}
+
+// Check that a path is non-empty, and has no empty, "." or ".." components.
+func validPath(path string) bool {
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "." || p == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Total size of the stream's blocks.
+func (this *Stream) Size() (size int64) {
+	for _, b := range this.Blocks {
+		size += int64(b.Size)
+	}
+	return
+}
+
+// Map the length bytes starting at offset pos in the stream onto the
+// blocks which hold them.  The range must be within the stream.
+func (this *Stream) BlockRanges(pos int64, length int64) []BlockRange {
+	// Offset of each block within the stream, plus the end of the stream
+	blockStart := make([]int64, len(this.Blocks)+1)
+	for i, b := range this.Blocks {
+		blockStart[i+1] = blockStart[i] + int64(b.Size)
+	}
+
+	// Find the first block containing 'pos', then take as many blocks
+	// as the range spans.
+	i := sort.Search(len(this.Blocks), func(i int) bool {
+		return blockStart[i+1] > pos
+	})
+	var ranges []BlockRange
+	for end := pos + length; pos < end; i++ {
+		rangeEnd := blockStart[i+1]
+		if rangeEnd > end {
+			rangeEnd = end
+		}
+		ranges = append(ranges, BlockRange{this.Blocks[i], pos - blockStart[i], rangeEnd - pos})
+		pos = rangeEnd
+	}
+	return ranges
+}
+
+// Decode the octal escapes (such as "\040" for a space) used in manifest
+// stream and file names.
+func UnescapeName(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
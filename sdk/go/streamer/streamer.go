@@ -26,6 +26,11 @@ Make sure to close the reader when you're done with it.
 When you're done with the stream:
   stream.Close()
 
+To abandon a transfer early, for example because the operation using the
+stream was cancelled, call Cancel() before Close().  Any outstanding or future
+reads on the stream's readers return the given error instead of blocking:
+  stream.Cancel(err)
+
 Alternately, if you already have a filled buffer and just want to read out from it:
   stream := AsyncStreamFromSlice(buf)
 
@@ -45,6 +50,7 @@ type AsyncStream struct {
 	add_reader        chan bool
 	subtract_reader   chan bool
 	wait_zero_readers chan bool
+	cancel            chan error
 }
 
 // Reads from the buffer managed by the Transfer()
@@ -55,7 +61,7 @@ type StreamReader struct {
 }
 
 func AsyncStreamFromReader(buffersize int, source io.Reader) *AsyncStream {
-	t := &AsyncStream{make([]byte, buffersize), make(chan sliceRequest), make(chan bool), make(chan bool), make(chan bool)}
+	t := &AsyncStream{make([]byte, buffersize), make(chan sliceRequest), make(chan bool), make(chan bool), make(chan bool), make(chan error)}
 
 	go t.transfer(source)
 	go t.readersMonitor()
@@ -64,7 +70,7 @@ func AsyncStreamFromReader(buffersize int, source io.Reader) *AsyncStream {
 }
 
 func AsyncStreamFromSlice(buf []byte) *AsyncStream {
-	t := &AsyncStream{buf, make(chan sliceRequest), make(chan bool), make(chan bool), make(chan bool)}
+	t := &AsyncStream{buf, make(chan sliceRequest), make(chan bool), make(chan bool), make(chan bool), make(chan error)}
 
 	go t.transfer(nil)
 	go t.readersMonitor()
@@ -121,6 +127,14 @@ func (this *StreamReader) Close() error {
 	return nil
 }
 
+// Abandon the transfer.  Pending and subsequent reads from any StreamReader
+// return 'err', and the stream stops waiting for data from the source reader.
+// Readers must still be closed, and Close() called, as usual.  Must not be
+// called after Close().
+func (this *AsyncStream) Cancel(err error) {
+	this.cancel <- err
+}
+
 func (this *AsyncStream) Close() {
 	this.wait_zero_readers <- true
 	close(this.requests)
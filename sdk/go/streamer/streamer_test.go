@@ -1,6 +1,7 @@
 package streamer
 
 import (
+	"errors"
 	. "gopkg.in/check.v1"
 	"io"
 	"testing"
@@ -364,3 +365,42 @@ func (s *StandaloneSuite) TestManyReaders(c *C) {
 	writer.Write([]byte("baz"))
 	writer.Close()
 }
+
+func (s *StandaloneSuite) TestCancel(c *C) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+
+	tr := AsyncStreamFromReader(512, reader)
+
+	sr := tr.MakeStreamReader()
+
+	go writer.Write([]byte("foo"))
+
+	p := make([]byte, 10)
+	n, err := sr.Read(p)
+	c.Check(n, Equals, 3)
+	c.Check(err, Equals, nil)
+
+	// A read waiting for more data fails when the stream is cancelled.
+	cancelled := errors.New("cancelled")
+	done := make(chan bool)
+	go func() {
+		n, err := sr.Read(p)
+		c.Check(n, Equals, 0)
+		c.Check(err, Equals, cancelled)
+		done <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tr.Cancel(cancelled)
+	<-done
+
+	// So does every read after that, even of data already buffered.
+	sr2 := tr.MakeStreamReader()
+	n, err = sr2.Read(p)
+	c.Check(n, Equals, 0)
+	c.Check(err, Equals, cancelled)
+
+	sr.Close()
+	sr2.Close()
+	tr.Close()
+}
@@ -35,6 +35,12 @@ offset is beyond end of the body, it responds with EOF.  Otherwise, the read
 request is for a slice beyond the current size of "body" but we expect the body
 to expand as more data is added, so the request gets added to a wait list.
 
+When a message is recieved on the "cancel" channel, sent by
+AsyncStream.Cancel(), the error it carries becomes the reader status, so all
+pending and future read requests are answered with that error.  transfer()
+stops listening on the "slices" channel, and leaves a goroutine to discard
+anything else readIntoBuffer() sends until the source reader returns.
+
 The transfer() runs until the requests channel is closed by AsyncStream.Close()
 
 To track readers, streamer uses the readersMonitor() goroutine.  This goroutine
@@ -221,9 +227,24 @@ func (this *AsyncStream) transfer(source_reader io.Reader) {
 				}
 			} else {
 				// closed 'requests' channel indicates we're done
+				if slices != nil {
+					go discardSlices(slices)
+				}
 				return
 			}
 
+		case err := <-this.cancel:
+			// Transfer abandoned; fail all reads from now on
+			reader_status = err
+			for _, req := range pending_requests {
+				handleReadRequest(req, body, reader_status)
+			}
+			pending_requests = pending_requests[:0]
+			if slices != nil {
+				go discardSlices(slices)
+				slices = nil
+			}
+
 		case bk, valid := <-slices:
 			// Got a new slice from the reader
 			if valid {
@@ -261,6 +282,13 @@ func (this *AsyncStream) transfer(source_reader io.Reader) {
 	}
 }
 
+// Receive and discard slices until readIntoBuffer closes the channel, so that
+// it does not block forever once transfer() has stopped listening.
+func discardSlices(slices <-chan nextSlice) {
+	for _ = range slices {
+	}
+}
+
 func (this *AsyncStream) readersMonitor() {
 	var readers int = 0
 
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/blockdigest"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
 	"git.curoverse.com/arvados.git/sdk/go/logger"
 	"git.curoverse.com/arvados.git/sdk/go/manifest"
 	"git.curoverse.com/arvados.git/sdk/go/util"
@@ -49,6 +50,7 @@ type SdkCollectionInfo struct {
 	Uuid         string    `json:"uuid"`
 	OwnerUuid    string    `json:"owner_uuid"`
 	Redundancy   int       `json:"redundancy"`
+	Replication  int       `json:"replication_desired"`
 	ModifiedAt   time.Time `json:"modified_at"`
 	ManifestText string    `json:"manifest_text"`
 }
@@ -127,12 +129,21 @@ func GetCollections(params GetCollectionsParams) (results ReadCollections) {
 		"uuid",
 		// TODO(misha): Start using the redundancy field.
 		"redundancy",
+		"replication_desired",
 		"modified_at"}
 
-	sdkParams := arvadosclient.Dict{
-		"select":  fieldsWanted,
-		"order":   []string{"modified_at ASC"},
-		"filters": [][]string{[]string{"modified_at", ">=", "1900-01-01T00:00:00Z"}}}
+	sdkParams := arvadosclient.Dict{"select": fieldsWanted}
+
+	// Collections that do not say how many replicas they want get the
+	// API server's default, or keepclient's if the API server does not
+	// say.
+	defaultReplication := keepclient.DEFAULT_REPLICAS
+	if discovery, err := params.Client.Discovery(); err != nil {
+		log.Printf("Error getting discovery document, assuming %d replicas by default: %v",
+			defaultReplication, err)
+	} else if discovery.DefaultCollectionReplication > 0 {
+		defaultReplication = discovery.DefaultCollectionReplication
+	}
 
 	if params.BatchSize > 0 {
 		sdkParams["limit"] = params.BatchSize
@@ -159,39 +170,37 @@ func GetCollections(params GetCollectionsParams) (results ReadCollections) {
 		})
 	}
 
-	// These values are just for getting the loop to run the first time,
-	// afterwards they'll be set to real values.
-	previousTotalCollections := -1
+	// Page through the collections in order of modification time, so
+	// that collections modified while we're reading are not missed.
+	pages := params.Client.Iterate("collections", sdkParams).ByKeyset("modified_at")
 	totalCollections := 0
-	for totalCollections > previousTotalCollections {
-		// We're still finding new collections
-
+	var latestModificationDate string
+	for {
 		// Write the heap profile for examining memory usage
 		WriteHeapProfile()
 
 		// Get next batch of collections.
 		var collections SdkCollectionList
-		err := params.Client.List("collections", sdkParams, &collections)
-		if err != nil {
-			loggerutil.FatalWithMessage(params.Logger,
-				fmt.Sprintf("Error querying collections: %v", err))
+		if !pages.Next(&collections) {
+			break
 		}
 
-		// Process collection and update our date filter.
-		sdkParams["filters"].([][]string)[0][2] =
+		// Process collection and update our date.
+		latestModificationDate =
 			ProcessCollections(params.Logger,
 				collections.Items,
+				defaultReplication,
 				results.UuidToCollection).Format(time.RFC3339)
 
 		// update counts
-		previousTotalCollections = totalCollections
+		previousTotalCollections := totalCollections
 		totalCollections = len(results.UuidToCollection)
 
 		log.Printf("%d collections read, %d new in last batch, "+
 			"%s latest modified date, %.0f %d %d avg,max,total manifest size",
 			totalCollections,
 			totalCollections-previousTotalCollections,
-			sdkParams["filters"].([][]string)[0][2],
+			latestModificationDate,
 			float32(totalManifestSize)/float32(totalCollections),
 			maxManifestSize, totalManifestSize)
 
@@ -199,12 +208,16 @@ func GetCollections(params GetCollectionsParams) (results ReadCollections) {
 			params.Logger.Update(func(p map[string]interface{}, e map[string]interface{}) {
 				collectionInfo := p["collection_info"].(map[string]interface{})
 				collectionInfo["collections_read"] = totalCollections
-				collectionInfo["latest_modified_date_seen"] = sdkParams["filters"].([][]string)[0][2]
+				collectionInfo["latest_modified_date_seen"] = latestModificationDate
 				collectionInfo["total_manifest_size"] = totalManifestSize
 				collectionInfo["max_manifest_size"] = maxManifestSize
 			})
 		}
 	}
+	if err := pages.Err(); err != nil {
+		loggerutil.FatalWithMessage(params.Logger,
+			fmt.Sprintf("Error querying collections: %v", err))
+	}
 
 	// Just in case this lowers the numbers reported in the heap profile.
 	runtime.GC()
@@ -224,13 +237,21 @@ func StrCopy(s string) string {
 
 func ProcessCollections(arvLogger *logger.Logger,
 	receivedCollections []SdkCollectionInfo,
+	defaultReplication int,
 	uuidToCollection map[string]Collection) (latestModificationDate time.Time) {
 	for _, sdkCollection := range receivedCollections {
 		collection := Collection{Uuid: StrCopy(sdkCollection.Uuid),
 			OwnerUuid:         StrCopy(sdkCollection.OwnerUuid),
-			ReplicationLevel:  sdkCollection.Redundancy,
+			ReplicationLevel:  sdkCollection.Replication,
 			BlockDigestToSize: make(map[blockdigest.BlockDigest]int)}
 
+		if collection.ReplicationLevel <= 0 {
+			collection.ReplicationLevel = sdkCollection.Redundancy
+		}
+		if collection.ReplicationLevel <= 0 {
+			collection.ReplicationLevel = defaultReplication
+		}
+
 		if sdkCollection.ModifiedAt.IsZero() {
 			loggerutil.FatalWithMessage(arvLogger,
 				fmt.Sprintf(
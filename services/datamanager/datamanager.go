@@ -15,12 +15,17 @@ import (
 )
 
 var (
+	arvadosSettings     string
 	logEventTypePrefix  string
 	logFrequencySeconds int
 	minutesBetweenRuns  int
 )
 
 func init() {
+	flag.StringVar(&arvadosSettings,
+		"arvados-settings",
+		"",
+		"Path to a settings file giving ARVADOS_API_HOST and ARVADOS_API_TOKEN. If set, the environment is not consulted for these.")
 	flag.StringVar(&logEventTypePrefix,
 		"log-event-type-prefix",
 		"experimental-data-manager",
@@ -51,7 +56,17 @@ func main() {
 }
 
 func singlerun() {
-	arv, err := arvadosclient.MakeArvadosClient()
+	var arv arvadosclient.ArvadosClient
+	var err error
+	if arvadosSettings == "" {
+		arv, err = arvadosclient.MakeArvadosClient()
+	} else {
+		var settings arvadosclient.Settings
+		settings, err = arvadosclient.ReadSettingsFile(arvadosSettings)
+		if err == nil {
+			arv, err = arvadosclient.MakeArvadosClientWithSettings(settings)
+		}
+	}
 	if err != nil {
 		log.Fatalf("Error setting up arvados client %s", err.Error())
 	}
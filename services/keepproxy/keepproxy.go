@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
@@ -32,6 +34,7 @@ func main() {
 		default_replicas int
 		timeout          int64
 		pidfile          string
+		settings_file    string
 	)
 
 	flagset := flag.NewFlagSet("default", flag.ExitOnError)
@@ -59,8 +62,9 @@ func main() {
 	flagset.IntVar(
 		&default_replicas,
 		"default-replicas",
-		2,
-		"Default number of replicas to write if not specified by the client.")
+		0,
+		"Default number of replicas to write if not specified by the client. "+
+			"If 0, use the API server's defaultCollectionReplication.")
 
 	flagset.Int64Var(
 		&timeout,
@@ -74,9 +78,17 @@ func main() {
 		"",
 		"Path to write pid file")
 
+	flagset.StringVar(
+		&settings_file,
+		"arvados-settings",
+		"",
+		"Path to a settings file giving ARVADOS_API_HOST, ARVADOS_API_TOKEN "+
+			"and ARVADOS_API_HOST_INSECURE. If set, the environment is not "+
+			"consulted for these.")
+
 	flagset.Parse(os.Args[1:])
 
-	arv, err := arvadosclient.MakeArvadosClient()
+	arv, err := makeArvadosClient(settings_file)
 	if err != nil {
 		log.Fatalf("Error setting up arvados client %s", err.Error())
 	}
@@ -96,7 +108,9 @@ func main() {
 		defer os.Remove(pidfile)
 	}
 
-	kc.Want_replicas = default_replicas
+	if default_replicas > 0 {
+		kc.Want_replicas = default_replicas
+	}
 
 	kc.Client.Timeout = time.Duration(timeout) * time.Second
 
@@ -105,7 +119,8 @@ func main() {
 		log.Fatalf("Could not listen on %v", listen)
 	}
 
-	go RefreshServicesList(&kc)
+	// Refresh the keep service list every five minutes.
+	kc.RefreshServiceRoots(300 * time.Second)
 
 	// Shut down the server gracefully (by closing the listener)
 	// if SIGTERM is received.
@@ -126,27 +141,25 @@ func main() {
 	log.Println("shutting down")
 }
 
+// Make the client for the API server, with the settings in settings_file
+// if it is given, or from the environment and settings.conf if not.
+func makeArvadosClient(settings_file string) (arvadosclient.ArvadosClient, error) {
+	if settings_file == "" {
+		return arvadosclient.MakeArvadosClient()
+	}
+	settings, err := arvadosclient.ReadSettingsFile(settings_file)
+	if err != nil {
+		return arvadosclient.ArvadosClient{}, err
+	}
+	return arvadosclient.MakeArvadosClientWithSettings(settings)
+}
+
 type ApiTokenCache struct {
 	tokens     map[string]int64
 	lock       sync.Mutex
 	expireTime int64
 }
 
-// Refresh the keep service list every five minutes.
-func RefreshServicesList(kc *keepclient.KeepClient) {
-	for {
-		time.Sleep(300 * time.Second)
-		oldservices := kc.ServiceRoots()
-		kc.DiscoverKeepServers()
-		newservices := kc.ServiceRoots()
-		s1 := fmt.Sprint(oldservices)
-		s2 := fmt.Sprint(newservices)
-		if s1 != s2 {
-			log.Printf("Updated server list to %v", s2)
-		}
-	}
-}
-
 // Cache the token and set an expire time.  If we already have an expire time
 // on the token, it is not updated.
 func (this *ApiTokenCache) RememberToken(token string) {
@@ -229,6 +242,11 @@ type PutBlockHandler struct {
 	*ApiTokenCache
 }
 
+type ExistsHandler struct {
+	*keepclient.KeepClient
+	*ApiTokenCache
+}
+
 type InvalidPathHandler struct{}
 
 type OptionsHandler struct{}
@@ -250,6 +268,7 @@ func MakeRESTRouter(
 		rest.Handle(`/{hash:[0-9a-f]{32}}+{hints}`,
 			GetBlockHandler{kc, t}).Methods("GET", "HEAD")
 		rest.Handle(`/{hash:[0-9a-f]{32}}`, GetBlockHandler{kc, t}).Methods("GET", "HEAD")
+		rest.Handle(`/exists`, ExistsHandler{kc, t}).Methods("POST")
 	}
 
 	if enable_put {
@@ -325,8 +344,8 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	}
 
 	var status = 0
-	switch err {
-	case nil:
+	switch {
+	case err == nil:
 		status = http.StatusOK
 		resp.Header().Set("Content-Length", fmt.Sprint(blocklen))
 		if reader != nil {
@@ -344,9 +363,15 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 		} else {
 			log.Printf("%s: %s %s %v 0", GetRemoteAddress(req), req.Method, hash, status)
 		}
-	case keepclient.BlockNotFound:
+	case keepclient.IsNotFound(err):
 		status = http.StatusNotFound
 		http.Error(resp, "Not Found", http.StatusNotFound)
+	case keepclient.IsPermissionDenied(err):
+		status = http.StatusForbidden
+		http.Error(resp, err.Error(), http.StatusForbidden)
+	case keepclient.IsTemporary(err):
+		status = http.StatusServiceUnavailable
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
 	default:
 		status = http.StatusBadGateway
 		http.Error(resp, err.Error(), http.StatusBadGateway)
@@ -358,6 +383,59 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	}
 }
 
+// ExistsHandler passes a batch existence check (a JSON list of
+// locators) on to the Keep servers, and responds with their answers in
+// the same form as a Keep server's /exists.
+func (this ExistsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	SetCorsHeaders(resp)
+
+	kc := *this.KeepClient
+
+	if req.ContentLength > keepclient.MAX_EXISTS_REQUEST_SIZE {
+		http.Error(resp, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var locators []string
+	r := json.NewDecoder(http.MaxBytesReader(resp, req.Body, keepclient.MAX_EXISTS_REQUEST_SIZE))
+	if err := r.Decode(&locators); err != nil {
+		http.Error(resp, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if len(locators) > keepclient.MAX_EXISTS_LOCATORS {
+		http.Error(resp, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	log.Printf("%s: %s %s begin (%d locators)", GetRemoteAddress(req), req.Method, req.URL.Path, len(locators))
+
+	var pass bool
+	var tok string
+	if pass, tok = CheckAuthorizationHeader(kc, this.ApiTokenCache, req); !pass {
+		http.Error(resp, "Missing or invalid Authorization header", http.StatusForbidden)
+		return
+	}
+
+	// Copy ArvadosClient struct and use the client's API token
+	arvclient := *kc.Arvados
+	arvclient.ApiToken = tok
+	kc.Arvados = &arvclient
+
+	results, err := kc.AskMany(locators)
+	if err != nil {
+		log.Printf("%s: %s %s %v error: %v",
+			GetRemoteAddress(req), req.Method, req.URL.Path, http.StatusBadGateway, err.Error())
+		http.Error(resp, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if body, err := json.Marshal(results); err == nil {
+		resp.Write(body)
+		log.Printf("%s: %s %s %v", GetRemoteAddress(req), req.Method, req.URL.Path, http.StatusOK)
+	} else {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	SetCorsHeaders(resp)
 
@@ -429,8 +507,8 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 	// Tell the client how many successful PUTs we accomplished
 	resp.Header().Set(keepclient.X_Keep_Replicas_Stored, fmt.Sprintf("%d", replicas))
 
-	switch put_err {
-	case nil:
+	switch {
+	case put_err == nil:
 		// Default will return http.StatusOK
 		log.Printf("%s: %s %s finished, stored %v replicas (desired %v)", GetRemoteAddress(req), req.Method, hash, replicas, kc.Want_replicas)
 		n, err2 := io.WriteString(resp, hash)
@@ -438,11 +516,11 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 			log.Printf("%s: wrote %v bytes to response body and got error %v", n, err2.Error())
 		}
 
-	case keepclient.OversizeBlockError:
+	case put_err == keepclient.OversizeBlockError:
 		// Too much data
 		http.Error(resp, fmt.Sprintf("Exceeded maximum blocksize %d", keepclient.BLOCKSIZE), http.StatusRequestEntityTooLarge)
 
-	case keepclient.InsufficientReplicasError:
+	case errors.Is(put_err, keepclient.InsufficientReplicasError):
 		if replicas > 0 {
 			// At least one write is considered success.  The
 			// client can decide if getting less than the number of
@@ -452,6 +530,8 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 			if err2 != nil {
 				log.Printf("%s: wrote %v bytes to response body and got error %v", n, err2.Error())
 			}
+		} else if keepclient.IsPermissionDenied(put_err) {
+			http.Error(resp, put_err.Error(), http.StatusForbidden)
 		} else {
 			http.Error(resp, put_err.Error(), http.StatusServiceUnavailable)
 		}
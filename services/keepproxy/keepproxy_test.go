@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/md5"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
@@ -168,14 +169,16 @@ func (s *ServerRequiredSuite) TestPutAskGet(c *C) {
 
 	{
 		_, _, err := kc.Ask(hash)
-		c.Check(err, Equals, keepclient.BlockNotFound)
+		c.Check(errors.Is(err, keepclient.BlockNotFound), Equals, true)
+		c.Check(keepclient.IsNotFound(err), Equals, true)
 		log.Print("Finished Ask (expected BlockNotFound)")
 	}
 
 	{
 		reader, _, _, err := kc.Get(hash)
 		c.Check(reader, Equals, nil)
-		c.Check(err, Equals, keepclient.BlockNotFound)
+		c.Check(errors.Is(err, keepclient.BlockNotFound), Equals, true)
+		c.Check(keepclient.IsNotFound(err), Equals, true)
 		log.Print("Finished Get (expected BlockNotFound)")
 	}
 
@@ -205,6 +208,15 @@ func (s *ServerRequiredSuite) TestPutAskGet(c *C) {
 		log.Print("Finished Ask (expected success)")
 	}
 
+	{
+		results, err := kc.AskMany([]string{hash2, fmt.Sprintf("%x", md5.Sum([]byte("bar")))})
+		c.Assert(err, Equals, nil)
+		c.Check(results[0].Exists, Equals, true)
+		c.Check(results[0].Size, Equals, int64(3))
+		c.Check(results[1].Exists, Equals, false)
+		log.Print("Finished AskMany (expected one found)")
+	}
+
 	{
 		reader, blocklen, _, err := kc.Get(hash2)
 		c.Assert(err, Equals, nil)
@@ -247,7 +259,7 @@ func (s *ServerRequiredSuite) TestPutAskGetForbidden(c *C) {
 
 	{
 		_, _, err := kc.Ask(hash)
-		c.Check(err, Equals, keepclient.BlockNotFound)
+		c.Check(errors.Is(err, keepclient.BlockNotFound), Equals, true)
 		log.Print("Ask 1")
 	}
 
@@ -255,20 +267,21 @@ func (s *ServerRequiredSuite) TestPutAskGetForbidden(c *C) {
 		hash2, rep, err := kc.PutB([]byte("bar"))
 		c.Check(hash2, Equals, "")
 		c.Check(rep, Equals, 0)
-		c.Check(err, Equals, keepclient.InsufficientReplicasError)
+		c.Check(errors.Is(err, keepclient.InsufficientReplicasError), Equals, true)
 		log.Print("PutB")
 	}
 
 	{
 		blocklen, _, err := kc.Ask(hash)
-		c.Assert(err, Equals, keepclient.BlockNotFound)
+		c.Assert(errors.Is(err, keepclient.BlockNotFound), Equals, true)
 		c.Check(blocklen, Equals, int64(0))
 		log.Print("Ask 2")
 	}
 
 	{
 		_, blocklen, _, err := kc.Get(hash)
-		c.Assert(err, Equals, keepclient.BlockNotFound)
+		c.Assert(errors.Is(err, keepclient.BlockNotFound), Equals, true)
+		c.Check(keepclient.IsPermissionDenied(err), Equals, true)
 		c.Check(blocklen, Equals, int64(0))
 		log.Print("Get")
 	}
@@ -287,7 +300,7 @@ func (s *ServerRequiredSuite) TestGetDisabled(c *C) {
 
 	{
 		_, _, err := kc.Ask(hash)
-		c.Check(err, Equals, keepclient.BlockNotFound)
+		c.Check(errors.Is(err, keepclient.BlockNotFound), Equals, true)
 		log.Print("Ask 1")
 	}
 
@@ -301,14 +314,14 @@ func (s *ServerRequiredSuite) TestGetDisabled(c *C) {
 
 	{
 		blocklen, _, err := kc.Ask(hash)
-		c.Assert(err, Equals, keepclient.BlockNotFound)
+		c.Assert(errors.Is(err, keepclient.BlockNotFound), Equals, true)
 		c.Check(blocklen, Equals, int64(0))
 		log.Print("Ask 2")
 	}
 
 	{
 		_, blocklen, _, err := kc.Get(hash)
-		c.Assert(err, Equals, keepclient.BlockNotFound)
+		c.Assert(errors.Is(err, keepclient.BlockNotFound), Equals, true)
 		c.Check(blocklen, Equals, int64(0))
 		log.Print("Get")
 	}
@@ -327,7 +340,7 @@ func (s *ServerRequiredSuite) TestPutDisabled(c *C) {
 		hash2, rep, err := kc.PutB([]byte("quux"))
 		c.Check(hash2, Equals, "")
 		c.Check(rep, Equals, 0)
-		c.Check(err, Equals, keepclient.InsufficientReplicasError)
+		c.Check(errors.Is(err, keepclient.InsufficientReplicasError), Equals, true)
 		log.Print("PutB")
 	}
 
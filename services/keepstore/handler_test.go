@@ -3,6 +3,7 @@
 //     GetBlockHandler
 //     PutBlockHandler
 //     IndexHandler
+//     ExistsHandler
 //
 // The HTTP handlers are responsible for enforcing permission policy,
 // so these tests must exercise all possible permission permutations.
@@ -13,6 +14,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -88,6 +90,24 @@ func TestGetHandler(t *testing.T) {
 		t.Errorf("expected Content-Length %s, got %s", expected_cl, received_cl)
 	}
 
+	// Unauthenticated request, locator with hints keepstore does not
+	// interpret
+	// => OK
+	for _, hints := range []string{
+		"+K@zzzzz.example:25107",
+		"+K",
+		"+Afoo",
+		fmt.Sprintf("+K@zzzzz+%d", len(TEST_BLOCK)),
+	} {
+		response = IssueRequest(
+			&RequestTester{
+				method: "GET",
+				uri:    unsigned_locator + hints,
+			})
+		ExpectStatusCode(t,
+			"Unauthenticated request, hints "+hints, http.StatusOK, response)
+	}
+
 	// ----------------
 	// Permissions: on.
 	enforce_permissions = true
@@ -141,6 +161,116 @@ func TestGetHandler(t *testing.T) {
 		ExpiredError.HTTPCode, response)
 }
 
+// Test ExistsHandler on the following situations:
+//   - permissions off, unsigned locators, some present and some not
+//   - permissions on, signed, unsigned and expired locators
+//   - malformed locators and request bodies
+//
+func TestExistsHandler(t *testing.T) {
+	defer teardown()
+
+	// Store TEST_BLOCK on both volumes and TEST_BLOCK_2 on one.
+	KeepVM = MakeTestVolumeManager(2)
+	defer KeepVM.Quit()
+
+	vols := KeepVM.Volumes()
+	vols[0].Put(TEST_HASH, TEST_BLOCK)
+	vols[1].Put(TEST_HASH, TEST_BLOCK)
+	vols[1].Put(TEST_HASH_2, TEST_BLOCK_2)
+	mtime, _ := vols[1].Mtime(TEST_HASH)
+	mtime2, _ := vols[1].Mtime(TEST_HASH_2)
+
+	PermissionSecret = []byte(known_key)
+	permission_ttl = time.Duration(300) * time.Second
+
+	var (
+		valid_timestamp   = time.Now().Add(permission_ttl)
+		expired_timestamp = time.Now().Add(-time.Hour)
+		signed_locator    = SignLocator(TEST_HASH+"+44", known_token, valid_timestamp)
+		signed_locator_3  = SignLocator(TEST_HASH_3, known_token, valid_timestamp)
+		expired_locator   = SignLocator(TEST_HASH_2, known_token, expired_timestamp)
+	)
+
+	checkExists := func(testname string, api_token string, locators []string, expected []BlockExistence) {
+		body, _ := json.Marshal(locators)
+		response := IssueRequest(&RequestTester{
+			method:       "POST",
+			uri:          "/exists",
+			api_token:    api_token,
+			request_body: body,
+		})
+		ExpectStatusCode(t, testname, http.StatusOK, response)
+		var result []BlockExistence
+		if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+			t.Errorf("%s: json.Unmarshal: %s", testname, err)
+			return
+		}
+		if len(result) != len(expected) {
+			t.Errorf("%s: expected %d results, got %+v", testname, len(expected), result)
+			return
+		}
+		for i := range expected {
+			if result[i] != expected[i] {
+				t.Errorf("%s: result %d: expected %+v, got %+v", testname, i, expected[i], result[i])
+			}
+		}
+	}
+
+	// Permissions off: unsigned locators are accepted.
+	checkExists("Permissions off", "",
+		[]string{TEST_HASH, TEST_HASH_2 + "+40", TEST_HASH_3, "foo"},
+		[]BlockExistence{
+			{Locator: TEST_HASH, Exists: true, Size: 44, Mtime: mtime.Unix()},
+			{Locator: TEST_HASH_2 + "+40", Exists: true, Size: 40, Mtime: mtime2.Unix()},
+			{Locator: TEST_HASH_3, Exists: false},
+			{Locator: "foo", Exists: false, Error: BadRequestError.Error()},
+		})
+
+	// Permissions on: only valid signatures are accepted.
+	enforce_permissions = true
+	checkExists("Permissions on", known_token,
+		[]string{signed_locator, TEST_HASH, expired_locator, signed_locator_3},
+		[]BlockExistence{
+			{Locator: signed_locator, Exists: true, Size: 44, Mtime: mtime.Unix()},
+			{Locator: TEST_HASH, Exists: false, Error: PermissionError.Error()},
+			{Locator: expired_locator, Exists: false, Error: ExpiredError.Error()},
+			{Locator: signed_locator_3, Exists: false},
+		})
+	checkExists("Permissions on, wrong token", "bogus_token",
+		[]string{signed_locator},
+		[]BlockExistence{
+			{Locator: signed_locator, Exists: false, Error: PermissionError.Error()},
+		})
+
+	// Malformed request body => BadRequestError
+	response := IssueRequest(&RequestTester{
+		method:       "POST",
+		uri:          "/exists",
+		request_body: []byte(`{ "key":"I'm a little teapot" }`),
+	})
+	ExpectStatusCode(t, "Malformed request body", BadRequestError.HTTPCode, response)
+
+	// Too many locators, or too large a body => TooLargeError
+	tooMany := make([]string, keepclient.MAX_EXISTS_LOCATORS+1)
+	for i := range tooMany {
+		tooMany[i] = TEST_HASH
+	}
+	body, _ := json.Marshal(tooMany)
+	response = IssueRequest(&RequestTester{
+		method:       "POST",
+		uri:          "/exists",
+		request_body: body,
+	})
+	ExpectStatusCode(t, "Too many locators", TooLargeError.HTTPCode, response)
+
+	response = IssueRequest(&RequestTester{
+		method:       "POST",
+		uri:          "/exists",
+		request_body: bytes.Repeat([]byte(" "), keepclient.MAX_EXISTS_REQUEST_SIZE+1),
+	})
+	ExpectStatusCode(t, "Request body too large", TooLargeError.HTTPCode, response)
+}
+
 // Test PutBlockHandler on the following situations:
 //   - no server key
 //   - with server key, authenticated request, unsigned locator
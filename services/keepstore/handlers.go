@@ -6,6 +6,8 @@ package main
 // PutBlockHandler (PUT /locator)
 // IndexHandler    (GET /index, GET /index/prefix)
 // StatusHandler   (GET /status.json)
+// PullStatusHandler (GET /pull)
+// ExistsHandler   (POST /exists)
 
 import (
 	"bufio"
@@ -14,6 +16,8 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/locator"
 	"github.com/gorilla/mux"
 	"io"
 	"log"
@@ -59,6 +63,10 @@ func MakeRESTRouter() *mux.Router {
 		`/index/{prefix:[0-9a-f]{0,32}}`, IndexHandler).Methods("GET", "HEAD")
 	rest.HandleFunc(`/status.json`, StatusHandler).Methods("GET", "HEAD")
 
+	// ExistsHandler reports which of a list of blocks are stored
+	// on this server, without retrieving them.
+	rest.HandleFunc(`/exists`, ExistsHandler).Methods("POST")
+
 	// The PullHandler and TrashHandler process "PUT /pull" and "PUT
 	// /trash" requests from Data Manager.  These requests instruct
 	// Keep to replicate or delete blocks; see
@@ -70,6 +78,7 @@ func MakeRESTRouter() *mux.Router {
 	// trash queue with their contentes.
 	//
 	rest.HandleFunc(`/pull`, PullHandler).Methods("PUT")
+	rest.HandleFunc(`/pull`, PullStatusHandler).Methods("GET", "HEAD")
 	rest.HandleFunc(`/trash`, TrashHandler).Methods("PUT")
 
 	// Any request which does not match any of these routes gets
@@ -118,46 +127,13 @@ func FindKeepVolumes() []string {
 func GetBlockHandler(resp http.ResponseWriter, req *http.Request) {
 	hash := mux.Vars(req)["hash"]
 
-	hints := mux.Vars(req)["hints"]
-
-	// Parse the locator string and hints from the request.
-	// TODO(twp): implement a Locator type.
-	var signature, timestamp string
-	if hints != "" {
-		signature_pat, _ := regexp.Compile("^A([[:xdigit:]]+)@([[:xdigit:]]{8})$")
-		for _, hint := range strings.Split(hints, "+") {
-			if match, _ := regexp.MatchString("^[[:digit:]]+$", hint); match {
-				// Server ignores size hints
-			} else if m := signature_pat.FindStringSubmatch(hint); m != nil {
-				signature = m[1]
-				timestamp = m[2]
-			} else if match, _ := regexp.MatchString("^[[:upper:]]", hint); match {
-				// Any unknown hint that starts with an uppercase letter is
-				// presumed to be valid and ignored, to permit forward compatibility.
-			} else {
-				// Unknown format; not a valid locator.
-				http.Error(resp, BadRequestError.Error(), BadRequestError.HTTPCode)
-				return
-			}
-		}
-	}
-
-	// If permission checking is in effect, verify this
-	// request's permission signature.
-	if enforce_permissions {
-		if signature == "" || timestamp == "" {
-			http.Error(resp, PermissionError.Error(), PermissionError.HTTPCode)
-			return
-		} else if IsExpired(timestamp) {
-			http.Error(resp, ExpiredError.Error(), ExpiredError.HTTPCode)
-			return
-		} else {
-			req_locator := req.URL.Path[1:] // strip leading slash
-			if !VerifySignature(req_locator, GetApiToken(req)) {
-				http.Error(resp, PermissionError.Error(), PermissionError.HTTPCode)
-				return
-			}
-		}
+	// Parse the locator string and hints from the request, and
+	// check its permission signature if necessary.
+	req_locator := req.URL.Path[1:] // strip leading slash
+	if err := CheckLocatorPermission(req_locator, GetApiToken(req)); err != nil {
+		ke := err.(*KeepError)
+		http.Error(resp, ke.Error(), ke.HTTPCode)
+		return
 	}
 
 	block, err := GetBlock(hash, false)
@@ -222,6 +198,35 @@ func PutBlockHandler(resp http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// CheckLocatorPermission parses the hints in a locator of the form
+// hash+hint+hint... and, if permission checking is in effect,
+// verifies the locator's permission signature for api_token.
+//
+// Returns nil if the locator may be read. Otherwise returns
+// BadRequestError if the locator has a malformed hint,
+// PermissionError if the signature is missing or invalid, or
+// ExpiredError if the signature has expired.
+//
+func CheckLocatorPermission(signed_locator string, api_token string) error {
+	loc, err := locator.Parse(signed_locator)
+	if err != nil {
+		return BadRequestError
+	}
+
+	// If permission checking is in effect, verify this
+	// locator's permission signature.
+	if enforce_permissions {
+		switch loc.Verify(PermissionSecret, api_token) {
+		case nil:
+		case locator.SignatureExpired:
+			return ExpiredError
+		default:
+			return PermissionError
+		}
+	}
+	return nil
+}
+
 // IndexHandler
 //     A HandleFunc to address /index and /index/{prefix} requests.
 //
@@ -241,6 +246,81 @@ func IndexHandler(resp http.ResponseWriter, req *http.Request) {
 	resp.Write([]byte(index))
 }
 
+// ExistsHandler processes "POST /exists" requests. The request body
+// is a JSON list of block locators, e.g.:
+//
+//   [
+//      "e4d909c290d0fb1ca068ffaddf22cbd0+44+A...@...",
+//      "55ae4d45d2db0793d53f03e805f656e5+658395+A...@..."
+//   ]
+//
+// When permissions are enforced, each locator must carry a valid
+// permission signature for the request's API token.
+//
+// The response is a JSON list with one entry for each locator, in the
+// same order:
+//
+//   [
+//      {"locator":"e4d909c2...","exists":true,"size":44,"mtime":1388894303},
+//      {"locator":"55ae4d45...","exists":false,"error":"Forbidden"}
+//   ]
+//
+// "size" and "mtime" are given only for blocks that exist. "mtime" is
+// the most recent modification time (in seconds since the Unix epoch)
+// of any copy of the block on this server. "error" is given when the
+// locator is malformed or its permission signature is not valid, in
+// which case "exists" is always false.
+//
+// If the request body cannot be parsed, return 400 Bad Request.  If it
+// is larger than keepclient.MAX_EXISTS_REQUEST_SIZE bytes or lists
+// more than keepclient.MAX_EXISTS_LOCATORS locators, return 413
+// Request Entity Too Large.
+//
+type BlockExistence struct {
+	Locator string `json:"locator"`
+	Exists  bool   `json:"exists"`
+	Size    int64  `json:"size,omitempty"`
+	Mtime   int64  `json:"mtime,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func ExistsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > keepclient.MAX_EXISTS_REQUEST_SIZE {
+		http.Error(resp, TooLargeError.Error(), TooLargeError.HTTPCode)
+		return
+	}
+	var locators []string
+	r := json.NewDecoder(http.MaxBytesReader(resp, req.Body, keepclient.MAX_EXISTS_REQUEST_SIZE))
+	if err := r.Decode(&locators); err != nil {
+		http.Error(resp, BadRequestError.Error(), BadRequestError.HTTPCode)
+		return
+	}
+	if len(locators) > keepclient.MAX_EXISTS_LOCATORS {
+		http.Error(resp, TooLargeError.Error(), TooLargeError.HTTPCode)
+		return
+	}
+
+	api_token := GetApiToken(req)
+	result := make([]BlockExistence, len(locators))
+	for i, loc := range locators {
+		result[i].Locator = loc
+		if !IsValidLocator(LocatorHash(loc)) {
+			result[i].Error = BadRequestError.Error()
+		} else if err := CheckLocatorPermission(loc, api_token); err != nil {
+			result[i].Error = err.Error()
+		} else {
+			result[i].Exists, result[i].Size, result[i].Mtime = GetBlockExistence(LocatorHash(loc))
+		}
+	}
+
+	if body, err := json.Marshal(result); err == nil {
+		resp.Write(body)
+	} else {
+		log.Printf("json.Marshal: %s\n", err)
+		http.Error(resp, err.Error(), 500)
+	}
+}
+
 // StatusHandler
 //     Responds to /status.json requests with the current node status,
 //     described in a JSON structure.
@@ -252,16 +332,33 @@ func IndexHandler(resp http.ResponseWriter, req *http.Request) {
 //            * device_num (an integer identifying the underlying filesystem)
 //            * bytes_free
 //            * bytes_used
+//            * degraded (true if the volume has failed its health checks)
+//            * recent_errors (I/O errors since the last health check)
+//            * last_error
+//            * last_health_check (a Unix timestamp)
+//        pull_queue - the progress of the pull workers through the
+//          current pull list, an object with the following fields:
+//            * queued
+//            * in_progress
+//            * completed
+//        trash_queue - the progress through the current trash list,
+//          in the same format as pull_queue
 //
 type VolumeStatus struct {
-	MountPoint string `json:"mount_point"`
-	DeviceNum  uint64 `json:"device_num"`
-	BytesFree  uint64 `json:"bytes_free"`
-	BytesUsed  uint64 `json:"bytes_used"`
+	MountPoint      string `json:"mount_point"`
+	DeviceNum       uint64 `json:"device_num"`
+	BytesFree       uint64 `json:"bytes_free"`
+	BytesUsed       uint64 `json:"bytes_used"`
+	Degraded        bool   `json:"degraded"`
+	RecentErrors    int    `json:"recent_errors"`
+	LastError       string `json:"last_error,omitempty"`
+	LastHealthCheck int64  `json:"last_health_check,omitempty"`
 }
 
 type NodeStatus struct {
-	Volumes []*VolumeStatus `json:"volumes"`
+	Volumes    []*VolumeStatus `json:"volumes"`
+	PullQueue  WorkQueueStatus `json:"pull_queue"`
+	TrashQueue WorkQueueStatus `json:"trash_queue"`
 }
 
 func StatusHandler(resp http.ResponseWriter, req *http.Request) {
@@ -285,6 +382,15 @@ func GetNodeStatus() *NodeStatus {
 	st.Volumes = make([]*VolumeStatus, len(KeepVM.Volumes()))
 	for i, vol := range KeepVM.Volumes() {
 		st.Volumes[i] = vol.Status()
+		if st.Volumes[i] != nil {
+			KeepVM.Health(vol).UpdateStatus(st.Volumes[i])
+		}
+	}
+	if pullq != nil {
+		st.PullQueue = pullq.Status()
+	}
+	if trashq != nil {
+		st.TrashQueue = trashq.Status()
 	}
 	return st
 }
@@ -313,7 +419,12 @@ func GetVolumeStatus(volume string) *VolumeStatus {
 	// uses fs.Blocks - fs.Bfree.
 	free := fs.Bavail * uint64(fs.Bsize)
 	used := (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
-	return &VolumeStatus{volume, devnum, free, used}
+	return &VolumeStatus{
+		MountPoint: volume,
+		DeviceNum:  devnum,
+		BytesFree:  free,
+		BytesUsed:  used,
+	}
 }
 
 // DeleteHandler processes DELETE requests.
@@ -432,6 +543,10 @@ func DeleteHandler(resp http.ResponseWriter, req *http.Request) {
 type PullRequest struct {
 	Locator string   `json:"locator"`
 	Servers []string `json:"servers"`
+
+	// The generation of the journaled list the request came from,
+	// or zero if the list was not journaled.
+	journalGeneration uint64
 }
 
 func PullHandler(resp http.ResponseWriter, req *http.Request) {
@@ -456,8 +571,19 @@ func PullHandler(resp http.ResponseWriter, req *http.Request) {
 	resp.Write([]byte(
 		fmt.Sprintf("Received %d pull requests\n", len(pr))))
 
+	// Save the list before queueing it, so that each request can
+	// carry the journal generation under which it is marked done.
+	var generation uint64
+	if pullJournal != nil {
+		var err error
+		if generation, err = pullJournal.Save(pr); err != nil {
+			log.Printf("PullHandler: saving pull list: %s\n", err)
+		}
+	}
+
 	plist := list.New()
 	for _, p := range pr {
+		p.journalGeneration = generation
 		plist.PushBack(p)
 	}
 
@@ -467,6 +593,36 @@ func PullHandler(resp http.ResponseWriter, req *http.Request) {
 	pullq.ReplaceQueue(plist)
 }
 
+// PullStatusHandler responds to "GET /pull" requests from the data
+// manager with a JSON description of the pull workers' activity:
+//
+//   {
+//      "queued":12,
+//      "in_progress":[{"locator":"...","servers":[...]}, ...],
+//      "recent_successes":[{"locator":"...","attempts":1,"finished_at":"..."}, ...],
+//      "recent_failures":[{"locator":"...","attempts":3,"error":"...","finished_at":"..."}, ...]
+//   }
+//
+// If the request has not been sent by the Data Manager, return 401
+// Unauthorized.
+//
+func PullStatusHandler(resp http.ResponseWriter, req *http.Request) {
+	// Reject unauthorized requests.
+	if !IsDataManagerToken(GetApiToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+
+	st := pullStatus.Status(pullq)
+	if jstat, err := json.Marshal(st); err == nil {
+		resp.Write(jstat)
+	} else {
+		log.Printf("json.Marshal: %s\n", err)
+		log.Printf("PullStatus = %v\n", st)
+		http.Error(resp, err.Error(), 500)
+	}
+}
+
 type TrashRequest struct {
 	Locator    string `json:"locator"`
 	BlockMtime int64  `json:"block_mtime"`
@@ -499,6 +655,12 @@ func TrashHandler(resp http.ResponseWriter, req *http.Request) {
 		tlist.PushBack(t)
 	}
 
+	if trashJournal != nil {
+		if _, err := trashJournal.Save(trash); err != nil {
+			log.Printf("TrashHandler: saving trash list: %s\n", err)
+		}
+	}
+
 	if trashq == nil {
 		trashq = NewWorkQueue()
 	}
@@ -534,10 +696,13 @@ func TrashHandler(resp http.ResponseWriter, req *http.Request) {
 
 func GetBlock(hash string, update_timestamp bool) ([]byte, error) {
 	// Attempt to read the requested hash from a keep volume.
+	// Degraded volumes are tried last.
 	error_to_caller := NotFoundError
 
-	for _, vol := range KeepVM.Volumes() {
-		if buf, err := vol.Get(hash); err != nil {
+	for _, vol := range KeepVM.ReadableVolumes() {
+		buf, err := vol.Get(hash)
+		KeepVM.Health(vol).Record(err)
+		if err != nil {
 			// IsNotExist is an expected error and may be ignored.
 			// (If all volumes report IsNotExist, we return a NotFoundError)
 			// All other errors should be logged but we continue trying to
@@ -560,6 +725,7 @@ func GetBlock(hash string, update_timestamp bool) ([]byte, error) {
 				//
 				log.Printf("%s: checksum mismatch for request %s (actual %s)\n",
 					vol, hash, filehash)
+				KeepVM.Health(vol).Record(DiskHashError)
 				error_to_caller = DiskHashError
 			} else {
 				// Success!
@@ -586,6 +752,26 @@ func GetBlock(hash string, update_timestamp bool) ([]byte, error) {
 	return nil, error_to_caller
 }
 
+// GetBlockExistence reports whether the block identified by "hash"
+// is stored on any volume, and if so, its size and the most recent
+// modification time of any copy (in seconds since the Unix epoch).
+// Unlike GetBlock, it does not read the block or verify its checksum.
+//
+func GetBlockExistence(hash string) (exists bool, size int64, mtime int64) {
+	for _, vol := range KeepVM.Volumes() {
+		if sz, t, err := vol.Stat(hash); err == nil {
+			exists = true
+			size = sz
+			if t.Unix() > mtime {
+				mtime = t.Unix()
+			}
+		} else if !os.IsNotExist(err) {
+			log.Printf("GetBlockExistence: %s: stat %s: %s\n", vol, hash, err)
+		}
+	}
+	return
+}
+
 /* PutBlock(block, hash)
    Stores the BLOCK (identified by the content id HASH) in Keep.
 
@@ -606,6 +792,9 @@ func GetBlock(hash string, update_timestamp bool) ([]byte, error) {
    503 Full
           There was not enough space left in any Keep volume to store
           the object.
+   503 No healthy volumes
+          Every Keep volume has been marked degraded by the health
+          checks.
    500 Fail
           The object could not be stored for some other reason (e.g.
           all writes failed). The text of the error message should
@@ -637,14 +826,22 @@ func PutBlock(block []byte, hash string) error {
 	}
 
 	// Choose a Keep volume to write to.
-	// If this volume fails, try all of the volumes in order.
+	// If this volume fails, try all of the healthy volumes in order.
+	// Degraded volumes are never written to.
 	vol := KeepVM.Choose()
-	if err := vol.Put(hash, block); err == nil {
+	if vol == nil {
+		log.Printf("all Keep volumes degraded")
+		return UnhealthyError
+	}
+	err := vol.Put(hash, block)
+	KeepVM.Health(vol).Record(err)
+	if err == nil {
 		return nil // success!
 	} else {
 		allFull := true
-		for _, vol := range KeepVM.Volumes() {
+		for _, vol := range KeepVM.WritableVolumes() {
 			err := vol.Put(hash, block)
+			KeepVM.Health(vol).Record(err)
 			if err == nil {
 				return nil // success!
 			}
@@ -680,6 +877,13 @@ func IsValidLocator(loc string) bool {
 	return false
 }
 
+// LocatorHash returns the hash portion of a Keep locator, without
+// any size or other hints.
+//
+func LocatorHash(locator string) string {
+	return strings.SplitN(locator, "+", 2)[0]
+}
+
 // GetApiToken returns the OAuth2 token from the Authorization
 // header of a HTTP request, or an empty string if no matching
 // token is found.
@@ -0,0 +1,312 @@
+// A WorkJournal saves the most recent work list received from the
+// Data Manager, and the progress made on it, in a state directory.
+// When keepstore restarts, it uses the journals to resume the pull
+// and trash lists instead of waiting for the Data Manager's next run.
+//
+// Each journal consists of two files in the state directory:
+//
+//   {name}.json
+//       the list itself, together with a random ID, the time it was
+//       received and an MD5 digest of the Data Manager token that
+//       authorized it.
+//   {name}.done
+//       the locators of the requests that have been processed, one
+//       per line, each preceded by the ID of the list it belongs to,
+//       appended as the workers finish them.  Lines with the ID of
+//       any other list are ignored, so progress on an old list that
+//       was left behind by a crash is never applied to a new one.
+//
+// Each list saved or loaded starts a new generation of the journal.
+// Requests carry the generation of the list they came from, and
+// MarkDone ignores requests from earlier generations, so a worker that
+// finishes a request from a replaced list cannot mark the same locator
+// done on the new one.
+//
+// There is no trash worker yet, so nothing marks trash requests done:
+// after a restart the whole trash list is resumed, less the requests
+// dropped by ResumeTrashList.
+
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaleJournalError is returned by WorkJournal.Load when the saved
+// list was not authorized by the current Data Manager token.
+var StaleJournalError = errors.New("journal was not written with the current data manager token")
+
+// state_dir is the directory where the pull and trash lists are
+// journaled.  If empty, the lists are not saved.
+// Initialized by the --state-dir flag.
+var state_dir string
+
+// The journals for the pull and trash lists, or nil if state_dir
+// is not set.
+var pullJournal *WorkJournal
+var trashJournal *WorkJournal
+
+type WorkJournal struct {
+	listPath string
+	donePath string
+	lock     sync.Mutex
+
+	// The generation of the current list, counting from 1.  Zero
+	// means no list has been saved or loaded.
+	generation uint64
+
+	// The ID of the current list.
+	listID string
+}
+
+// journalList is the format of the {name}.json file.
+type journalList struct {
+	ID         string          `json:"id"`
+	TokenHash  string          `json:"data_manager_token_md5"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Requests   json.RawMessage `json:"requests"`
+}
+
+// NewWorkJournal returns a WorkJournal that stores the list called
+// name in the directory dir.
+//
+func NewWorkJournal(dir string, name string) *WorkJournal {
+	return &WorkJournal{
+		listPath: filepath.Join(dir, name+".json"),
+		donePath: filepath.Join(dir, name+".done"),
+	}
+}
+
+// Save replaces the journaled list with requests, discards the
+// progress recorded for the previous list, and returns the generation
+// of the new list, to be passed to MarkDone.
+//
+// The list is written to a temporary file and renamed into place, so
+// a crash during Save leaves either the old or the new list intact.
+// If Save fails, it returns generation zero, and the old list remains
+// the current one.
+//
+func (j *WorkJournal) Save(requests interface{}) (generation uint64, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	id, err := newListID()
+	if err != nil {
+		return 0, err
+	}
+	if err := j.save(id, requests); err != nil {
+		return 0, err
+	}
+	j.generation++
+	j.listID = id
+
+	// The old progress is ignored from now on, since it is recorded
+	// under the old list's ID, so failing to remove it is harmless.
+	if err := os.Remove(j.donePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("%s: %s", j.donePath, err)
+	}
+	return j.generation, nil
+}
+
+func (j *WorkJournal) save(id string, requests interface{}) error {
+	reqs, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(journalList{
+		ID:         id,
+		TokenHash:  tokenHash(data_manager_token),
+		ReceivedAt: time.Now(),
+		Requests:   reqs,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(j.listPath), "tmp"+filepath.Base(j.listPath))
+	if err != nil {
+		return err
+	}
+	if _, err := tmpfile.Write(buf); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	return os.Rename(tmpfile.Name(), j.listPath)
+}
+
+// MarkDone records that the request for locator, from the list with
+// the given generation, has been processed.  Requests from any list
+// but the current one are ignored.
+//
+func (j *WorkJournal) MarkDone(generation uint64, locator string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if generation == 0 || generation != j.generation {
+		return nil
+	}
+
+	f, err := os.OpenFile(j.donePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, j.listID, locator); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load decodes the journaled list into requests, which must be a
+// pointer to a slice, and returns the set of locators that have
+// already been processed, and the generation of the list, to be
+// passed to MarkDone.
+//
+// If there is no journaled list, Load leaves requests untouched and
+// returns an error satisfying os.IsNotExist.  If the list was saved
+// under a different Data Manager token, Load returns
+// StaleJournalError.
+//
+func (j *WorkJournal) Load(requests interface{}) (generation uint64, done map[string]bool, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	buf, err := ioutil.ReadFile(j.listPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	var saved journalList
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return 0, nil, err
+	}
+	if data_manager_token == "" || saved.TokenHash != tokenHash(data_manager_token) {
+		return 0, nil, StaleJournalError
+	}
+	if err := json.Unmarshal(saved.Requests, requests); err != nil {
+		return 0, nil, err
+	}
+
+	done = make(map[string]bool)
+	f, err := os.Open(j.donePath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, nil, err
+	} else if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && fields[0] == saved.ID {
+				done[fields[1]] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, nil, err
+		}
+	}
+	j.generation++
+	j.listID = saved.ID
+	return j.generation, done, nil
+}
+
+// newListID returns a random ID for a newly saved list.
+//
+func newListID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// tokenHash returns the MD5 digest of a Data Manager token, so that
+// journals can be matched to a token without storing it on disk.
+//
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(token)))
+}
+
+// ResumePullList puts the unfinished requests from the journaled pull
+// list back on the pull queue.
+//
+func ResumePullList(j *WorkJournal, q *WorkQueue) {
+	var pr []PullRequest
+	generation, done, err := j.Load(&pr)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("not resuming pull list: %s", err)
+		}
+		return
+	}
+	plist := list.New()
+	for _, p := range pr {
+		if !done[p.Locator] {
+			p.journalGeneration = generation
+			plist.PushBack(p)
+		}
+	}
+	log.Printf("resuming pull list: %d of %d requests remaining", plist.Len(), len(pr))
+	q.ReplaceQueue(plist)
+}
+
+// ResumeTrashList puts the unfinished requests from the journaled
+// trash list back on the trash queue.  (Until there is a trash worker
+// to mark them done, that is all of them.)  Requests for blocks whose
+// modification time no longer matches the one given by the Data
+// Manager are dropped: the block has been written again since the
+// list was made, so it may no longer be garbage.
+//
+func ResumeTrashList(j *WorkJournal, q *WorkQueue) {
+	var trash []TrashRequest
+	_, done, err := j.Load(&trash)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("not resuming trash list: %s", err)
+		}
+		return
+	}
+	tlist := list.New()
+	for _, t := range trash {
+		if done[t.Locator] {
+			continue
+		}
+		if !BlockMtimeMatches(t.Locator, t.BlockMtime) {
+			log.Printf("dropping trash request for %s: mtime is no longer %d", t.Locator, t.BlockMtime)
+			continue
+		}
+		tlist.PushBack(t)
+	}
+	log.Printf("resuming trash list: %d of %d requests remaining", tlist.Len(), len(trash))
+	q.ReplaceQueue(tlist)
+}
+
+// BlockMtimeMatches returns true if a copy of the block identified by
+// locator on some local volume has the modification time mtime
+// (expressed in seconds since the Unix epoch).
+//
+func BlockMtimeMatches(locator string, mtime int64) bool {
+	hash := LocatorHash(locator)
+	for _, vol := range KeepVM.Volumes() {
+		if t, err := vol.Mtime(hash); err == nil && t.Unix() == mtime {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestWorkJournalSaveLoad
+//     Test that a saved list and its progress are loaded intact, and
+//     that saving a new list discards the old progress.
+//
+func TestWorkJournalSaveLoad(t *testing.T) {
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "keepstore-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data_manager_token = "DATA MANAGER TOKEN"
+	j := NewWorkJournal(dir, "pull")
+
+	var pr []PullRequest
+	if _, _, err := j.Load(&pr); !os.IsNotExist(err) {
+		t.Errorf("Load with no saved list: expected IsNotExist, got %v", err)
+	}
+
+	saved := []PullRequest{
+		{Locator: "locator1", Servers: []string{"server_1", "server_2"}},
+		{Locator: "locator2", Servers: []string{"server_3"}},
+	}
+	generation, err := j.Save(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.MarkDone(generation, "locator1"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, done, err := j.Load(&pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pr) != 2 || pr[0].Locator != "locator1" || pr[1].Servers[0] != "server_3" {
+		t.Errorf("Load returned %+v, expected %+v", pr, saved)
+	}
+	if !done["locator1"] || done["locator2"] {
+		t.Errorf("Load returned done=%v, expected only locator1", done)
+	}
+
+	// Saving a new list discards the progress on the old one.
+	if _, err := j.Save(saved[1:]); err != nil {
+		t.Fatal(err)
+	}
+	pr = nil
+	if _, done, err = j.Load(&pr); err != nil {
+		t.Fatal(err)
+	}
+	if len(pr) != 1 || len(done) != 0 {
+		t.Errorf("Load after second Save returned %+v, done=%v", pr, done)
+	}
+}
+
+// TestWorkJournalStaleGeneration
+//     Test that a request from a replaced list is not marked done on
+//     the list that replaced it.
+//
+func TestWorkJournalStaleGeneration(t *testing.T) {
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "keepstore-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data_manager_token = "DATA MANAGER TOKEN"
+	j := NewWorkJournal(dir, "pull")
+	saved := []PullRequest{{Locator: "locator1"}}
+	oldGeneration, err := j.Save(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newGeneration, err := j.Save(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newGeneration == oldGeneration {
+		t.Fatalf("Save returned generation %d twice", newGeneration)
+	}
+
+	// A worker finishes locator1 from the old list.
+	if err := j.MarkDone(oldGeneration, "locator1"); err != nil {
+		t.Fatal(err)
+	}
+	var pr []PullRequest
+	loaded, done, err := j.Load(&pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done["locator1"] {
+		t.Errorf("locator1 from the old list was marked done on the new one")
+	}
+
+	// Once reloaded, only requests from the loaded list are recorded.
+	j.MarkDone(newGeneration, "locator1")
+	j.MarkDone(loaded, "locator1")
+	if _, done, _ = j.Load(&pr); !done["locator1"] {
+		t.Errorf("locator1 from the loaded list was not marked done")
+	}
+}
+
+// TestWorkJournalFailedSave
+//     Test that a failed Save leaves the old list current, and that
+//     progress left over from an old list is not applied to a new one.
+//
+func TestWorkJournalFailedSave(t *testing.T) {
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "keepstore-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data_manager_token = "DATA MANAGER TOKEN"
+	j := NewWorkJournal(dir, "pull")
+	saved := []PullRequest{{Locator: "locator1"}, {Locator: "locator2"}}
+	generation, err := j.Save(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A list that cannot be encoded is not saved, and the old list
+	// is still the one whose progress is recorded.
+	if g, err := j.Save(make(chan int)); err == nil || g != 0 {
+		t.Errorf("Save(chan) returned %d, %v", g, err)
+	}
+	if err := j.MarkDone(generation, "locator1"); err != nil {
+		t.Fatal(err)
+	}
+	var pr []PullRequest
+	if _, done, err := j.Load(&pr); err != nil {
+		t.Fatal(err)
+	} else if !done["locator1"] {
+		t.Errorf("locator1 was not marked done after a failed Save")
+	}
+
+	// Simulate a crash after a new list was renamed into place but
+	// before the old progress was removed.
+	stale, err := ioutil.ReadFile(j.donePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(j.donePath, stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pr = nil
+	if _, done, err := j.Load(&pr); err != nil {
+		t.Fatal(err)
+	} else if len(done) != 0 {
+		t.Errorf("progress on the old list was applied to the new one: %v", done)
+	}
+}
+
+// TestWorkJournalStaleToken
+//     Test that a list saved under a different data manager token
+//     is not loaded.
+//
+func TestWorkJournalStaleToken(t *testing.T) {
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "keepstore-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data_manager_token = "OLD DATA MANAGER TOKEN"
+	j := NewWorkJournal(dir, "pull")
+	if _, err := j.Save([]PullRequest{{Locator: "locator1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	data_manager_token = "NEW DATA MANAGER TOKEN"
+	var pr []PullRequest
+	if _, _, err := j.Load(&pr); err != StaleJournalError {
+		t.Errorf("expected StaleJournalError, got %v", err)
+	}
+
+	pullq = NewWorkQueue()
+	defer pullq.Close()
+	ResumePullList(j, pullq)
+	expectStatus(t, pullq, WorkQueueStatus{0, 0, 0})
+}
+
+// TestResumeLists
+//     Test that unfinished pull requests are resumed, and that trash
+//     requests are dropped if the block's mtime has changed.
+//
+func TestResumeLists(t *testing.T) {
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "keepstore-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data_manager_token = "DATA MANAGER TOKEN"
+	KeepVM = MakeTestVolumeManager(2)
+	defer func() { KeepVM.Quit() }()
+
+	vols := KeepVM.Volumes()
+	vols[0].Put(TEST_HASH, TEST_BLOCK)
+	vols[1].Put(TEST_HASH_2, TEST_BLOCK_2)
+	mtime, _ := vols[0].Mtime(TEST_HASH)
+	mtime2, _ := vols[1].Mtime(TEST_HASH_2)
+
+	pj := NewWorkJournal(dir, "pull")
+	generation, _ := pj.Save([]PullRequest{
+		{Locator: "locator1", Servers: []string{"server_1"}},
+		{Locator: "locator2", Servers: []string{"server_2"}},
+		{Locator: "locator3", Servers: []string{"server_3"}},
+	})
+	pj.MarkDone(generation, "locator2")
+
+	tj := NewWorkJournal(dir, "trash")
+	tj.Save([]TrashRequest{
+		{Locator: TEST_HASH, BlockMtime: mtime.Unix()},
+		{Locator: TEST_HASH_2, BlockMtime: mtime2.Add(-time.Hour).Unix()},
+		{Locator: TEST_HASH_3, BlockMtime: mtime.Unix()},
+	})
+
+	pullq = NewWorkQueue()
+	defer pullq.Close()
+	ResumePullList(pj, pullq)
+	for _, expected := range []string{"locator1", "locator3"} {
+		if pr := (<-pullq.NextItem).(PullRequest); pr.Locator != expected {
+			t.Errorf("resumed pull request %+v, expected locator %s", pr, expected)
+		}
+	}
+	expectChannelEmpty(t, pullq.NextItem)
+
+	trashq = NewWorkQueue()
+	defer trashq.Close()
+	ResumeTrashList(tj, trashq)
+	if tr := (<-trashq.NextItem).(TrashRequest); tr.Locator != TEST_HASH {
+		t.Errorf("resumed trash request %+v, expected locator %s", tr, TEST_HASH)
+	}
+	expectChannelEmpty(t, trashq.NextItem)
+}
+
+// TestPullHandlerSavesJournal
+//     Test that a pull list received from the data manager is saved
+//     to the journal.
+//
+func TestPullHandlerSavesJournal(t *testing.T) {
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "keepstore-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data_manager_token = "DATA MANAGER TOKEN"
+	pullJournal = NewWorkJournal(dir, "pull")
+	defer func() { pullJournal = nil }()
+
+	pullq = NewWorkQueue()
+	defer pullq.Close()
+
+	response := IssueRequest(&RequestTester{"/pull", data_manager_token, "PUT",
+		[]byte(`[{"locator":"locator1","servers":["server_1"]}]`)})
+	ExpectStatusCode(t, "PUT /pull", 200, response)
+
+	var pr []PullRequest
+	if _, _, err := pullJournal.Load(&pr); err != nil {
+		t.Fatal(err)
+	}
+	if len(pr) != 1 || pr[0].Locator != "locator1" {
+		t.Errorf("journaled pull list %+v, expected locator1", pr)
+	}
+}
@@ -54,6 +54,22 @@ var data_manager_token string
 // actually deleting anything.
 var never_delete = false
 
+// pull_workers is the number of goroutines that process the pull
+// queue concurrently.
+// Initialized by the --pull-workers flag.
+var pull_workers = 1
+
+// pull_max_attempts is the number of times a pull worker tries to
+// fetch a block from the servers listed in a pull request before
+// giving up.
+// Initialized by the --pull-max-attempts flag.
+var pull_max_attempts = 3
+
+// pull_retry_delay is the time a pull worker waits before its first
+// retry. The delay doubles after each failed attempt.
+// Initialized by the --pull-retry-delay flag.
+var pull_retry_delay = time.Second
+
 // ==========
 // Error types.
 //
@@ -75,6 +91,8 @@ var (
 	FullError           = &KeepError{503, "Full"}
 	TooLongError        = &KeepError{504, "Timeout"}
 	MethodDisabledError = &KeepError{405, "Method disabled"}
+	UnhealthyError      = &KeepError{503, "No healthy volumes"}
+	TooLargeError       = &KeepError{413, "Request too large"}
 )
 
 func (e *KeepError) Error() string {
@@ -135,6 +153,8 @@ func main() {
 		listen                  string
 		permission_key_file     string
 		permission_ttl_sec      int
+		pull_retry_delay_sec    int
+		volume_check_sec        int
 		serialize_io            bool
 		volumearg               string
 		pidfile                 string
@@ -175,12 +195,48 @@ func main() {
 		1209600,
 		"Expiration time (in seconds) for newly generated permission "+
 			"signatures.")
+	flag.IntVar(
+		&pull_workers,
+		"pull-workers",
+		1,
+		"Number of pull requests to process concurrently.")
+	flag.IntVar(
+		&pull_max_attempts,
+		"pull-max-attempts",
+		3,
+		"Number of times to try fetching a block for a pull request "+
+			"before giving up.")
+	flag.IntVar(
+		&pull_retry_delay_sec,
+		"pull-retry-delay",
+		1,
+		"Time (in seconds) to wait before retrying a failed pull "+
+			"request. The delay doubles after each failed attempt.")
 	flag.BoolVar(
 		&serialize_io,
 		"serialize",
 		false,
 		"If set, all read and write operations on local Keep volumes will "+
 			"be serialized.")
+	flag.StringVar(
+		&state_dir,
+		"state-dir",
+		"",
+		"Directory in which to save the most recent pull and trash "+
+			"lists, so they can be resumed after a restart. If empty, "+
+			"the lists are not saved.")
+	flag.IntVar(
+		&volume_check_sec,
+		"volume-check-interval",
+		60,
+		"Time (in seconds) between health checks of each volume. "+
+			"Use 0 to disable health checks.")
+	flag.IntVar(
+		&volume_max_errors,
+		"volume-max-errors",
+		5,
+		"Number of I/O errors a volume may return between health "+
+			"checks before it is marked degraded.")
 	flag.StringVar(
 		&volumearg,
 		"volumes",
@@ -246,6 +302,14 @@ func main() {
 	// Initialize permission TTL
 	permission_ttl = time.Duration(permission_ttl_sec) * time.Second
 
+	// Initialize pull retry delay
+	pull_retry_delay = time.Duration(pull_retry_delay_sec) * time.Second
+
+	// With no pull workers, pull requests would be queued forever.
+	if pull_workers < 1 {
+		log.Fatal("--pull-workers must be at least 1")
+	}
+
 	// If --enforce-permissions is true, we must have a permission key
 	// to continue.
 	if PermissionSecret == nil {
@@ -263,6 +327,12 @@ func main() {
 	// Start a round-robin VolumeManager with the volumes we have found.
 	KeepVM = MakeRRVolumeManager(goodvols)
 
+	// Start checking the health of the volumes.
+	volume_check_interval = time.Duration(volume_check_sec) * time.Second
+	if volume_check_interval > 0 {
+		go RunVolumeHealthChecks(KeepVM, volume_check_interval)
+	}
+
 	// Tell the built-in HTTP server to direct all requests to the REST router.
 	loggingRouter := MakeLoggingRESTRouter()
 	http.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
@@ -275,7 +345,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Initialize Pull queue and worker
+	// Initialize Pull queue and workers
 	keepClient := keepclient.KeepClient{
 		Arvados:       nil,
 		Want_replicas: 1,
@@ -284,7 +354,19 @@ func main() {
 	}
 
 	pullq = NewWorkQueue()
-	go RunPullWorker(pullq, keepClient)
+	trashq = NewWorkQueue()
+
+	// Resume the pull and trash lists saved before the last restart.
+	if state_dir != "" {
+		pullJournal = NewWorkJournal(state_dir, "pull")
+		trashJournal = NewWorkJournal(state_dir, "trash")
+		ResumePullList(pullJournal, pullq)
+		ResumeTrashList(trashJournal, trashq)
+	}
+
+	for i := 0; i < pull_workers; i++ {
+		go RunPullWorker(pullq, keepClient)
+	}
 
 	// Shut down the server gracefully (by closing the listener)
 	// if SIGTERM is received.
@@ -446,6 +446,37 @@ func TestNodeStatus(t *testing.T) {
 	}
 }
 
+// TestNodeStatusQueues
+//     Test that GetNodeStatus reports the progress of the pull and
+//     trash queues.
+//
+func TestNodeStatusQueues(t *testing.T) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	defer func() { KeepVM.Quit() }()
+
+	pullq = NewWorkQueue()
+	defer pullq.Close()
+	trashq = NewWorkQueue()
+	defer trashq.Close()
+
+	pullq.ReplaceQueue(makeTestWorkList([]int{1, 2, 3}))
+	trashq.ReplaceQueue(makeTestWorkList([]int{4, 5}))
+	<-pullq.NextItem
+	<-pullq.NextItem
+	pullq.DoneItem()
+	expectStatus(t, pullq, WorkQueueStatus{1, 1, 1})
+
+	st := GetNodeStatus()
+	if st.PullQueue != (WorkQueueStatus{1, 1, 1}) {
+		t.Errorf("GetNodeStatus pull_queue %+v, expected {1 1 1}", st.PullQueue)
+	}
+	if st.TrashQueue != (WorkQueueStatus{2, 0, 0}) {
+		t.Errorf("GetNodeStatus trash_queue %+v, expected {2 0 0}", st.TrashQueue)
+	}
+}
+
 // ========================================
 // Helper functions for unit tests.
 // ========================================
@@ -36,12 +36,7 @@ present, Keep returns a 401 error.
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"fmt"
-	"regexp"
-	"strconv"
-	"strings"
+	"git.curoverse.com/arvados.git/sdk/go/locator"
 	"time"
 )
 
@@ -53,14 +48,7 @@ var PermissionSecret []byte
 // MakePermSignature returns a string representing the signed permission
 // hint for the blob identified by blob_hash, api_token and expiration timestamp.
 func MakePermSignature(blob_hash string, api_token string, expiry string) string {
-	hmac := hmac.New(sha1.New, PermissionSecret)
-	hmac.Write([]byte(blob_hash))
-	hmac.Write([]byte("@"))
-	hmac.Write([]byte(api_token))
-	hmac.Write([]byte("@"))
-	hmac.Write([]byte(expiry))
-	digest := hmac.Sum(nil)
-	return fmt.Sprintf("%x", digest)
+	return locator.MakeSignature(PermissionSecret, blob_hash, api_token, expiry)
 }
 
 // SignLocator takes a blob_locator, an api_token and an expiry time, and
@@ -71,40 +59,20 @@ func SignLocator(blob_locator string, api_token string, expiry time.Time) string
 	if PermissionSecret == nil || api_token == "" {
 		return blob_locator
 	}
-	// Extract the hash from the blob locator, omitting any size hint that may be present.
-	blob_hash := strings.Split(blob_locator, "+")[0]
-	// Return the signed locator string.
-	timestamp_hex := fmt.Sprintf("%08x", expiry.Unix())
-	return blob_locator +
-		"+A" + MakePermSignature(blob_hash, api_token, timestamp_hex) +
-		"@" + timestamp_hex
+	loc, err := locator.Parse(blob_locator)
+	if err != nil {
+		return blob_locator
+	}
+	return loc.SignUntil(PermissionSecret, api_token, expiry).String()
 }
 
-var signedLocatorRe = regexp.MustCompile(`^([[:xdigit:]]{32}).*\+A([[:xdigit:]]{40})@([[:xdigit:]]{8})`)
-
 // VerifySignature returns true if the signature on the signed_locator
 // can be verified using the given api_token.
 func VerifySignature(signed_locator string, api_token string) bool {
-	matches := signedLocatorRe.FindStringSubmatch(signed_locator)
-	if matches == nil {
-		// Could not find a permission signature at all
-		return false
-	}
-	blob_hash := matches[1]
-	sig_hex := matches[2]
-	exp_hex := matches[3]
-	if exp_time, err := ParseHexTimestamp(exp_hex); err != nil || exp_time.Before(time.Now()) {
-		// Signature is expired, or timestamp is unparseable
-		return false
-	}
-	return sig_hex == MakePermSignature(blob_hash, api_token, exp_hex)
+	loc, err := locator.Parse(signed_locator)
+	return err == nil && loc.Verify(PermissionSecret, api_token) == nil
 }
 
 func ParseHexTimestamp(timestamp_hex string) (ts time.Time, err error) {
-	if ts_int, e := strconv.ParseInt(timestamp_hex, 16, 0); e == nil {
-		ts = time.Unix(ts_int, 0)
-	} else {
-		err = e
-	}
-	return ts, err
+	return locator.ParseHexTimestamp(timestamp_hex)
 }
@@ -4,31 +4,69 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
 	"io"
 	"io/ioutil"
 	"log"
+	"sort"
+	"sync"
 	"time"
 )
 
 /*
-	Keepstore initiates pull worker channel goroutine.
-	The channel will process pull list.
+	Keepstore initiates pull worker channel goroutines (one for each
+	of the --pull-workers). The workers share a single pull queue.
 		For each (next) pull request:
+			Skip it if the block is already stored on a local volume
 			For each locator listed, execute Pull on the server(s) listed
 			Skip the rest of the servers if no errors
+			If all servers fail, wait and try again, doubling the delay
+			each time, up to pull_max_attempts times
 		Repeat
 */
 func RunPullWorker(pullq *WorkQueue, keepClient keepclient.KeepClient) {
 	nextItem := pullq.NextItem
 	for item := range nextItem {
 		pullRequest := item.(PullRequest)
-		err := PullItemAndProcess(item.(PullRequest), GenerateRandomApiToken(), keepClient)
+		id := pullStatus.Start(pullRequest)
+		attempts, err := PullItemWithRetries(pullRequest, keepClient)
+		pullStatus.Finish(id, attempts, err)
+		pullq.DoneItem()
+		if pullJournal != nil {
+			if err := pullJournal.MarkDone(pullRequest.journalGeneration, pullRequest.Locator); err != nil {
+				log.Printf("Pull %s: recording progress: %s", pullRequest.Locator, err)
+			}
+		}
 		if err == nil {
-			log.Printf("Pull %s success", pullRequest)
+			log.Printf("Pull %s success", pullRequest.Locator)
 		} else {
-			log.Printf("Pull %s error: %s", pullRequest, err)
+			log.Printf("Pull %s error: %s", pullRequest.Locator, err)
+		}
+	}
+}
+
+// PullItemWithRetries processes a single pull request, retrying with
+// exponential backoff if none of the listed servers could supply the
+// block.  If the block is already present on a local volume, it is
+// not fetched again.
+//
+// Returns the number of attempts made (zero if the block was already
+// present) and the error from the last attempt.
+func PullItemWithRetries(pullRequest PullRequest, keepClient keepclient.KeepClient) (attempts int, err error) {
+	if BlockIsPresent(pullRequest.Locator) {
+		return 0, nil
+	}
+	delay := pull_retry_delay
+	for attempts = 1; ; attempts++ {
+		err = PullItemAndProcess(pullRequest, GenerateRandomApiToken(), keepClient)
+		if err == nil || attempts >= pull_max_attempts {
+			return
 		}
+		log.Printf("Pull %s attempt %d error: %s (retrying in %v)",
+			pullRequest.Locator, attempts, err, delay)
+		time.Sleep(delay)
+		delay *= 2
 	}
 }
 
@@ -40,7 +78,14 @@ func RunPullWorker(pullq *WorkQueue, keepClient keepclient.KeepClient) {
 		Write to storage
 */
 func PullItemAndProcess(pullRequest PullRequest, token string, keepClient keepclient.KeepClient) (err error) {
-	keepClient.Arvados.ApiToken = token
+	// Use a private copy of the Arvados client, so that concurrent
+	// pull workers do not overwrite each other's tokens.
+	arv := arvadosclient.ArvadosClient{}
+	if keepClient.Arvados != nil {
+		arv = *keepClient.Arvados
+	}
+	arv.ApiToken = token
+	keepClient.Arvados = &arv
 
 	service_roots := make(map[string]string)
 	for _, addr := range pullRequest.Servers {
@@ -81,6 +126,25 @@ var GetContent = func(signedLocator string, keepClient keepclient.KeepClient) (
 	return reader, blocklen, url, err
 }
 
+// BlockIsPresent returns true if a copy of the block identified by
+// locator is already stored on a readable local volume. Size and other
+// hints in the locator are ignored. Only the volumes' metadata is
+// consulted: the block is not read or checksummed, and its timestamp is
+// not updated, so a block due to be trashed is not kept alive by a pull
+// request that skips it.
+var BlockIsPresent = func(locator string) bool {
+	hash := LocatorHash(locator)
+	if !IsValidLocator(hash) {
+		return false
+	}
+	for _, vol := range KeepVM.ReadableVolumes() {
+		if _, err := vol.Mtime(hash); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 const ALPHA_NUMERIC = "0123456789abcdefghijklmnopqrstuvwxyz"
 
 func GenerateRandomApiToken() string {
@@ -97,3 +161,103 @@ var PutContent = func(content []byte, locator string) (err error) {
 	err = PutBlock(content, locator)
 	return
 }
+
+// The number of finished pull requests remembered in each of the
+// success and failure lists reported by GET /pull.
+const PULL_STATUS_HISTORY = 100
+
+// A PullResult describes a finished pull request.
+type PullResult struct {
+	Locator  string    `json:"locator"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Finished time.Time `json:"finished_at"`
+}
+
+// A PullStatus is a snapshot of the pull workers' activity, as
+// reported in response to GET /pull.
+type PullStatus struct {
+	Queued     int           `json:"queued"`
+	InProgress []PullRequest `json:"in_progress"`
+	Successes  []PullResult  `json:"recent_successes"`
+	Failures   []PullResult  `json:"recent_failures"`
+}
+
+// A PullTracker records the activity of the pull workers.  It is
+// safe for concurrent use by multiple workers.
+type PullTracker struct {
+	sync.Mutex
+	nextId     int
+	inProgress map[int]PullRequest
+	successes  []PullResult
+	failures   []PullResult
+}
+
+// pullStatus tracks the activity of the pull workers started by main.
+var pullStatus = NewPullTracker()
+
+func NewPullTracker() *PullTracker {
+	return &PullTracker{inProgress: make(map[int]PullRequest)}
+}
+
+// Start records that a worker has begun processing pr, and returns
+// an identifier to pass to Finish.
+func (t *PullTracker) Start(pr PullRequest) int {
+	t.Lock()
+	defer t.Unlock()
+	t.nextId++
+	t.inProgress[t.nextId] = pr
+	return t.nextId
+}
+
+// Finish records the outcome of the pull request identified by id.
+func (t *PullTracker) Finish(id int, attempts int, err error) {
+	t.Lock()
+	defer t.Unlock()
+	result := PullResult{
+		Locator:  t.inProgress[id].Locator,
+		Attempts: attempts,
+		Finished: time.Now(),
+	}
+	delete(t.inProgress, id)
+	if err == nil {
+		t.successes = appendPullResult(t.successes, result)
+	} else {
+		result.Error = err.Error()
+		t.failures = appendPullResult(t.failures, result)
+	}
+}
+
+// Status returns a snapshot of the pull workers' activity, with
+// Queued taken from the pull queue q.
+func (t *PullTracker) Status(q *WorkQueue) PullStatus {
+	t.Lock()
+	defer t.Unlock()
+	ids := make([]int, 0, len(t.inProgress))
+	for id := range t.inProgress {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	st := PullStatus{
+		InProgress: make([]PullRequest, len(ids)),
+		Successes:  append([]PullResult{}, t.successes...),
+		Failures:   append([]PullResult{}, t.failures...),
+	}
+	for i, id := range ids {
+		st.InProgress[i] = t.inProgress[id]
+	}
+	if q != nil {
+		st.Queued = q.Status().Queued
+	}
+	return st
+}
+
+// appendPullResult appends r to results, discarding the oldest
+// entries beyond PULL_STATUS_HISTORY.
+func appendPullResult(results []PullResult, r PullResult) []PullResult {
+	results = append(results, r)
+	if len(results) > PULL_STATUS_HISTORY {
+		results = results[len(results)-PULL_STATUS_HISTORY:]
+	}
+	return results
+}
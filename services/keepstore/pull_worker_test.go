@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
@@ -9,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"testing"
+	"time"
 )
 
 type PullWorkerTestSuite struct{}
@@ -35,6 +37,12 @@ func (s *PullWorkerTestSuite) SetUpTest(c *C) {
 	putContent = []byte("")
 	putError = nil
 
+	// Most tests expect a single attempt per pull request; the
+	// retry tests set this explicitly.
+	pull_max_attempts = 1
+	pull_retry_delay = time.Millisecond
+	pullStatus = NewPullTracker()
+
 	// When a new pull request arrives, the old one will be overwritten.
 	// This behavior is verified using these two maps in the
 	// "TestPullWorker_pull_list_with_two_items_latest_replacing_old"
@@ -50,6 +58,7 @@ func RunTestPullWorker(c *C) {
 	keepClient, err := keepclient.MakeKeepClient(&arv)
 	c.Assert(err, Equals, nil)
 
+	KeepVM = MakeTestVolumeManager(2)
 	pullq = NewWorkQueue()
 	go RunPullWorker(pullq, keepClient)
 }
@@ -312,6 +321,144 @@ func performTest(testData PullWorkerTestData, c *C) {
 	}
 }
 
+// Make a keep client for tests that do not need an API server.
+func makeStandaloneKeepClient() keepclient.KeepClient {
+	return keepclient.KeepClient{
+		Arvados:       &arvadosclient.ArvadosClient{},
+		Want_replicas: 1,
+		Using_proxy:   true,
+		Client:        &http.Client{},
+	}
+}
+
+// Override GetContent so that it fails the first numFailures times
+// it is called, and returns content after that. Returns a pointer to
+// the number of calls made.
+func mockGetContentWithFailures(numFailures int, content string) *int {
+	calls := 0
+	GetContent = func(signedLocator string, keepClient keepclient.KeepClient) (
+		reader io.ReadCloser, contentLength int64, url string, err error) {
+		calls++
+		if calls <= numFailures {
+			return nil, 0, "", errors.New("Error getting data")
+		}
+		return &ClosingBuffer{bytes.NewBufferString(content)}, int64(len(content)), "", nil
+	}
+	PutContent = func(content []byte, locator string) (err error) {
+		putContent = content
+		return nil
+	}
+	return &calls
+}
+
+func (s *PullWorkerTestSuite) TestPullWorker_retry_until_success(c *C) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	pull_max_attempts = 3
+	calls := mockGetContentWithFailures(2, "hello")
+
+	attempts, err := PullItemWithRetries(
+		PullRequest{Locator: "locator1", Servers: []string{"server_1", "server_2"}},
+		makeStandaloneKeepClient())
+	c.Check(err, IsNil)
+	c.Check(attempts, Equals, 3)
+	c.Check(*calls, Equals, 3)
+	c.Check(string(putContent), Equals, "hello")
+}
+
+func (s *PullWorkerTestSuite) TestPullWorker_give_up_after_max_attempts(c *C) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	pull_max_attempts = 3
+	calls := mockGetContentWithFailures(5, "hello")
+
+	attempts, err := PullItemWithRetries(
+		PullRequest{Locator: "locator1", Servers: []string{"server_1"}},
+		makeStandaloneKeepClient())
+	c.Check(err, NotNil)
+	c.Check(attempts, Equals, 3)
+	c.Check(*calls, Equals, 3)
+	c.Check(string(putContent), Equals, "")
+}
+
+func (s *PullWorkerTestSuite) TestPullWorker_skip_block_already_present(c *C) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	vol := KeepVM.Volumes()[1].(*MockVolume)
+	vol.Put(TEST_HASH, TEST_BLOCK)
+	old := time.Now().Add(-time.Hour)
+	vol.Timestamps[TEST_HASH] = old
+	calls := mockGetContentWithFailures(0, string(TEST_BLOCK))
+
+	attempts, err := PullItemWithRetries(
+		PullRequest{Locator: TEST_HASH + "+44", Servers: []string{"server_1"}},
+		makeStandaloneKeepClient())
+	c.Check(err, IsNil)
+	c.Check(attempts, Equals, 0)
+	c.Check(*calls, Equals, 0)
+
+	// Checking for the block does not make it look recently used.
+	c.Check(vol.Timestamps[TEST_HASH], Equals, old)
+}
+
+func (s *PullWorkerTestSuite) TestPullWorker_status(c *C) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	data_manager_token = "DATA MANAGER TOKEN"
+	pull_max_attempts = 2
+
+	GetContent = func(signedLocator string, keepClient keepclient.KeepClient) (
+		reader io.ReadCloser, contentLength int64, url string, err error) {
+		if signedLocator == "locator2" {
+			return nil, 0, "", errors.New("Error getting data")
+		}
+		return &ClosingBuffer{bytes.NewBufferString("hello")}, 5, "", nil
+	}
+	PutContent = func(content []byte, locator string) (err error) {
+		return nil
+	}
+
+	pullq = NewWorkQueue()
+	for i := 0; i < 2; i++ {
+		go RunPullWorker(pullq, makeStandaloneKeepClient())
+	}
+	defer pullq.Close()
+
+	response := IssueRequest(&RequestTester{"/pull", data_manager_token, "PUT", first_pull_list})
+	c.Assert(response.Code, Equals, http.StatusOK)
+
+	// Wait for both pull requests to finish.
+	for i := 0; i < 100; i++ {
+		if pullq.Status().Completed == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response = IssueRequest(&RequestTester{"/pull", "invalid_data_manager_token", "GET", nil})
+	c.Check(response.Code, Equals, http.StatusUnauthorized)
+
+	response = IssueRequest(&RequestTester{"/pull", data_manager_token, "GET", nil})
+	c.Assert(response.Code, Equals, http.StatusOK)
+
+	var st PullStatus
+	c.Assert(json.Unmarshal(response.Body.Bytes(), &st), IsNil)
+	c.Check(st.Queued, Equals, 0)
+	c.Check(len(st.InProgress), Equals, 0)
+	c.Check(pullq.Status(), Equals, WorkQueueStatus{0, 0, 2})
+	c.Assert(len(st.Successes), Equals, 1)
+	c.Check(st.Successes[0].Locator, Equals, "locator1")
+	c.Check(st.Successes[0].Attempts, Equals, 1)
+	c.Assert(len(st.Failures), Equals, 1)
+	c.Check(st.Failures[0].Locator, Equals, "locator2")
+	c.Check(st.Failures[0].Attempts, Equals, 2)
+	c.Check(st.Failures[0].Error, Equals, "Error getting data")
+}
+
 type ClosingBuffer struct {
 	*bytes.Buffer
 }
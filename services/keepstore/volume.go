@@ -17,8 +17,10 @@ type Volume interface {
 	Put(loc string, block []byte) error
 	Touch(loc string) error
 	Mtime(loc string) (time.Time, error)
+	Stat(loc string) (size int64, mtime time.Time, err error)
 	Index(prefix string) string
 	Delete(loc string) error
+	Probe() error
 	Status() *VolumeStatus
 	String() string
 }
@@ -92,6 +94,14 @@ func (v *MockVolume) Mtime(loc string) (time.Time, error) {
 	return mtime, err
 }
 
+func (v *MockVolume) Stat(loc string) (int64, time.Time, error) {
+	mtime, err := v.Mtime(loc)
+	if err != nil {
+		return 0, mtime, err
+	}
+	return int64(len(v.Store[loc])), mtime, nil
+}
+
 func (v *MockVolume) Index(prefix string) string {
 	var result string
 	for loc, block := range v.Store {
@@ -114,12 +124,24 @@ func (v *MockVolume) Delete(loc string) error {
 	return os.ErrNotExist
 }
 
+func (v *MockVolume) Probe() error {
+	if v.Bad {
+		return errors.New("Bad volume")
+	}
+	return nil
+}
+
 func (v *MockVolume) Status() *VolumeStatus {
 	var used uint64
 	for _, block := range v.Store {
 		used = used + uint64(len(block))
 	}
-	return &VolumeStatus{"/bogo", 123, 1000000 - used, used}
+	return &VolumeStatus{
+		MountPoint: "/bogo",
+		DeviceNum:  123,
+		BytesFree:  1000000 - used,
+		BytesUsed:  used,
+	}
 }
 
 func (v *MockVolume) String() string {
@@ -129,17 +151,26 @@ func (v *MockVolume) String() string {
 // A VolumeManager manages a collection of volumes.
 //
 // - Volumes is a slice of available Volumes.
-// - Choose() returns a Volume suitable for writing to.
+// - ReadableVolumes() returns the Volumes in the order they should be
+//   tried for reads: healthy volumes first, then degraded ones.
+// - WritableVolumes() returns the Volumes that are not degraded.
+// - Choose() returns a healthy Volume suitable for writing to, or
+//   nil if every volume is degraded.
+// - Health(vol) returns the VolumeHealth tracking vol.
 // - Quit() instructs the VolumeManager to shut down gracefully.
 //
 type VolumeManager interface {
 	Volumes() []Volume
+	ReadableVolumes() []Volume
+	WritableVolumes() []Volume
 	Choose() Volume
+	Health(vol Volume) *VolumeHealth
 	Quit()
 }
 
 type RRVolumeManager struct {
 	volumes   []Volume
+	health    map[Volume]*VolumeHealth
 	nextwrite chan Volume
 	quit      chan int
 }
@@ -149,7 +180,10 @@ func MakeRRVolumeManager(vols []Volume) *RRVolumeManager {
 	// and with new Nextwrite and Quit channels.
 	// The Quit channel is buffered with a capacity of 1 so that
 	// another routine may write to it without blocking.
-	vm := &RRVolumeManager{vols, make(chan Volume), make(chan int, 1)}
+	vm := &RRVolumeManager{vols, make(map[Volume]*VolumeHealth), make(chan Volume), make(chan int, 1)}
+	for _, v := range vols {
+		vm.health[v] = &VolumeHealth{}
+	}
 
 	// This goroutine implements round-robin volume selection.
 	// It sends each available Volume in turn to the Nextwrite
@@ -174,8 +208,45 @@ func (vm *RRVolumeManager) Volumes() []Volume {
 	return vm.volumes
 }
 
+func (vm *RRVolumeManager) ReadableVolumes() []Volume {
+	healthy := vm.WritableVolumes()
+	for _, v := range vm.volumes {
+		if vm.health[v].Degraded() {
+			healthy = append(healthy, v)
+		}
+	}
+	return healthy
+}
+
+func (vm *RRVolumeManager) WritableVolumes() []Volume {
+	var healthy []Volume
+	for _, v := range vm.volumes {
+		if !vm.health[v].Degraded() {
+			healthy = append(healthy, v)
+		}
+	}
+	return healthy
+}
+
+// Choose returns the next volume in round-robin order, skipping
+// degraded volumes.
 func (vm *RRVolumeManager) Choose() Volume {
-	return <-vm.nextwrite
+	for i := 0; i < len(vm.volumes); i++ {
+		if v := <-vm.nextwrite; !vm.health[v].Degraded() {
+			return v
+		}
+	}
+	return nil
+}
+
+// Health returns the VolumeHealth tracking vol.  A volume that vm does
+// not manage gets a fresh VolumeHealth, which records nothing that
+// vm will ever consult.
+func (vm *RRVolumeManager) Health(vol Volume) *VolumeHealth {
+	if h, ok := vm.health[vol]; ok {
+		return h
+	}
+	return &VolumeHealth{}
 }
 
 func (vm *RRVolumeManager) Quit() {
@@ -0,0 +1,128 @@
+// Volume health checking.
+//
+// Keepstore keeps track of I/O errors on each volume, and
+// periodically probes each volume by writing, reading back and
+// removing a small file outside the block namespace.  A volume whose
+// probe fails, or which returns too many I/O errors between probes, is
+// marked degraded: the VolumeManager stops choosing it for writes and
+// tries it last for reads.  A degraded volume is restored as soon as a
+// probe succeeds without any further errors in the meantime.
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// volume_check_interval is the time between health probes of each
+// volume.  If zero, volumes are not probed.
+// Initialized by the --volume-check-interval flag.
+var volume_check_interval = time.Minute
+
+// volume_max_errors is the number of I/O errors a volume may return
+// between health probes before it is marked degraded.
+// Initialized by the --volume-max-errors flag.
+var volume_max_errors = 5
+
+// The data written to each volume by Volume.Probe.
+var PROBE_DATA = []byte("keepstore volume health check")
+
+// A VolumeHealth records the health of a single volume.  It is safe
+// for concurrent use.
+type VolumeHealth struct {
+	lock      sync.Mutex
+	degraded  bool
+	errors    int
+	lastError string
+	lastProbe time.Time
+}
+
+// Record notes the outcome of an I/O operation on the volume.
+// Errors that do not indicate a problem with the volume itself
+// (a missing block, or a full volume) are not counted.  If the
+// volume returns more than volume_max_errors errors between probes,
+// it is marked degraded immediately.
+//
+func (h *VolumeHealth) Record(err error) {
+	if err == nil || os.IsNotExist(err) || err == FullError {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.errors++
+	h.lastError = err.Error()
+	if h.errors > volume_max_errors {
+		h.degraded = true
+	}
+}
+
+// ProbeResult records the outcome of a health probe, and starts
+// counting errors afresh.  The volume is degraded if the probe
+// failed or if it returned too many errors since the last probe, and
+// restored otherwise.
+//
+func (h *VolumeHealth) ProbeResult(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err != nil {
+		h.lastError = err.Error()
+	}
+	h.degraded = err != nil || h.errors > volume_max_errors
+	h.errors = 0
+	h.lastProbe = time.Now()
+}
+
+// Degraded returns true if the volume has been marked degraded.
+//
+func (h *VolumeHealth) Degraded() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.degraded
+}
+
+// UpdateStatus fills in the health fields of a VolumeStatus.
+//
+func (h *VolumeHealth) UpdateStatus(st *VolumeStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	st.Degraded = h.degraded
+	st.RecentErrors = h.errors
+	st.LastError = h.lastError
+	if !h.lastProbe.IsZero() {
+		st.LastHealthCheck = h.lastProbe.Unix()
+	}
+}
+
+// CheckVolumeHealth probes every volume managed by vm once, and
+// records the results.
+//
+func CheckVolumeHealth(vm VolumeManager) {
+	for _, vol := range vm.Volumes() {
+		h := vm.Health(vol)
+		wasDegraded := h.Degraded()
+		err := vol.Probe()
+		h.ProbeResult(err)
+		if err != nil {
+			log.Printf("%s: health check failed: %s\n", vol, err)
+		}
+		if degraded := h.Degraded(); degraded != wasDegraded {
+			if degraded {
+				log.Printf("%s: marking volume degraded\n", vol)
+			} else {
+				log.Printf("%s: volume is healthy again\n", vol)
+			}
+		}
+	}
+}
+
+// RunVolumeHealthChecks probes every volume managed by vm once per
+// interval, forever.
+//
+func RunVolumeHealthChecks(vm VolumeManager, interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		CheckVolumeHealth(vm)
+	}
+}
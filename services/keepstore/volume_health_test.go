@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestProbeVolume
+//     Test that the probe succeeds on a working volume without leaving
+//     anything behind, and fails on a broken one, whether or not I/O
+//     on the volume is serialized.
+//
+func TestProbeVolume(t *testing.T) {
+	defer teardown()
+
+	for _, serialize := range []bool{false, true} {
+		v := TempUnixVolume(t, serialize)
+		defer _teardown(v)
+		if err := v.Probe(); err != nil {
+			t.Errorf("Probe on a good volume (serialize=%v): %s", serialize, err)
+		}
+		if names, err := ioutil.ReadDir(v.root); err != nil {
+			t.Fatal(err)
+		} else if len(names) != 0 {
+			t.Errorf("Probe left %d files in the volume root (serialize=%v)", len(names), serialize)
+		}
+
+		os.RemoveAll(v.root)
+		if err := v.Probe(); err == nil {
+			t.Errorf("Probe on a missing volume (serialize=%v): expected an error", serialize)
+		}
+	}
+}
+
+// TestHealthUnknownVolume
+//     Test that asking for the health of a volume the volume manager
+//     does not manage does not return nil.
+//
+func TestHealthUnknownVolume(t *testing.T) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(1)
+	defer KeepVM.Quit()
+
+	h := KeepVM.Health(CreateMockVolume())
+	if h == nil {
+		t.Fatal("Health returned nil for an unknown volume")
+	}
+	h.Record(errors.New("I/O error"))
+	if KeepVM.Health(KeepVM.Volumes()[0]).Degraded() {
+		t.Error("error on an unknown volume degraded a managed one")
+	}
+}
+
+// TestVolumeDegradedAndRestored
+//     Test that a volume returning too many I/O errors is marked
+//     degraded, skipped for writes and tried last for reads, and that
+//     it is restored once a health check passes.
+//
+func TestVolumeDegradedAndRestored(t *testing.T) {
+	defer teardown()
+	defer func(n int) { volume_max_errors = n }(volume_max_errors)
+	volume_max_errors = 2
+
+	KeepVM = MakeTestVolumeManager(2)
+	defer KeepVM.Quit()
+
+	vols := KeepVM.Volumes()
+	vols[1].Put(TEST_HASH, TEST_BLOCK)
+	vols[0].(*MockVolume).Bad = true
+
+	// Each read tries the bad volume first until it is degraded.
+	for i := 0; i < 3; i++ {
+		if _, err := GetBlock(TEST_HASH, false); err != nil {
+			t.Fatalf("GetBlock: %s", err)
+		}
+	}
+	if !KeepVM.Health(vols[0]).Degraded() {
+		t.Fatal("expected volume 0 to be degraded")
+	}
+	if KeepVM.Health(vols[1]).Degraded() {
+		t.Fatal("expected volume 1 to be healthy")
+	}
+
+	if w := KeepVM.WritableVolumes(); len(w) != 1 || w[0] != vols[1] {
+		t.Errorf("WritableVolumes returned %v, expected only %v", w, vols[1])
+	}
+	if r := KeepVM.ReadableVolumes(); len(r) != 2 || r[0] != vols[1] || r[1] != vols[0] {
+		t.Errorf("ReadableVolumes returned %v, expected degraded volume last", r)
+	}
+	for i := 0; i < 4; i++ {
+		if v := KeepVM.Choose(); v != vols[1] {
+			t.Errorf("Choose returned degraded volume %v", v)
+		}
+	}
+
+	st := GetNodeStatus()
+	if !st.Volumes[0].Degraded || st.Volumes[0].RecentErrors != 3 || st.Volumes[0].LastError != "Bad volume" {
+		t.Errorf("unexpected status for degraded volume: %+v", st.Volumes[0])
+	}
+	if st.Volumes[1].Degraded {
+		t.Errorf("unexpected status for healthy volume: %+v", st.Volumes[1])
+	}
+
+	// While the volume is still bad, a health check keeps it degraded.
+	CheckVolumeHealth(KeepVM)
+	if !KeepVM.Health(vols[0]).Degraded() {
+		t.Error("expected volume 0 to stay degraded after a failed health check")
+	}
+
+	// Once the volume works again, a health check restores it.
+	vols[0].(*MockVolume).Bad = false
+	CheckVolumeHealth(KeepVM)
+	if KeepVM.Health(vols[0]).Degraded() {
+		t.Error("expected volume 0 to be restored after a good health check")
+	}
+	st = GetNodeStatus()
+	if st.Volumes[0].Degraded || st.Volumes[0].RecentErrors != 0 || st.Volumes[0].LastHealthCheck == 0 {
+		t.Errorf("unexpected status for restored volume: %+v", st.Volumes[0])
+	}
+}
+
+// TestPutBlockAllDegraded
+//     Test that PutBlock refuses to write when every volume is
+//     degraded.
+//
+func TestPutBlockAllDegraded(t *testing.T) {
+	defer teardown()
+
+	KeepVM = MakeTestVolumeManager(2)
+	defer KeepVM.Quit()
+
+	for _, vol := range KeepVM.Volumes() {
+		vol.(*MockVolume).Bad = true
+	}
+	CheckVolumeHealth(KeepVM)
+
+	if err := PutBlock(TEST_BLOCK, TEST_HASH); err != UnhealthyError {
+		t.Errorf("PutBlock: expected UnhealthyError, got %v", err)
+	}
+}
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -14,7 +16,7 @@ import (
 	"time"
 )
 
-// IORequests are encapsulated Get or Put requests.  They are used to
+// IORequests are encapsulated Get, Put or Probe requests.  They are used to
 // implement serialized I/O (i.e. only one read/write operation per
 // volume). When running in serialized mode, the Keep front end sends
 // IORequests on a channel to an IORunner, which handles them one at a
@@ -25,6 +27,7 @@ type IOMethod int
 const (
 	KeepGet IOMethod = iota
 	KeepPut
+	KeepProbe
 )
 
 type IORequest struct {
@@ -62,6 +65,8 @@ func (v *UnixVolume) IOHandler() {
 			result.data, result.err = v.Read(req.loc)
 		case KeepPut:
 			result.err = v.Write(req.loc, req.data)
+		case KeepProbe:
+			result.err = v.probe()
 		}
 		req.reply <- &result
 	}
@@ -122,6 +127,17 @@ func (v *UnixVolume) Mtime(loc string) (time.Time, error) {
 	}
 }
 
+// Stat returns the size and modification time of the block
+// identified by the locator string "loc", without reading it.
+//
+func (v *UnixVolume) Stat(loc string) (int64, time.Time, error) {
+	if fi, err := os.Stat(v.blockPath(loc)); err != nil {
+		return 0, time.Time{}, err
+	} else {
+		return fi.Size(), fi.ModTime(), nil
+	}
+}
+
 // Read retrieves a block identified by the locator string "loc", and
 // returns its contents as a byte slice.
 //
@@ -202,7 +218,12 @@ func (v *UnixVolume) Status() *VolumeStatus {
 	// uses fs.Blocks - fs.Bfree.
 	free := fs.Bavail * uint64(fs.Bsize)
 	used := (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
-	return &VolumeStatus{v.root, devnum, free, used}
+	return &VolumeStatus{
+		MountPoint: v.root,
+		DeviceNum:  devnum,
+		BytesFree:  free,
+		BytesUsed:  used,
+	}
 }
 
 // Index returns a list of blocks found on this volume which begin with
@@ -281,6 +302,51 @@ func (v *UnixVolume) Delete(loc string) error {
 	return os.Remove(p)
 }
 
+// Probe checks that the volume can be written to and read from, by
+// writing a small temporary file in the volume's root directory,
+// reading it back, and removing it.  The file is outside the block
+// namespace, so it never appears in the index.  A full volume cannot
+// take writes anyway, but it is not broken, so it is not probed.
+//
+// On a serialized volume the probe waits its turn on the queue like any
+// other request, so it does not compete with them for the disk.
+//
+func (v *UnixVolume) Probe() error {
+	if v.queue == nil {
+		return v.probe()
+	}
+	reply := make(chan *IOResponse)
+	v.queue <- &IORequest{KeepProbe, "", nil, reply}
+	response := <-reply
+	return response.err
+}
+
+func (v *UnixVolume) probe() error {
+	if v.IsFull() {
+		return nil
+	}
+	f, err := ioutil.TempFile(v.root, "tmp-health-check")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(PROBE_DATA); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, PROBE_DATA) {
+		return errors.New("health check file read back incorrectly")
+	}
+	return nil
+}
+
 // blockDir returns the fully qualified directory name for the directory
 // where loc is (or would be) stored on this volume.
 func (v *UnixVolume) blockDir(loc string) string {
@@ -34,6 +34,13 @@ package main
              output channel (signalling any workers to quit) and
              terminates.
 
+     4. When a worker has finished with an item (whether or not the
+        work succeeded), it calls DoneItem().  The manager keeps count
+        of the items that are queued, in progress and completed, so
+        that Status() can report how far through the current list the
+        workers have got.  Items from a replaced list that are still
+        in progress are not counted against the new list.
+
    Tasks currently handled by WorkQueue:
      * the pull list
      * the trash list
@@ -55,6 +62,7 @@ package main
 			for i := range list.NextItem {
 				req := i.(FrobRequest)
 				frob.Run(req)
+				list.DoneItem()
 			}
 		}(froblist)
 
@@ -77,6 +85,14 @@ package main
             processing a list item when ReplaceQueue is called, it
             finishes processing before receiving items from the new
             list.
+		DoneItem()
+			Tells the manager that a worker has finished processing
+			an item it received from NextItem.  Each worker must call
+			DoneItem exactly once for each item it receives.
+		Status()
+			Returns a WorkQueueStatus with the number of items
+			from the current list that are queued, in progress,
+			and completed.
 		Close()
 			Shuts down the manager goroutine. When Close is called,
 			the manager closes the NextItem channel.
@@ -85,8 +101,28 @@ package main
 import "container/list"
 
 type WorkQueue struct {
-	newlist  chan *list.List
-	NextItem chan interface{}
+	newlist   chan *list.List
+	NextItem  chan interface{}
+	doneItem  chan bool
+	getStatus chan WorkQueueStatus
+	stopped   chan bool
+}
+
+// A WorkQueueStatus is a snapshot of a WorkQueue's progress.
+//
+// Queued is the number of items on the current list that have not
+// yet been sent to a worker. InProgress is the number of items from
+// the current list that workers have received but not yet reported as
+// done. Completed is the number of items from the current list
+// reported as done.
+//
+// The current list has finished when Queued and InProgress are both
+// zero.
+//
+type WorkQueueStatus struct {
+	Queued     int `json:"queued"`
+	InProgress int `json:"in_progress"`
+	Completed  int `json:"completed"`
 }
 
 // NewWorkQueue returns a new worklist, and launches a listener
@@ -94,8 +130,11 @@ type WorkQueue struct {
 //
 func NewWorkQueue() *WorkQueue {
 	b := WorkQueue{
-		newlist:  make(chan *list.List),
-		NextItem: make(chan interface{}),
+		newlist:   make(chan *list.List),
+		NextItem:  make(chan interface{}),
+		doneItem:  make(chan bool),
+		getStatus: make(chan WorkQueueStatus),
+		stopped:   make(chan bool),
 	}
 	go b.listen()
 	return &b
@@ -109,6 +148,29 @@ func (b *WorkQueue) ReplaceQueue(list *list.List) {
 	b.newlist <- list
 }
 
+// DoneItem reports that a worker has finished processing an item it
+// received from NextItem.
+//
+func (b *WorkQueue) DoneItem() {
+	select {
+	case b.doneItem <- true:
+	case <-b.stopped:
+	}
+}
+
+// Status returns a snapshot of the number of items queued, in
+// progress and completed.  Once the manager has shut down, Status
+// returns an empty WorkQueueStatus.
+//
+func (b *WorkQueue) Status() WorkQueueStatus {
+	select {
+	case st := <-b.getStatus:
+		return st
+	case <-b.stopped:
+		return WorkQueueStatus{}
+	}
+}
+
 // Close shuts down the manager and terminates the goroutine, which
 // completes any pull request in progress and abandons any pending
 // requests.
@@ -121,6 +183,15 @@ func (b *WorkQueue) Close() {
 // input queue until the queue is closed.
 // listen takes ownership of the list that is passed to it.
 //
+// listen also owns the queued, in progress and completed counts,
+// which it updates as items are sent to workers and reported done.
+// When the list is replaced, the items still in progress belong to
+// the old list.  DoneItem does not say which item is done, so the
+// next that many reports are taken to be for those items and are not
+// counted.  A new item that finishes before an old one is therefore
+// counted late, but the new list is never reported finished before
+// all its items are done.
+//
 // Note that the routine does not ever need to access the list
 // itself once the current_item has been initialized, so we do
 // not bother to keep a pointer to the list. Because it is a
@@ -129,32 +200,48 @@ func (b *WorkQueue) Close() {
 //
 func (b *WorkQueue) listen() {
 	var current_item *list.Element
+	var status WorkQueueStatus
+
+	// Items from earlier lists that are still in progress
+	var stale int
 
 	// When we're done, close the output channel to shut down any
-	// workers.
+	// workers, and stop answering DoneItem and Status calls.
+	defer close(b.stopped)
 	defer close(b.NextItem)
 
 	for {
-		// If the current list is empty, wait for a new list before
-		// even checking if workers are ready.
-		if current_item == nil {
-			if p, ok := <-b.newlist; ok {
-				current_item = p.Front()
-			} else {
-				// The channel was closed; shut down.
-				return
-			}
+		// If the current list is empty, leave nextItem nil so that
+		// we wait for a new list before even checking if workers
+		// are ready.
+		var nextItem chan interface{}
+		var value interface{}
+		if current_item != nil {
+			nextItem = b.NextItem
+			value = current_item.Value
 		}
 		select {
 		case p, ok := <-b.newlist:
 			if ok {
 				current_item = p.Front()
+				stale += status.InProgress
+				status = WorkQueueStatus{Queued: p.Len()}
 			} else {
 				// The input channel is closed; time to shut down
 				return
 			}
-		case b.NextItem <- current_item.Value:
+		case nextItem <- value:
 			current_item = current_item.Next()
+			status.Queued--
+			status.InProgress++
+		case <-b.doneItem:
+			if stale > 0 {
+				stale--
+			} else {
+				status.InProgress--
+				status.Completed++
+			}
+		case b.getStatus <- status:
 		}
 	}
 }
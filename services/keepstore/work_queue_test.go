@@ -147,3 +147,67 @@ func TestWorkQueueReplaceQueue(t *testing.T) {
 
 	b.Close()
 }
+
+func expectStatus(t *testing.T, b *WorkQueue, expected WorkQueueStatus) {
+	if actual := b.Status(); actual != expected {
+		t.Fatalf("Expected status %+v but got %+v", expected, actual)
+	}
+}
+
+// Check the queued, in progress and completed counts as items are
+// read and reported done.
+func TestWorkQueueStatus(t *testing.T) {
+	var input = []int{1, 2, 3, 4, 5}
+
+	b := NewWorkQueue()
+	expectStatus(t, b, WorkQueueStatus{0, 0, 0})
+
+	b.ReplaceQueue(makeTestWorkList(input))
+	expectStatus(t, b, WorkQueueStatus{5, 0, 0})
+
+	expectFromChannel(t, b.NextItem, input[0:2])
+	expectStatus(t, b, WorkQueueStatus{3, 2, 0})
+
+	b.DoneItem()
+	expectStatus(t, b, WorkQueueStatus{3, 1, 1})
+
+	expectFromChannel(t, b.NextItem, input[2:5])
+	for i := 0; i < 4; i++ {
+		b.DoneItem()
+	}
+	expectStatus(t, b, WorkQueueStatus{0, 0, 5})
+
+	b.Close()
+}
+
+// Replacing the list resets all the counts.  Items from the old list
+// that are still in progress are not counted against the new one when
+// they finish.
+func TestWorkQueueStatusReplaceQueue(t *testing.T) {
+	var firstInput = []int{1, 2, 3, 4, 5}
+	var replaceInput = []int{6, 7, 8}
+
+	b := NewWorkQueue()
+	b.ReplaceQueue(makeTestWorkList(firstInput))
+	expectFromChannel(t, b.NextItem, firstInput[0:2])
+	b.DoneItem()
+	expectStatus(t, b, WorkQueueStatus{3, 1, 1})
+
+	b.ReplaceQueue(makeTestWorkList(replaceInput))
+	expectStatus(t, b, WorkQueueStatus{3, 0, 0})
+
+	expectFromChannel(t, b.NextItem, replaceInput)
+	expectStatus(t, b, WorkQueueStatus{0, 3, 0})
+
+	// The old item finishes, then the new ones.
+	b.DoneItem()
+	expectStatus(t, b, WorkQueueStatus{0, 3, 0})
+	for i := 0; i < 2; i++ {
+		b.DoneItem()
+	}
+	expectStatus(t, b, WorkQueueStatus{0, 1, 2})
+	b.DoneItem()
+	expectStatus(t, b, WorkQueueStatus{0, 0, 3})
+
+	b.Close()
+}